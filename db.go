@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/sethgrid/countmyreps/v2/teamname"
 )
 
 func totalReps(d []RepData) int {
@@ -181,29 +182,34 @@ func getUserTeams(db *sql.DB, email string) []string {
 	return teams
 }
 
+// getTeamID finds the team by its teamname.Key, so " münchen ", "MÜNCHEN" and "München" typed with a combining umlaut are all the same team
 func getTeamID(db *sql.DB, teamName string, createIfMissing bool) (int, error) {
 	var id int
-	teamName = strings.TrimSpace(teamName)
-	q := "SELECT id FROM team WHERE name=? LIMIT 1"
-	rows, err := db.Query(q, teamName)
+	teamName = teamname.Normalize(teamName)
+	key := teamname.Key(teamName)
+	q := "SELECT id, name FROM team ORDER BY id"
+	rows, err := db.Query(q)
 	if err != nil {
 		return 0, errors.Wrapf(err, "unable to scan team id for %q", teamName)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		err = rows.Scan(&id)
+		var name string
+		err = rows.Scan(&id, &name)
 		if err != nil {
 			continue
 		}
 
-		return id, nil
+		if teamname.Key(name) == key {
+			return id, nil
+		}
 	}
 	if rows.Err() != nil {
 		logError(nil, err, "error after rows.Next in getTeamID")
 	}
 
-	if id == 0 && createIfMissing {
+	if createIfMissing {
 		res, err := db.Exec("INSERT INTO team SET name=?", teamName)
 		if err != nil {
 			return 0, errors.Wrapf(err, "unable to insert team id for %q", teamName)
@@ -219,13 +225,12 @@ func getTeamID(db *sql.DB, teamName string, createIfMissing bool) (int, error) {
 }
 
 func addTeam(db *sql.DB, teamName string, userID int) error {
-	teamName = strings.TrimSpace(teamName)
 	teamID, err := getTeamID(db, teamName, true)
 	if err != nil {
 		return err
 	}
 
-	if isOnTeam(db, teamName, userID) {
+	if isOnTeam(db, teamID, userID) {
 		return nil
 	}
 
@@ -238,11 +243,11 @@ func addTeam(db *sql.DB, teamName string, userID int) error {
 	return nil
 }
 
-func isOnTeam(db *sql.DB, teamName string, userID int) bool {
-	q := "SELECT count(*) FROM user_team WHERE user_team.team_id=(SELECT id FROM team WHERE name=?) AND user_team.user_id=?"
-	rows, err := db.Query(q, teamName, userID)
+func isOnTeam(db *sql.DB, teamID int, userID int) bool {
+	q := "SELECT count(*) FROM user_team WHERE user_team.team_id=? AND user_team.user_id=?"
+	rows, err := db.Query(q, teamID, userID)
 	if err != nil {
-		logError(nil, errors.Wrap(err, queryPrinter(q, teamName, userID)), "unable to check for team membership")
+		logError(nil, errors.Wrap(err, queryPrinter(q, teamID, userID)), "unable to check for team membership")
 		return false
 	}
 	defer rows.Close()
@@ -260,7 +265,6 @@ func isOnTeam(db *sql.DB, teamName string, userID int) bool {
 }
 
 func removeTeam(db *sql.DB, teamName string, userID int) error {
-	teamName = strings.TrimSpace(teamName)
 	teamID, err := getTeamID(db, teamName, false)
 	if err != nil {
 		return err
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	htmltemplate "html/template"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	texttemplate "text/template"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
-// TODO: change to interface so we can unit test
-
 // ErrSubjectFmt ...
 var ErrSubjectFmt = "CountMyReps was unable to parse your subject. Please provide FOUR comma separated numbers like: `5, 10, 15, 20` where the numbers represent pull ups, push ups, squats, and situps respectively. You provided \"%s\""
 
@@ -25,9 +31,45 @@ var ErrFromFmt = "CountMyReps only accepts mail from the sendgrid domain. You us
 // ErrUnexpectedFmt ...
 var ErrUnexpectedFmt = "CountMyReps experienced an unexpected error, please try again later. Error: %s"
 
-// Emailer interface allows us to send emails
+// SuccessEmailHTML and SuccessEmailText render the multipart success email
+var SuccessEmailHTML *htmltemplate.Template
+var SuccessEmailText *texttemplate.Template
+
+// ErrorEmailHTML and ErrorEmailText render the multipart error email
+var ErrorEmailHTML *htmltemplate.Template
+var ErrorEmailText *texttemplate.Template
+
+func init() {
+	var err error
+
+	// funcs shared by the html and text email templates
+	funcs := map[string]interface{}{
+		"join": strings.Join,
+	}
+
+	// like the page templates, these are parsed once; restart the process to load file changes
+	emailDir := filepath.Join("go_templates", "email")
+	SuccessEmailHTML, err = htmltemplate.New("success.html").Funcs(funcs).ParseFiles(filepath.Join(emailDir, "success.html"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	SuccessEmailText, err = texttemplate.New("success.txt").Funcs(funcs).ParseFiles(filepath.Join(emailDir, "success.txt"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ErrorEmailHTML, err = htmltemplate.New("error.html").Funcs(funcs).ParseFiles(filepath.Join(emailDir, "error.html"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ErrorEmailText, err = texttemplate.New("error.txt").Funcs(funcs).ParseFiles(filepath.Join(emailDir, "error.txt"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Emailer interface allows us to send emails. Messages are sent as multipart/alternative with both an html and a plain text body
 type Emailer interface {
-	SendEmail(to string, subject string, msg string) error
+	SendEmail(to string, subject string, htmlMsg string, textMsg string) error
 }
 
 // FakeEmailer is useful for testing
@@ -36,7 +78,7 @@ type FakeEmailer struct {
 }
 
 // SendEmail is a NoOp for the FakeEmailer, returning what ever error we need
-func (f FakeEmailer) SendEmail(to string, subject string, msg string) error {
+func (f FakeEmailer) SendEmail(to string, subject string, htmlMsg string, textMsg string) error {
 	return f.Err
 }
 
@@ -44,7 +86,7 @@ func (f FakeEmailer) SendEmail(to string, subject string, msg string) error {
 type SendGridEmailer struct{}
 
 // SendEmail sends an email through SendGrid
-func (SendGridEmailer) SendEmail(to string, subject string, msg string) error {
+func (SendGridEmailer) SendEmail(to string, subject string, htmlMsg string, textMsg string) error {
 	from := mail.NewEmail("CountMyReps", "automailer@countmyreps.com")
 	// at this point, all recipients _should_ be firstname.lastname@sendgrid.com or firstname@sendgrid.com
 	toName := strings.Split(to, ".")[0]
@@ -53,10 +95,8 @@ func (SendGridEmailer) SendEmail(to string, subject string, msg string) error {
 	}
 	toAddr := mail.NewEmail(toName, to)
 
-	msg = `<img src="http://countmyreps.com/images/mustache-thin.jpg" style="margin:auto; width:300px; display:block"/>` + msg
-
-	content := mail.NewContent("text/html", msg)
-	m := mail.NewV3MailInit(from, subject, toAddr, content)
+	// SendGrid requires text/plain to come before text/html
+	m := mail.NewV3MailInit(from, subject, toAddr, mail.NewContent("text/plain", textMsg), mail.NewContent("text/html", htmlMsg))
 
 	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
 	request.Method = "POST"
@@ -71,84 +111,185 @@ func (SendGridEmailer) SendEmail(to string, subject string, msg string) error {
 	return nil
 }
 
+// ErrorEmailData is the data needed to populate the error email templates
+type ErrorEmailData struct {
+	ImageURL string
+	NewEmail string
+	Offices  []string
+	To       string
+	Subject  string
+	Time     string
+	Error    string
+}
+
+// SuccessEmailData is the data needed to populate the success email templates
+type SuccessEmailData struct {
+	ImageURL string
+	ViewURL  string
+	NewEmail string
+	Offices  []string
+
+	Email         string
+	TotalReps     int
+	AveragePerDay int
+	CurrentStreak int
+	LongestStreak int
+
+	// Office is empty when the user has not linked their reps to an office
+	Office           string
+	OfficeComparison string
+	OfficeTotals     []OfficeTotal
+	Teams            []TeamStanding
+}
+
+// OfficeTotal is an office's rep total for the challenge
+type OfficeTotal struct {
+	Name      string
+	TotalReps int
+}
+
+// TeamStanding is where one of the user's teams ranks against all teams by reps per person per day
+type TeamStanding struct {
+	Name                string
+	Rank                int
+	TeamCount           int
+	RepsPerPersonPerDay int
+	TotalReps           int
+}
+
 // SendErrorEmail sets up the error message and then calls sendEmail
 func (s *Server) SendErrorEmail(rcpt string, originalAddressTo string, subject string, msg string) error {
-	officeList := strings.Join(Offices, ", ")
-	msgFmt := `
-	<h3>Uh oh!</h3>
-	<p>
-	There was an error with your CountMyReps Submission.<br /><br />
-    Make sure that you addressed your email to %s<br />
-    Make sure that your subject line was FOUR comma separated numbers, like: 5, 10, 15, 20<br />
-    If you were trying to set your office location, make sure you choose one from:<br />
-	%s<br />
-	(This should be sent in its own email). The same for if you are removing or adding a team. Use 'Team Add: team-name' or 'Team Remove: team-name'.
-    </p>
-	<p>
-    Details from received message:<br />
-    Addessed to: %s<br />
-    Subject: %s<br />
-    Time: %s<br />
-	Error: %s<br />
-	</p>`
-	return EmailSender.SendEmail(rcpt, "Error with your submission", fmt.Sprintf(msgFmt, NewEmail, officeList, originalAddressTo, subject, time.Now().String(), msg))
+	data := ErrorEmailData{
+		ImageURL: emailImageURL(),
+		NewEmail: NewEmail,
+		Offices:  Offices,
+		To:       originalAddressTo,
+		Subject:  subject,
+		Time:     time.Now().String(),
+		Error:    msg,
+	}
+	htmlMsg, textMsg, err := renderEmail(ErrorEmailHTML, ErrorEmailText, data)
+	if err != nil {
+		return err
+	}
+	return EmailSender.SendEmail(rcpt, "Error with your submission", htmlMsg, textMsg)
 }
 
 // SendSuccessEmail sets up the success message and calls sendEmail
 func (s *Server) SendSuccessEmail(to string) error {
 	office := getUserOffice(s.DB, to)
 	officeStats := getOfficeStats(s.DB)
-	var officeMsg string
-	var forTheTeam string
-	if office == "" || office == "Unknown" {
-		officeMsg = fmt.Sprintf("You've not linked your reps to an office. Send an email to %s with your office in the subject line. Valid office choices are: <br />%s", NewEmail, strings.Join(Offices, ", "))
-		forTheTeam = ""
-	} else {
-		officeMsg = officeComparisonUpdate(office, officeStats)
-		forTheTeam = fmt.Sprintf(" for the %s team", office)
+
+	data := SuccessEmailData{
+		ImageURL: emailImageURL(),
+		ViewURL:  fmt.Sprintf("%s/view?email=%s", SiteURL, url.QueryEscape(to)),
+		NewEmail: NewEmail,
+		Offices:  Offices,
+		Email:    to,
+	}
+
+	if office != "" && office != "Unknown" {
+		data.Office = office
+		data.OfficeComparison = officeComparisonUpdate(office, officeStats)
 	}
-	total := totalReps(getUserReps(s.DB, to))
+
+	userReps := getUserReps(s.DB, to)
+	data.TotalReps = totalReps(userReps)
 	days := int(time.Since(StartDate).Hours() / float64(24))
 	if days == 0 {
 		days = 1 // avoid divide by zero
 	}
-	avg := total / days
+	data.AveragePerDay = data.TotalReps / days
+	data.CurrentStreak, data.LongestStreak = streaks(userReps, time.Now())
 
-	var data []string
 	for officeName, stats := range officeStats {
-		data = append(data, fmt.Sprintf("%s: %d", officeName, stats.TotalReps))
+		data.OfficeTotals = append(data.OfficeTotals, OfficeTotal{Name: officeName, TotalReps: stats.TotalReps})
 	}
+	sort.Slice(data.OfficeTotals, func(i, j int) bool { return data.OfficeTotals[i].Name < data.OfficeTotals[j].Name })
 
-	var teamsMsg string
-	teams := getUserTeams(s.DB, to)
-	if len(teams) == 0 {
-		teamsMsg = "You are not with any teams yet! Send an email with the subject 'Team Add: team-name' to get on a team. You can be on multiple teams!"
-	} else {
-		teamsMsg = "You are on the following teams. You can send an email with the subject 'Team Remove: team-name' to get off them, or `Team Add: team-name' to join others."
-		var teamList string
-		for _, team := range teams {
-			teamList += fmt.Sprintf("<li>%s</li>", team)
+	data.Teams = teamStandings(getUserTeams(s.DB, to), getTeamStats(s.DB))
+
+	htmlMsg, textMsg, err := renderEmail(SuccessEmailHTML, SuccessEmailText, data)
+	if err != nil {
+		return err
+	}
+	return EmailSender.SendEmail(to, "Success!", htmlMsg, textMsg)
+}
+
+// renderEmail executes both versions of an email template with the same data
+func renderEmail(h *htmltemplate.Template, t *texttemplate.Template, data interface{}) (string, string, error) {
+	var htmlBuf, textBuf bytes.Buffer
+	if err := h.Execute(&htmlBuf, data); err != nil {
+		return "", "", errors.Wrapf(err, "unable to execute %s template", h.Name())
+	}
+	if err := t.Execute(&textBuf, data); err != nil {
+		return "", "", errors.Wrapf(err, "unable to execute %s template", t.Name())
+	}
+	return htmlBuf.String(), textBuf.String(), nil
+}
+
+func emailImageURL() string {
+	return SiteURL + "/images/mustache-thin.jpg"
+}
+
+// streaks returns the current and longest run of consecutive days with reps logged. RepData must be in date order, as from initRepData.
+// A current streak is still alive if the user has not logged anything yet today but did yesterday.
+func streaks(d []RepData, now time.Time) (int, int) {
+	today := fmt.Sprintf("%d-%d", int(now.Month()), now.Day())
+
+	var current, longest, run int
+	for _, rd := range d {
+		active := totalReps([]RepData{rd}) > 0
+		if active {
+			run++
+		} else if rd.Date != today {
+			run = 0
+		}
+		if run > longest {
+			longest = run
+		}
+		if rd.Date == today {
+			current = run
+			break
 		}
-		teamsMsg = fmt.Sprintf("%s<ul>%s</ul>", teamsMsg, teamList)
-	}
-
-	officeTotals := "The office totals are: " + strings.Join(data, ", ")
-
-	msg := fmt.Sprintf(`<h3>Keep it up!</h3>
-	<p>
-	You've logged a total of %d%s, an average of %d per day.
-	</p>
-	<p>
-	%s
-	</p>
-	<p>
-	%s
-	</p>
-	<p>
-	%s
-	</p>`, total, forTheTeam, avg, officeMsg, teamsMsg, officeTotals)
-
-	return EmailSender.SendEmail(to, "Success!", msg)
+	}
+	return current, longest
+}
+
+// teamStandings ranks each of the user's teams against all teams by reps per person per day
+func teamStandings(userTeams []string, teamStats map[string]Stats) []TeamStanding {
+	var names []string
+	for name := range teamStats {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := teamStats[names[i]], teamStats[names[j]]
+		if a.RepsPerPersonPerDay != b.RepsPerPersonPerDay {
+			return a.RepsPerPersonPerDay > b.RepsPerPersonPerDay
+		}
+		return names[i] < names[j]
+	})
+
+	rank := make(map[string]int)
+	for i, name := range names {
+		rank[name] = i + 1
+	}
+
+	var standings []TeamStanding
+	for _, team := range userTeams {
+		stats, ok := teamStats[team]
+		if !ok {
+			continue
+		}
+		standings = append(standings, TeamStanding{
+			Name:                team,
+			Rank:                rank[team],
+			TeamCount:           len(names),
+			RepsPerPersonPerDay: stats.RepsPerPersonPerDay,
+			TotalReps:           stats.TotalReps,
+		})
+	}
+	return standings
 }
 
 // extractEmailAddr gets the email address from the email string
@@ -166,6 +166,44 @@ func TestAddRemoveTeam(t *testing.T) {
 	}
 }
 
+func TestAddExistingTeamByEmail(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+
+	teamID, err := getTeamID(srv.DB, "São Paulo", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = parseAPIRecv(srv.Port, "Team Add: São Paulo", "oc_3@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := getTeamID(srv.DB, "São Paulo", false); err != nil || got != teamID {
+		t.Errorf("got team %d (%v), want the existing team %d", got, err, teamID)
+	}
+	var count int
+	if err := srv.DB.QueryRow("SELECT count(*) FROM team WHERE name LIKE 'S%Paulo'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("got %d São Paulo teams, want the email add to join the existing one", count)
+	}
+
+	resp, err := getResponse(srv.Port, "/json?email=oc_3@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vd := ViewData{}
+	if err := json.Unmarshal(resp.body, &vd); err != nil {
+		t.Error(err)
+	}
+	if !contains("São Paulo", vd.UserTeams) {
+		t.Errorf("got %v, want %s in list", vd.UserTeams, "São Paulo")
+	}
+}
+
 func contains(needle string, haystack []string) bool {
 	for _, s := range haystack {
 		if s == needle {
@@ -18,6 +18,7 @@ import (
 	"github.com/facebookgo/flagenv"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	"github.com/sethgrid/countmyreps/v2/teamname"
 )
 
 // ViewTemplate displays /view
@@ -115,6 +116,9 @@ const (
 // Debug turns on more verbose logging
 var Debug bool
 
+// SiteURL is the public scheme and host used to build links and image urls in emails
+var SiteURL string
+
 // EmailSender allows us to swap out how we send the email (specifically, SendGrid vs Fake/Test)
 var EmailSender Emailer
 
@@ -140,6 +144,7 @@ func main() {
 	flag.StringVar(&mysqlPass, "mysql-pass", "", "mysql pass")
 	flag.StringVar(&mysqlDBname, "mysql-dbname", "countmyreps", "mysql dbname")
 	flag.BoolVar(&Debug, "debug", false, "set flag for verbose logging")
+	flag.StringVar(&SiteURL, "site-url", "https://countmyreps.com", "public url used for links and images in emails")
 
 	flagenv.Parse()
 	flag.Parse()
@@ -389,13 +394,7 @@ func (s *Server) ParseHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func sanitizeTeamName(teamName string) string {
-	var rns []rune
-	for _, r := range teamName {
-		if strings.ContainsAny(string(r), "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890_") {
-			rns = append(rns, r)
-		}
-	}
-	return string(rns)
+	return teamname.Sanitize(teamName)
 }
 
 // ViewData is the data needed to populate the view.html template
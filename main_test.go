@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestExtractEmailAddr(t *testing.T) {
@@ -87,9 +89,13 @@ func TestSanitizeTeamName(t *testing.T) {
 		{"Sales1", "Sales1"},
 		{"Big_Data", "Big_Data"},
 		{" Engineering  ", "Engineering"},
-		{"Big-Data", "BigData"},
-		{"Big Data", "BigData"},
-		{"<script type='javascript'>", "scripttypejavascript"},
+		{"Big-Data", "Big-Data"},
+		{"Big Data", "Big Data"},
+		{"<script type='javascript'>", "script typejavascript"},
+		{"München", "München"},
+		{"Mu\u0308nchen", "München"},
+		{"São Paulo", "São Paulo"},
+		{" Dublin (Block)", "Dublin (Block)"},
 	}
 	for _, test := range tests {
 		if got, want := sanitizeTeamName(test.in), test.out; got != want {
@@ -133,3 +139,94 @@ func fakeStats() map[string]Stats {
 
 	return stats
 }
+
+func TestStreaks(t *testing.T) {
+	now := time.Date(2016, 11, 5, 12, 0, 0, 0, time.UTC)
+	rd := func(day int, count int) RepData {
+		return RepData{Date: fmt.Sprintf("11-%d", day), ExerciseCounts: map[string]int{PushUps: count}}
+	}
+
+	tests := []struct {
+		name    string
+		data    []RepData
+		current int
+		longest int
+	}{
+		{"no reps", []RepData{rd(1, 0), rd(2, 0), rd(3, 0), rd(4, 0), rd(5, 0)}, 0, 0},
+		{"every day", []RepData{rd(1, 5), rd(2, 5), rd(3, 5), rd(4, 5), rd(5, 5)}, 5, 5},
+		{"not yet today", []RepData{rd(1, 0), rd(2, 5), rd(3, 5), rd(4, 5), rd(5, 0)}, 3, 3},
+		{"broken streak", []RepData{rd(1, 5), rd(2, 5), rd(3, 5), rd(4, 0), rd(5, 5)}, 1, 3},
+		{"missed yesterday", []RepData{rd(1, 5), rd(2, 5), rd(3, 0), rd(4, 0), rd(5, 0), rd(6, 0)}, 0, 2},
+	}
+	for _, test := range tests {
+		current, longest := streaks(test.data, now)
+		if got, want := current, test.current; got != want {
+			t.Errorf("%s: got current streak %d, want %d", test.name, got, want)
+		}
+		if got, want := longest, test.longest; got != want {
+			t.Errorf("%s: got longest streak %d, want %d", test.name, got, want)
+		}
+	}
+}
+
+func TestTeamStandings(t *testing.T) {
+	standings := teamStandings([]string{"OC", "unknown team"}, fakeStats())
+
+	if got, want := len(standings), 1; got != want {
+		t.Fatalf("got %d standings, want %d", got, want)
+	}
+	if got, want := standings[0].Rank, 3; got != want {
+		t.Errorf("got rank %d, want %d", got, want)
+	}
+	if got, want := standings[0].TeamCount, 3; got != want {
+		t.Errorf("got team count %d, want %d", got, want)
+	}
+}
+
+func TestSuccessEmailTemplates(t *testing.T) {
+	data := SuccessEmailData{
+		ImageURL:         "https://countmyreps.com/images/mustache-thin.jpg",
+		ViewURL:          "https://countmyreps.com/view?email=oc_1%40sendgrid.com",
+		NewEmail:         NewEmail,
+		Email:            "oc_1@sendgrid.com",
+		TotalReps:        495,
+		AveragePerDay:    33,
+		CurrentStreak:    4,
+		LongestStreak:    9,
+		Office:           "OC",
+		OfficeComparison: officeComparisonUpdate("OC", fakeStats()),
+		OfficeTotals:     []OfficeTotal{{"Denver", 1000}, {"OC", 600}},
+		Teams:            []TeamStanding{{Name: "<eng>", Rank: 2, TeamCount: 4, RepsPerPersonPerDay: 12}},
+	}
+
+	htmlMsg, textMsg, err := renderEmail(SuccessEmailHTML, SuccessEmailText, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("HTML:\n%s\nText:\n%s", htmlMsg, textMsg)
+
+	for _, want := range []string{
+		"You've logged a total of 495 for the OC team, an average of 33 per day.",
+		"You are on a 4 day streak (your longest is 9 days).",
+		"ranked 2 of 4 with 12 reps per person per day",
+		"The office totals are: Denver: 1000, OC: 600",
+	} {
+		if !strings.Contains(htmlMsg, want) {
+			t.Errorf("html not found: %q", want)
+		}
+		if !strings.Contains(textMsg, want) {
+			t.Errorf("text not found: %q", want)
+		}
+	}
+
+	// team names come from users, so they must be escaped in html but not in text
+	if !strings.Contains(htmlMsg, "&lt;eng&gt;") {
+		t.Errorf("html team name not escaped")
+	}
+	if !strings.Contains(textMsg, "<eng>") {
+		t.Errorf("text team name unexpectedly escaped")
+	}
+	if strings.Contains(textMsg, "<img") {
+		t.Errorf("found html in text email")
+	}
+}
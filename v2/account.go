@@ -0,0 +1,242 @@
+package countmyreps
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// what DELETE /v3/me does, set with COUNTMYREPS_ACCOUNT_DELETION
+const (
+	deletionAnonymize = "anonymize"
+	deletionHard      = "delete"
+)
+
+// MyData is everything stored about a user, for GET /v3/me/data
+type MyData struct {
+	ID          int
+	Email       string
+	CreatedOn   string
+	Preferences *Preferences
+	Reps        []Rep
+	Teams       []Team
+	// OwnedTeams are the teams the user created
+	OwnedTeams    []Team
+	Goals         []Goal
+	StreakFreezes []string
+	Achievements  []Achievement
+	Webhooks      []Webhook
+	JoinRequests  []JoinRequest
+	Imports       []Import
+	// RemindersSent are when reminder emails were sent, as unix times
+	RemindersSent []int
+	// Activity is the audit log of changes the user made
+	Activity []AuditEntry
+}
+
+// getMyData gathers everything tied to the user. It returns nil if there is no such user
+func (s *Server) getMyData(uid int, now time.Time) (*MyData, error) {
+	data := &MyData{ID: uid}
+	err := s.DB.QueryRow("select coalesce(email, ''), coalesce(created_on, '') from users where id=?", uid).Scan(&data.Email, &data.CreatedOn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan getMyData: %w", err)
+	}
+
+	if data.Preferences, err = s.getPreferences(uid); err != nil {
+		return nil, err
+	}
+	if data.Reps, err = s.getReps(uid, 0, int(now.Unix())); err != nil {
+		return nil, err
+	}
+	teams, err := s.getMyTeams(uid)
+	if err != nil {
+		return nil, err
+	}
+	data.Teams = teams.Collection
+	owned, err := s.getAllTeams(uid)
+	if err != nil {
+		return nil, err
+	}
+	data.OwnedTeams = owned.Collection
+	if data.Goals, err = s.getGoals(uid, now); err != nil {
+		return nil, err
+	}
+	if data.StreakFreezes, err = s.getStreakFreezes(uid); err != nil {
+		return nil, err
+	}
+	if data.Achievements, err = s.getAchievements(uid); err != nil {
+		return nil, err
+	}
+	if data.Webhooks, err = s.getWebhooks(uid); err != nil {
+		return nil, err
+	}
+	if data.JoinRequests, err = s.queryJoinRequests("where user_id=? order by team_join_requests.created_on", uid); err != nil {
+		return nil, err
+	}
+	if data.Imports, err = s.getImports(uid); err != nil {
+		return nil, err
+	}
+	if data.RemindersSent, err = s.getReminderTimes(uid); err != nil {
+		return nil, err
+	}
+	// a limit of -1 is no limit
+	if data.Activity, err = s.getAudit(auditFilter{ActorID: uid, Limit: -1}); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// getReminderTimes returns when every reminder was sent to the user, oldest first
+func (s *Server) getReminderTimes(uid int) ([]int, error) {
+	rows, err := s.DB.Query("select sent_on from reminders where user_id=? order by sent_on", uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getReminderTimes: %w", err)
+	}
+	defer rows.Close()
+
+	sent := make([]int, 0)
+	for rows.Next() {
+		var on int
+		if err := rows.Scan(&on); err != nil {
+			return nil, fmt.Errorf("unable to scan getReminderTimes: %w", err)
+		}
+		sent = append(sent, on)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getReminderTimes: %w", err)
+	}
+	return sent, nil
+}
+
+// deleteUser removes the user's personal data, and then either anonymizes them, keeping their reps and memberships so team
+// totals stay the same, or deletes them along with their reps and memberships. Teams, team goals, and challenges they created
+// are kept for their members and become ownerless, like the seeded teams. The user's audit entries are kept with their before
+// and after redacted. It returns how many reps were anonymized or deleted
+func (s *Server) deleteUser(uid int, mode string) (int, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to begin deleteUser: %w", err)
+	}
+
+	var reps int
+	if err := tx.QueryRow("select count(*) from reps where user_id=?", uid).Scan(&reps); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to count deleteUser reps: %w", err)
+	}
+
+	// the log keeps who did what and when, but not the records: the user's own changes, and changes to them, their reps, and their imports
+	q := "update audit set before_value=case when before_value='' then '' else ? end, after_value=case when after_value='' then '' else ? end " +
+		"where actor_id=? or (subject_type='user' and subject_id=?) or (subject_type='rep' and subject_id in (select id from reps where user_id=?)) " +
+		"or (subject_type='import' and subject_id in (select id from imports where user_id=?))"
+	if _, err := tx.Exec(q, auditRedacted, auditRedacted, uid, uid, uid, uid); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to redact deleteUser audit: %w", err)
+	}
+
+	stmts := []string{
+		"delete from webhook_deliveries where webhook_id in (select id from webhooks where user_id=?)",
+		"delete from webhooks where user_id=?",
+		"delete from reminders where user_id=?",
+		"delete from streak_freezes where user_id=?",
+		"delete from achievements where user_id=?",
+		"delete from goals where user_id=? and team_id=0",
+		"delete from team_join_requests where user_id=?",
+		"update goals set user_id=-1 where user_id=?",
+		"update teams set created_by_user_id=-1 where created_by_user_id=?",
+		"update team_invites set created_by_user_id=-1 where created_by_user_id=?",
+		"update challenges set created_by_user_id=-1 where created_by_user_id=?",
+	}
+	if mode == deletionHard {
+		stmts = append(stmts,
+			"delete from reps where user_id=?",
+			"delete from user_teams where user_id=?",
+			"update imports set user_id=-1 where user_id=?",
+			"delete from users where id=?",
+		)
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt, uid); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("unable to deleteUser '%s': %w", stmt, err)
+		}
+	}
+
+	if mode != deletionHard {
+		// the placeholder is not an address, so nothing is ever emailed to it, and signing in again with the old email starts over
+		q := "update users set email=?, digest='', reminders=0 where id=?"
+		if _, err := tx.Exec(q, fmt.Sprintf("deleted-%d", uid), uid); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("unable to anonymize user: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit deleteUser: %w", err)
+	}
+
+	// sign the user out everywhere
+	for key, item := range s.tokenCache.Items() {
+		if t, ok := item.Object.(Token); ok && t.uid == uid {
+			s.tokenCache.Delete(key)
+		}
+	}
+	return reps, nil
+}
+
+// GetMyData returns everything stored about you
+func (s *Server) GetMyData(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	data, err := s.getMyData(uid, time.Now())
+	if err != nil {
+		log.Printf("unable to GetMyData: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="countmyreps-data.json"`)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("GetMyData marshal err ", err.Error())
+	}
+}
+
+// DeleteMe deletes or anonymizes your account, depending on COUNTMYREPS_ACCOUNT_DELETION. Requires ?confirm=true
+func (s *Server) DeleteMe(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	if confirm, _ := strconv.ParseBool(r.URL.Query().Get("confirm")); !confirm {
+		http.Error(w, "deleting your account cannot be undone; send ?confirm=true", http.StatusBadRequest)
+		return
+	}
+
+	// let subscribers finish with the user's earlier changes first, or a late one could award badges to the deleted account
+	s.events.wait()
+	mode := s.conf.AccountDeletion
+	reps, err := s.deleteUser(uid, mode)
+	if err != nil {
+		log.Printf("unable to DeleteMe: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the entry keeps only the user id, never the email
+	s.auditRequest(r, uid, AuditEntry{Action: "user.delete", SubjectType: "user", SubjectID: uid, After: auditJSON(struct {
+		Mode string
+		Reps int
+	}{mode, reps})})
+
+	if err := json.NewEncoder(w).Encode(struct {
+		Mode string
+		Reps int
+	}{mode, reps}); err != nil {
+		log.Println("DeleteMe marshal err ", err.Error())
+	}
+}
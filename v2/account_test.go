@@ -0,0 +1,132 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMyData(t *testing.T) {
+	s, _ := newTestServer(t)
+	day := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+
+	lifter := newTestClient(t, s, "lifter@twilio.com")
+	team, err := s.postTeam("Lifters", lifter.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsertReps(t, s, lifter.UID, "Push Ups", 20, day)
+
+	w := lifter.do("GET", "/v3/me/data", "")
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("got %d, want %d: %s", got, want, w.Body)
+	}
+	var data MyData
+	if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := data.Email, "lifter@twilio.com"; got != want {
+		t.Errorf("got email %q, want %q", got, want)
+	}
+	if got, want := [3]int{len(data.Reps), len(data.Teams), len(data.OwnedTeams)}, [3]int{1, 1, 1}; got != want {
+		t.Errorf("got reps, teams, and owned teams %v, want %v", got, want)
+	}
+	if got, want := data.OwnedTeams[0].ID, team.ID; got != want {
+		t.Errorf("got owned team %d, want %d", got, want)
+	}
+}
+
+func TestDeleteMe(t *testing.T) {
+	for _, mode := range []string{deletionAnonymize, deletionHard} {
+		t.Run(mode, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			s.conf.AccountDeletion = mode
+			day := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+			start, end := int(day.Add(-24*time.Hour).Unix()), int(day.Add(24*time.Hour).Unix())
+
+			leaving := newTestClient(t, s, "leaving@twilio.com")
+			staying := newTestClient(t, s, "staying@twilio.com")
+			team, err := s.postTeam("Lifters", leaving.UID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.postMyTeams(team.ID, staying.UID); err != nil {
+				t.Fatal(err)
+			}
+			mustInsertReps(t, s, leaving.UID, "Push Ups", 20, day)
+			mustInsertReps(t, s, staying.UID, "Push Ups", 5, day)
+			if got, want := leaving.do("POST", "/v3/stats", `{"Exercises": [{"Name": "Squats", "Count": 30}]}`).Code, http.StatusCreated; got != want {
+				t.Fatalf("got %d logging reps, want %d", got, want)
+			}
+			before, err := s.getTeamExerciseTotals(team.ID, start, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := leaving.do("DELETE", "/v3/me", "").Code, http.StatusBadRequest; got != want {
+				t.Errorf("got %d without confirming, want %d", got, want)
+			}
+			w := leaving.do("DELETE", "/v3/me?confirm=true", "")
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("got %d, want %d: %s", got, want, w.Body)
+			}
+			if got, want := leaving.do("GET", "/v3/me/data", "").Code, http.StatusBadRequest; got != want {
+				t.Errorf("got %d with the deleted user's token, want %d", got, want)
+			}
+
+			owner, found, _ := s.getTeamOwner(team.ID)
+			if !found || owner != -1 {
+				t.Errorf("got team owner %d (found %t), want the team kept without an owner", owner, found)
+			}
+			if achievements, _ := s.getAchievements(leaving.UID); len(achievements) != 0 {
+				t.Errorf("got %d badges for the deleted user, want none", len(achievements))
+			}
+			if email, _ := s.getUserEmail(leaving.UID); email == "leaving@twilio.com" {
+				t.Errorf("got the deleted user's email still stored")
+			}
+
+			after, err := s.getTeamExerciseTotals(team.ID, start, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reps, _ := s.getReps(leaving.UID, start, end)
+			switch mode {
+			case deletionAnonymize:
+				if !reflect.DeepEqual(before, after) {
+					t.Errorf("got team totals %+v after anonymizing, want them unchanged %+v", after, before)
+				}
+				if got, want := len(reps), 1; got != want {
+					t.Errorf("got %d anonymized reps, want %d", got, want)
+				}
+			case deletionHard:
+				if got, want := after[0].Count, 5; got != want {
+					t.Errorf("got team count %d after deleting, want only the remaining member's %d", got, want)
+				}
+				if got := len(reps); got != 0 {
+					t.Errorf("got %d reps after deleting, want none", got)
+				}
+				if member, _ := s.isTeamMember(team.ID, leaving.UID); member {
+					t.Errorf("got the deleted user still on the team")
+				}
+			}
+
+			logged, err := s.getAudit(auditFilter{ActorID: leaving.UID, Action: "rep.create", Limit: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(logged) != 1 || string(logged[0].After) != auditRedacted {
+				t.Errorf("got %+v, want the logged reps kept in the audit log with their values redacted", logged)
+			}
+
+			entries, err := s.getAudit(auditFilter{Action: "user.delete", Limit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].SubjectID != leaving.UID {
+				t.Errorf("got %+v, want the deletion audited", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Achievement is a badge. AwardedOn is when it was earned, which for backfilled awards is when the qualifying reps were logged
+type Achievement struct {
+	ID          string
+	Name        string
+	Description string
+	AwardedOn   int `json:",omitempty"`
+}
+
+// repHistory is everything a rule can look at: the user's reps oldest first, in their timezone, with their rest days
+type repHistory struct {
+	reps   []Rep
+	loc    *time.Location
+	frozen map[string]bool
+}
+
+// achievementRule is met at the time returned by earnedOn, or not at all
+type achievementRule struct {
+	ID          string
+	Name        string
+	Description string
+	earnedOn    func(h *repHistory) (time.Time, bool)
+}
+
+// achievementRules are checked in order; the order is also how badges are listed
+var achievementRules = []achievementRule{
+	totalRule("first-rep", "First Rep", "Log your first exercise", "", 1),
+	totalRule("push-ups-1000", "1,000 Push Ups", "Log 1,000 push ups", "Push Ups", 1000),
+	totalRule("push-ups-10000", "10,000 Push Ups", "Log 10,000 push ups", "Push Ups", 10000),
+	totalRule("sit-ups-1000", "1,000 Sit Ups", "Log 1,000 sit ups", "Sit Ups", 1000),
+	totalRule("squats-1000", "1,000 Squats", "Log 1,000 squats", "Squats", 1000),
+	totalRule("pull-ups-500", "500 Pull Ups", "Log 500 pull ups", "Pull Ups", 500),
+	totalRule("burpees-1000", "1,000 Burpees", "Log 1,000 burpees", "Burpees", 1000),
+	singleRule("first-10k", "First 10K Run", "Run 10 km in one go", "Running", 10000),
+	totalRule("running-100k", "100 km Run", "Run 100 km in total", "Running", 100000),
+	streakRule("streak-7", "Week Streak", "Log something 7 days in a row", 7),
+	streakRule("streak-30", "30 Day Streak", "Log something 30 days in a row", 30),
+	everyDayOfMonthRule("every-day-november", "Perfect November", "Log something every day of November", time.November),
+}
+
+// totalRule is met when the running total for the exercise reaches total. An empty exercise counts every exercise
+func totalRule(id, name, description, exercise string, total int) achievementRule {
+	return achievementRule{ID: id, Name: name, Description: description, earnedOn: func(h *repHistory) (time.Time, bool) {
+		var sum int
+		for _, rep := range h.reps {
+			if exercise != "" && rep.Name != exercise {
+				continue
+			}
+			sum += rep.Count
+			if sum >= total {
+				return time.Unix(int64(rep.CreatedOn), 0), true
+			}
+		}
+		return time.Time{}, false
+	}}
+}
+
+// singleRule is met by one entry of at least count for the exercise
+func singleRule(id, name, description, exercise string, count int) achievementRule {
+	return achievementRule{ID: id, Name: name, Description: description, earnedOn: func(h *repHistory) (time.Time, bool) {
+		for _, rep := range h.reps {
+			if rep.Name == exercise && rep.Count >= count {
+				return time.Unix(int64(rep.CreatedOn), 0), true
+			}
+		}
+		return time.Time{}, false
+	}}
+}
+
+// streakRule is met on the day a streak reaches days. Rest days keep the streak going, the same as in Streaks
+func streakRule(id, name, description string, days int) achievementRule {
+	return achievementRule{ID: id, Name: name, Description: description, earnedOn: func(h *repHistory) (time.Time, bool) {
+		var run int
+		var last time.Time
+		for _, rep := range h.reps {
+			day := localDay(time.Unix(int64(rep.CreatedOn), 0), h.loc)
+			if !last.IsZero() && !day.After(last) {
+				continue
+			}
+
+			gapFrozen := true
+			if !last.IsZero() {
+				for d := last.AddDate(0, 0, 1); d.Before(day); d = d.AddDate(0, 0, 1) {
+					if !h.frozen[d.Format(dayFormat)] {
+						gapFrozen = false
+						break
+					}
+				}
+			}
+			if last.IsZero() || !gapFrozen {
+				run = 0
+			}
+			run++
+			last = day
+
+			if run >= days {
+				return time.Unix(int64(rep.CreatedOn), 0), true
+			}
+		}
+		return time.Time{}, false
+	}}
+}
+
+// everyDayOfMonthRule is met by logging on every day of the month, in any year
+func everyDayOfMonthRule(id, name, description string, month time.Month) achievementRule {
+	return achievementRule{ID: id, Name: name, Description: description, earnedOn: func(h *repHistory) (time.Time, bool) {
+		active := make(map[string]bool)
+		for _, rep := range h.reps {
+			at := time.Unix(int64(rep.CreatedOn), 0)
+			day := localDay(at, h.loc)
+			if day.Month() != month || active[day.Format(dayFormat)] {
+				continue
+			}
+			active[day.Format(dayFormat)] = true
+
+			first := time.Date(day.Year(), month, 1, 0, 0, 0, 0, time.UTC)
+			complete := true
+			for d := first; d.Month() == month; d = d.AddDate(0, 0, 1) {
+				if !active[d.Format(dayFormat)] {
+					complete = false
+					break
+				}
+			}
+			if complete {
+				return at, true
+			}
+		}
+		return time.Time{}, false
+	}}
+}
+
+// localDay is the calendar day of t in loc, as midnight UTC so days can be stepped through without DST surprises
+func localDay(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func findAchievementRule(id string) (achievementRule, bool) {
+	for _, rule := range achievementRules {
+		if rule.ID == id {
+			return rule, true
+		}
+	}
+	return achievementRule{}, false
+}
+
+// handleAchievementEvent is the event bus subscriber that checks for new badges whenever reps are logged or corrected
+func (s *Server) handleAchievementEvent(e Event) error {
+	switch e := e.(type) {
+	case RepsLogged:
+		_, err := s.evaluateAchievements(e.UserID)
+		return err
+	case RepEdited:
+		_, err := s.evaluateAchievements(e.UserID)
+		return err
+	}
+	return nil
+}
+
+// evaluateAchievements awards every badge the user has earned but not yet been given, and returns the new ones.
+// Badges are never taken away, even if the reps that earned them are later edited or deleted.
+func (s *Server) evaluateAchievements(uid int) ([]Achievement, error) {
+	awarded, err := s.getAchievements(uid)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool)
+	for _, a := range awarded {
+		have[a.ID] = true
+	}
+	if len(have) == len(achievementRules) {
+		return nil, nil
+	}
+
+	h, err := s.getRepHistory(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	var earned []Achievement
+	for _, rule := range achievementRules {
+		if have[rule.ID] {
+			continue
+		}
+		at, ok := rule.earnedOn(h)
+		if !ok {
+			continue
+		}
+
+		// "or ignore" as a concurrent evaluation may have just awarded the same badge
+		q := "insert or ignore into achievements (user_id, achievement, awarded_on, created_on) values (?, ?, ?, ?)"
+		if _, err := s.DB.Exec(q, uid, rule.ID, at.Unix(), time.Now().Unix()); err != nil {
+			return nil, fmt.Errorf("unable to insert achievement: %w", err)
+		}
+		earned = append(earned, Achievement{ID: rule.ID, Name: rule.Name, Description: rule.Description, AwardedOn: int(at.Unix())})
+	}
+
+	return earned, nil
+}
+
+// backfillAchievements evaluates every user with reps, for badges added after their reps were logged. It returns how many badges were awarded
+func (s *Server) backfillAchievements() (int, error) {
+	rows, err := s.DB.Query("select distinct user_id from reps order by user_id")
+	if err != nil {
+		return 0, fmt.Errorf("unable to query backfillAchievements: %w", err)
+	}
+
+	var uids []int
+	for rows.Next() {
+		var uid int
+		if err := rows.Scan(&uid); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("unable to scan backfillAchievements: %w", err)
+		}
+		uids = append(uids, uid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("unexpected error after scanning backfillAchievements: %w", err)
+	}
+
+	var awarded int
+	for _, uid := range uids {
+		earned, err := s.evaluateAchievements(uid)
+		if err != nil {
+			return awarded, err
+		}
+		awarded += len(earned)
+	}
+	return awarded, nil
+}
+
+func (s *Server) getRepHistory(uid int) (*repHistory, error) {
+	prefs, err := s.getPreferences(uid)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(prefs.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	frozenDays, err := s.getStreakFreezes(uid)
+	if err != nil {
+		return nil, err
+	}
+	h := &repHistory{loc: loc, frozen: make(map[string]bool)}
+	for _, day := range frozenDays {
+		h.frozen[day] = true
+	}
+
+	q := "select id, exercise_id, count, created_on from reps where user_id=? order by created_on, id"
+	rows, err := s.DB.Query(q, uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getRepHistory: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rep Rep
+		if err := rows.Scan(&rep.ID, &rep.ExerciseID, &rep.Count, &rep.CreatedOn); err != nil {
+			return nil, fmt.Errorf("unable to scan getRepHistory: %w", err)
+		}
+		ex, _ := s.getExerciseByID(rep.ExerciseID)
+		rep.Name, rep.ValueType = ex.Name, ex.ValueType
+		h.reps = append(h.reps, rep)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getRepHistory: %w", err)
+	}
+	return h, nil
+}
+
+// getAchievements returns the user's badges, in the order of achievementRules
+func (s *Server) getAchievements(uid int) ([]Achievement, error) {
+	rows, err := s.DB.Query("select achievement, awarded_on from achievements where user_id=?", uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getAchievements: %w", err)
+	}
+	defer rows.Close()
+
+	awardedOn := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var at int
+		if err := rows.Scan(&id, &at); err != nil {
+			return nil, fmt.Errorf("unable to scan getAchievements: %w", err)
+		}
+		awardedOn[id] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getAchievements: %w", err)
+	}
+
+	achievements := make([]Achievement, 0)
+	for _, rule := range achievementRules {
+		if at, ok := awardedOn[rule.ID]; ok {
+			achievements = append(achievements, Achievement{ID: rule.ID, Name: rule.Name, Description: rule.Description, AwardedOn: at})
+		}
+	}
+	return achievements, nil
+}
+
+// AchievementsResponse lists earned badges. Available, the badges not yet earned, is only included for your own achievements
+type AchievementsResponse struct {
+	Achievements []Achievement
+	Available    []Achievement `json:",omitempty"`
+}
+
+func (s *Server) GetMyAchievements(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	earned, err := s.getAchievements(uid)
+	if err != nil {
+		log.Printf("unable to GetMyAchievements: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := AchievementsResponse{Achievements: earned, Available: make([]Achievement, 0)}
+	for _, rule := range achievementRules {
+		var have bool
+		for _, a := range earned {
+			if a.ID == rule.ID {
+				have = true
+			}
+		}
+		if !have {
+			data.Available = append(data.Available, Achievement{ID: rule.ID, Name: rule.Name, Description: rule.Description})
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("GetMyAchievements marshal err ", err.Error())
+	}
+}
+
+func (s *Server) GetUserAchievements(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	earned, err := s.getAchievements(uid)
+	if err != nil {
+		log.Printf("unable to GetUserAchievements: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(AchievementsResponse{Achievements: earned}); err != nil {
+		log.Println("GetUserAchievements marshal err ", err.Error())
+	}
+}
+
+// PostAchievementsBackfill awards badges from historical reps. Admins only
+func (s *Server) PostAchievementsBackfill(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+
+	awarded, err := s.backfillAchievements()
+	if err != nil {
+		log.Printf("unable to PostAchievementsBackfill: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(struct{ Awarded int }{awarded}); err != nil {
+		log.Println("PostAchievementsBackfill marshal err ", err.Error())
+	}
+}
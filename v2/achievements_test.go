@@ -0,0 +1,124 @@
+package countmyreps
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAchievementRules(t *testing.T) {
+	day := func(d int, hour int) int {
+		return int(time.Date(2020, 11, d, hour, 0, 0, 0, time.UTC).Unix())
+	}
+
+	var november []Rep
+	for d := 1; d <= 30; d++ {
+		november = append(november, Rep{Name: "Push Ups", Count: 40, CreatedOn: day(d, 12)})
+	}
+
+	tests := []struct {
+		name   string
+		rule   string
+		reps   []Rep
+		frozen map[string]bool
+		want   int // 0 for not earned
+	}{
+		{"first rep", "first-rep", []Rep{{Name: "Squats", Count: 1, CreatedOn: day(3, 9)}}, nil, day(3, 9)},
+		{"total crosses on the third entry", "push-ups-1000", []Rep{{Name: "Push Ups", Count: 400, CreatedOn: day(1, 9)}, {Name: "Squats", Count: 900, CreatedOn: day(2, 9)}, {Name: "Push Ups", Count: 400, CreatedOn: day(3, 9)}, {Name: "Push Ups", Count: 200, CreatedOn: day(4, 9)}}, nil, day(4, 9)},
+		{"total not reached", "push-ups-1000", []Rep{{Name: "Push Ups", Count: 999, CreatedOn: day(1, 9)}}, nil, 0},
+		{"two 5k runs are not a 10k", "first-10k", []Rep{{Name: "Running", Count: 5000, CreatedOn: day(1, 9)}, {Name: "Running", Count: 5000, CreatedOn: day(1, 10)}}, nil, 0},
+		{"10k run", "first-10k", []Rep{{Name: "Running", Count: 5000, CreatedOn: day(1, 9)}, {Name: "Running", Count: 10500, CreatedOn: day(2, 10)}}, nil, day(2, 10)},
+		{"week streak", "streak-7", november[:7], nil, day(7, 12)},
+		{"broken streak", "streak-7", append(append([]Rep{}, november[:3]...), november[4:8]...), nil, 0},
+		{"rest day keeps streak", "streak-7", append(append([]Rep{}, november[:3]...), november[4:8]...), map[string]bool{"2020-11-04": true}, day(8, 12)},
+		{"every day of november", "every-day-november", november, nil, day(30, 12)},
+		{"missed a day of november", "every-day-november", november[1:], nil, 0},
+	}
+	for _, test := range tests {
+		rule, ok := findAchievementRule(test.rule)
+		if !ok {
+			t.Fatalf("%s: no rule %q", test.name, test.rule)
+		}
+		h := &repHistory{reps: test.reps, loc: time.UTC, frozen: test.frozen}
+		at, earned := rule.earnedOn(h)
+		if got, want := earned, test.want != 0; got != want {
+			t.Errorf("%s: got earned %t, want %t", test.name, got, want)
+			continue
+		}
+		if earned && int(at.Unix()) != test.want {
+			t.Errorf("%s: got earned at %s, want %s", test.name, at.UTC(), time.Unix(int64(test.want), 0).UTC())
+		}
+	}
+}
+
+func TestAchievementsOnSubmission(t *testing.T) {
+	s, _ := newTestServer(t)
+	uid := mustCreateUser(t, s, "seth.ammons@twilio.com")
+
+	if _, err := s.postStats(uid, Exercises{Collection: []Exercise{{Name: "Push Ups", Count: 1000}}}); err != nil {
+		t.Fatal(err)
+	}
+	s.events.wait()
+
+	got, err := s.getAchievements(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"first-rep", "push-ups-1000"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d achievements, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].ID != want[i] {
+			t.Errorf("got achievement %q, want %q", got[i].ID, want[i])
+		}
+	}
+
+	// evaluating again awards nothing new
+	earned, err := s.evaluateAchievements(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(earned) != 0 {
+		t.Errorf("got %d new achievements on re-evaluation, want 0", len(earned))
+	}
+}
+
+func TestBackfillAchievements(t *testing.T) {
+	s, _ := newTestServer(t)
+	seth := mustCreateUser(t, s, "seth.ammons@twilio.com")
+	other := mustCreateUser(t, s, "someone@twilio.com")
+	mustCreateUser(t, s, "lurker@twilio.com")
+
+	for d := 1; d <= 7; d++ {
+		mustInsertReps(t, s, seth, "Squats", 10, time.Date(2020, 11, d, 12, 0, 0, 0, time.UTC))
+	}
+	mustInsertReps(t, s, other, "Running", 10000, time.Date(2020, 11, 2, 7, 0, 0, 0, time.UTC))
+
+	awarded, err := s.backfillAchievements()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// seth: first rep and a week streak. other: first rep and first 10k
+	if got, want := awarded, 4; got != want {
+		t.Errorf("got %d awarded, want %d", got, want)
+	}
+
+	got, err := s.getAchievements(seth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].ID != "streak-7" {
+		t.Fatalf("got %+v, want first-rep and streak-7", got)
+	}
+	if got, want := got[1].AwardedOn, int(time.Date(2020, 11, 7, 12, 0, 0, 0, time.UTC).Unix()); got != want {
+		t.Errorf("got streak awarded on %d, want the day it was reached, %d", got, want)
+	}
+
+	awarded, err = s.backfillAchievements()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if awarded != 0 {
+		t.Errorf("got %d awarded on second backfill, want 0", awarded)
+	}
+}
@@ -0,0 +1,231 @@
+package countmyreps
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// where a change came from
+const (
+	auditAPI   = "api"
+	auditAdmin = "admin"
+	auditSlack = "slack"
+	auditCLI   = "cli"
+)
+
+// auditRedacted replaces the before and after of a deleted user's entries. Migration 16 lets the audit table take this one change
+const auditRedacted = `"redacted"`
+
+// auditMaxLimit caps how many entries one GET /v3/admin/audit returns
+const auditMaxLimit = 500
+
+// AuditEntry is one change to the data: who made it, from where, and the record before and after as json. Before is empty for
+// creates and After is empty for deletes. ActorID is 0 for the command line
+type AuditEntry struct {
+	ID          int
+	ActorID     int
+	ActorEmail  string `json:",omitempty"`
+	Source      string
+	Action      string
+	SubjectType string
+	SubjectID   int
+	Before      json.RawMessage `json:",omitempty"`
+	After       json.RawMessage `json:",omitempty"`
+	CreatedOn   int
+}
+
+// auditMember is the before or after of a team membership change
+type auditMember struct {
+	UserID int
+}
+
+// auditJSON marshals a record for an audit entry. It is only handed our own types, so a marshal error is logged, not returned
+func auditJSON(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("unable to marshal audit record: %s", err)
+		return nil
+	}
+	return b
+}
+
+// postAudit appends the entry. The audit table refuses deletes and any update other than redaction, so entries can only be added
+func (s *Server) postAudit(e *AuditEntry) error {
+	if e.CreatedOn == 0 {
+		e.CreatedOn = int(time.Now().Unix())
+	}
+	q := "insert into audit (actor_id, source, action, subject_type, subject_id, before_value, after_value, created_on) values (?, ?, ?, ?, ?, ?, ?, ?)"
+	res, err := s.DB.Exec(q, e.ActorID, e.Source, e.Action, e.SubjectType, e.SubjectID, string(e.Before), string(e.After), e.CreatedOn)
+	if err != nil {
+		return fmt.Errorf("unable to insert audit: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("unable to get last insert id for audit: %w", err)
+	}
+	e.ID = int(id)
+	return nil
+}
+
+// audit records a change that has already been made. Failing to record it is logged rather than failing the change
+func (s *Server) audit(e AuditEntry) {
+	if err := s.postAudit(&e); err != nil {
+		log.Printf("unable to record audit %s of %s %d: %s", e.Action, e.SubjectType, e.SubjectID, err)
+	}
+}
+
+// auditRequest records a change made by the caller. ownerID is who the changed record belongs to; the source is admin for
+// /v3/admin routes and for admins changing what belongs to someone else
+func (s *Server) auditRequest(r *http.Request, ownerID int, e AuditEntry) {
+	uid, _ := r.Context().Value(ctxUID).(int)
+	e.ActorID, e.Source = uid, auditAPI
+	if strings.HasPrefix(r.URL.Path, "/v3/admin/") || (ownerID != uid && s.isAdmin(r)) {
+		e.Source = auditAdmin
+	}
+	s.audit(e)
+}
+
+// teamAuditRequest records a change the caller made to a team, which belongs to the team's owner
+func (s *Server) teamAuditRequest(r *http.Request, teamID int, e AuditEntry) {
+	owner, _, err := s.getTeamOwner(teamID)
+	if err != nil {
+		log.Printf("unable to get team owner for audit: %s", err)
+	}
+	s.auditRequest(r, owner, e)
+}
+
+// auditRepsLogged records one entry per rep
+func (s *Server) auditRepsLogged(actorID int, source string, reps []Rep) {
+	for _, rep := range reps {
+		s.audit(AuditEntry{ActorID: actorID, Source: source, Action: "rep.create", SubjectType: "rep", SubjectID: rep.ID, After: auditJSON(rep)})
+	}
+}
+
+// auditFilter narrows getAudit. Zero values match everything
+type auditFilter struct {
+	ActorID     int
+	Action      string
+	SubjectType string
+	SubjectID   int
+	Since       int
+	Until       int
+	// BeforeID pages back from the oldest entry of the previous page
+	BeforeID int
+	Limit    int
+}
+
+// getAudit returns entries matching the filter, newest first. ActorID -1 matches nothing, for an actor that does not exist
+func (s *Server) getAudit(f auditFilter) ([]AuditEntry, error) {
+	var where []string
+	var args []interface{}
+	if f.ActorID != 0 {
+		where, args = append(where, "audit.actor_id=?"), append(args, f.ActorID)
+	}
+	if f.Action != "" {
+		where, args = append(where, "audit.action=?"), append(args, f.Action)
+	}
+	if f.SubjectType != "" {
+		where, args = append(where, "audit.subject_type=?"), append(args, f.SubjectType)
+	}
+	if f.SubjectID != 0 {
+		where, args = append(where, "audit.subject_id=?"), append(args, f.SubjectID)
+	}
+	if f.Since != 0 {
+		where, args = append(where, "audit.created_on>=?"), append(args, f.Since)
+	}
+	if f.Until != 0 {
+		where, args = append(where, "audit.created_on<=?"), append(args, f.Until)
+	}
+	if f.BeforeID != 0 {
+		where, args = append(where, "audit.id<?"), append(args, f.BeforeID)
+	}
+
+	q := "select audit.id, audit.actor_id, coalesce(users.email, ''), audit.source, audit.action, audit.subject_type, audit.subject_id, audit.before_value, audit.after_value, audit.created_on from audit left join users on users.id=audit.actor_id"
+	if len(where) > 0 {
+		q += " where " + strings.Join(where, " and ")
+	}
+	q += " order by audit.id desc limit ?"
+	args = append(args, f.Limit)
+
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getAudit: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var e AuditEntry
+		var before, after string
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.ActorEmail, &e.Source, &e.Action, &e.SubjectType, &e.SubjectID, &before, &after, &e.CreatedOn); err != nil {
+			return nil, fmt.Errorf("unable to scan getAudit: %w", err)
+		}
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getAudit: %w", err)
+	}
+	return entries, nil
+}
+
+// GetAudit lists audit entries, newest first. Admins only. Options: ?actor={:email:}, ?action=rep.update, ?subject_type=team,
+// ?subject_id=3, ?since= and ?until= unix times, ?limit= (default 100), and ?before_id= the last ID of the previous page
+func (s *Server) GetAudit(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	f := auditFilter{
+		Action:      query.Get("action"),
+		SubjectType: query.Get("subject_type"),
+		Limit:       100,
+	}
+	for param, v := range map[string]*int{"subject_id": &f.SubjectID, "since": &f.Since, "until": &f.Until, "before_id": &f.BeforeID, "limit": &f.Limit} {
+		if query.Get(param) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(param))
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("%s must be a whole number", param), http.StatusBadRequest)
+			return
+		}
+		*v = n
+	}
+	if f.Limit < 1 || f.Limit > auditMaxLimit {
+		f.Limit = auditMaxLimit
+	}
+
+	if email := query.Get("actor"); email != "" {
+		f.ActorID = -1
+		err := s.DB.QueryRow("select id from users where email=?", email).Scan(&f.ActorID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("unable to GetAudit: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data, err := s.getAudit(f)
+	if err != nil {
+		log.Printf("unable to GetAudit: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Entries []AuditEntry }{data}); err != nil {
+		log.Println("GetAudit marshal err ", err.Error())
+	}
+}
@@ -0,0 +1,108 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.conf.Admins = []string{"admin@twilio.com"}
+	lifter := newTestClient(t, s, "lifter@twilio.com")
+	admin := newTestClient(t, s, "admin@twilio.com")
+
+	if got, want := lifter.do("POST", "/v3/stats", `{"Exercises": [{"Name": "Push Ups", "Count": 20}]}`).Code, http.StatusCreated; got != want {
+		t.Fatalf("got %d logging reps, want %d", got, want)
+	}
+	reps, err := s.getReps(lifter.UID, 0, 1<<31-1)
+	if err != nil || len(reps) != 1 {
+		t.Fatalf("got %d reps (%v), want 1", len(reps), err)
+	}
+	repPath := fmt.Sprintf("/v3/reps/%d", reps[0].ID)
+	lifter.do("PUT", repPath, `{"Count": 25}`)
+	lifter.do("DELETE", repPath, "")
+	// deleting twice changes nothing, so it is not recorded
+	lifter.do("DELETE", repPath, "")
+
+	denver, _ := s.getTeamByName("Denver")
+	teamPath := fmt.Sprintf("/v3/myteams/%d", denver.ID)
+	lifter.do("POST", teamPath, "")
+	lifter.do("POST", teamPath, "")
+	lifter.do("DELETE", teamPath, "")
+	if got, want := admin.do("PUT", fmt.Sprintf("/v3/teams/%d", denver.ID), `{"HeadCount": 120}`).Code, http.StatusOK; got != want {
+		t.Fatalf("got %d updating a seeded team, want %d", got, want)
+	}
+
+	if got, want := lifter.do("GET", "/v3/admin/audit", "").Code, http.StatusForbidden; got != want {
+		t.Errorf("got %d reading the audit log as a non admin, want %d", got, want)
+	}
+
+	get := func(query string) []AuditEntry {
+		t.Helper()
+		w := admin.do("GET", "/v3/admin/audit"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d for %s: %s", w.Code, query, w.Body)
+		}
+		var data struct{ Entries []AuditEntry }
+		if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		return data.Entries
+	}
+
+	var actions []string
+	for _, e := range get("?actor=lifter@twilio.com") {
+		actions = append(actions, e.Action)
+	}
+	if got, want := fmt.Sprint(actions), "[team.leave team.join rep.delete rep.update rep.create]"; got != want {
+		t.Errorf("got lifter actions %s, want %s", got, want)
+	}
+
+	updates := get("?action=rep.update")
+	if len(updates) != 1 {
+		t.Fatalf("got %d rep updates, want 1", len(updates))
+	}
+	var before, after Rep
+	json.Unmarshal(updates[0].Before, &before)
+	json.Unmarshal(updates[0].After, &after)
+	if got, want := [2]int{before.Count, after.Count}, [2]int{20, 25}; got != want {
+		t.Errorf("got count before and after %v, want %v", got, want)
+	}
+	if got, want := updates[0].ActorEmail, "lifter@twilio.com"; got != want {
+		t.Errorf("got actor %q, want %q", got, want)
+	}
+
+	teamUpdates := get(fmt.Sprintf("?subject_type=team&subject_id=%d&action=team.update", denver.ID))
+	if len(teamUpdates) != 1 {
+		t.Fatalf("got %d team updates, want 1", len(teamUpdates))
+	}
+	if got, want := teamUpdates[0].Source, auditAdmin; got != want {
+		t.Errorf("got source %q for an admin changing a seeded team, want %q", got, want)
+	}
+
+	page := get("?limit=2")
+	if len(page) != 2 {
+		t.Fatalf("got %d entries, want the limit of 2", len(page))
+	}
+	if next := get(fmt.Sprintf("?limit=2&before_id=%d", page[1].ID)); len(next) == 0 || next[0].ID >= page[1].ID {
+		t.Errorf("got a next page that does not continue from %d", page[1].ID)
+	}
+	if got := len(get("?actor=nobody@twilio.com")); got != 0 {
+		t.Errorf("got %d entries for someone unknown, want 0", got)
+	}
+
+	if _, err := s.DB.Exec("update audit set action='rep.create'"); err == nil {
+		t.Errorf("got an audit entry updated, want the log append only")
+	}
+	if _, err := s.DB.Exec("update audit set after_value='{}' where after_value!=''"); err == nil {
+		t.Errorf("got an audit record rewritten, want only redaction allowed")
+	}
+	if _, err := s.DB.Exec("update audit set after_value=? where after_value!=''", auditRedacted); err != nil {
+		t.Errorf("got %v redacting audit records, want it allowed", err)
+	}
+	if _, err := s.DB.Exec("delete from audit"); err == nil {
+		t.Errorf("got audit entries deleted, want the log append only")
+	}
+}
@@ -0,0 +1,339 @@
+package countmyreps
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/sethgrid/countmyreps/v2/config"
+)
+
+// backupFormat is the UTC time in a snapshot's file name. Snapshot names sort in the order they were taken
+const backupFormat = "20060102T150405Z"
+
+// Backup is a snapshot of the db in BackupPath
+type Backup struct {
+	Name      string
+	Size      int64
+	CreatedOn int
+}
+
+// backupPrefix is what every snapshot name starts with, taken from the db file name. cmr.db snapshots are cmr-{:time:}.db
+func backupPrefix(dbPath string) string {
+	base := filepath.Base(dbPath)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + "-"
+}
+
+// backupDB writes a snapshot of the live db to BackupPath. It uses SQLite's online backup api, so requests keep being served while
+// it runs. The copy is made under a temp name and renamed into place, so a snapshot in BackupPath is always whole
+func (s *Server) backupDB(now time.Time) (*Backup, error) {
+	if s.conf.BackupPath == "" {
+		return nil, fmt.Errorf("backups are disabled; set backup_path to enable them")
+	}
+
+	s.backupMu.Lock()
+	defer s.backupMu.Unlock()
+
+	if err := os.MkdirAll(s.conf.BackupPath, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create backup dir: %w", err)
+	}
+
+	name := backupPrefix(s.conf.DBPath) + now.UTC().Format(backupFormat) + ".db"
+	path := filepath.Join(s.conf.BackupPath, name)
+	tmp := path + ".tmp"
+	// a left over temp file is from a backup that did not finish
+	os.Remove(tmp)
+
+	if err := sqliteBackup(s.DB, tmp); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("unable to move backup into place: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat backup: %w", err)
+	}
+	return &Backup{Name: name, Size: info.Size(), CreatedOn: int(now.Unix())}, nil
+}
+
+// sqliteBackup copies every page of src into a new db file at dest
+func sqliteBackup(src *sql.DB, dest string) error {
+	ctx := context.Background()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get db conn: %w", err)
+	}
+	defer srcConn.Close()
+
+	destDB, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		return fmt.Errorf("unable to open backup: %w", err)
+	}
+	defer destDB.Close()
+
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get backup conn: %w", err)
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			destSQLite, ok := destRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected backup conn type %T", destRaw)
+			}
+			srcSQLite, ok := srcRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected db conn type %T", srcRaw)
+			}
+
+			b, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return fmt.Errorf("unable to start backup: %w", err)
+			}
+			// one step copies every page under a single read lock. Our db is small enough that this is quicker than
+			// stepping through it and restarting each time a write lands part way through
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return fmt.Errorf("unable to copy db: %w", err)
+			}
+			if err := b.Finish(); err != nil {
+				return fmt.Errorf("unable to finish backup: %w", err)
+			}
+			return nil
+		})
+	})
+}
+
+// getBackups lists the snapshots in BackupPath, newest first
+func (s *Server) getBackups() ([]Backup, error) {
+	if s.conf.BackupPath == "" {
+		return nil, nil
+	}
+
+	infos, err := ioutil.ReadDir(s.conf.BackupPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read backup dir: %w", err)
+	}
+
+	prefix := backupPrefix(s.conf.DBPath)
+	var backups []Backup
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".db") {
+			continue
+		}
+		at, err := time.Parse(backupFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".db"))
+		if err != nil {
+			// not one of ours
+			continue
+		}
+		backups = append(backups, Backup{Name: name, Size: info.Size(), CreatedOn: int(at.Unix())})
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return backups, nil
+}
+
+// pruneBackups deletes all but the newest BackupKeep snapshots and returns how many were deleted
+func (s *Server) pruneBackups() (int, error) {
+	s.backupMu.Lock()
+	defer s.backupMu.Unlock()
+
+	backups, err := s.getBackups()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+	for i := s.conf.BackupKeep; i < len(backups); i++ {
+		if err := os.Remove(filepath.Join(s.conf.BackupPath, backups[i].Name)); err != nil {
+			return removed, fmt.Errorf("unable to remove backup %s: %w", backups[i].Name, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// runBackups is the scheduled job. It takes a snapshot when the newest one is at least BackupInterval old
+func (s *Server) runBackups(now time.Time) error {
+	if s.conf.BackupPath == "" || s.conf.BackupInterval <= 0 {
+		return nil
+	}
+
+	backups, err := s.getBackups()
+	if err != nil {
+		return err
+	}
+	if len(backups) > 0 && now.Sub(time.Unix(int64(backups[0].CreatedOn), 0)) < s.conf.BackupInterval {
+		return nil
+	}
+
+	b, err := s.backupDB(now)
+	if err != nil {
+		return err
+	}
+	removed, err := s.pruneBackups()
+	if err != nil {
+		return err
+	}
+	log.Printf("backed up db to %s, removing %d old backups", b.Name, removed)
+	return nil
+}
+
+// ValidateSnapshot checks that the file at path is a whole countmyreps db that this version can open
+func ValidateSnapshot(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("unable to stat snapshot: %w", err)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("unable to open snapshot: %w", err)
+	}
+	defer db.Close()
+
+	var check string
+	if err := db.QueryRow("pragma integrity_check").Scan(&check); err != nil {
+		return fmt.Errorf("unable to check snapshot: %w", err)
+	}
+	if check != "ok" {
+		return fmt.Errorf("snapshot failed its integrity check: %s", check)
+	}
+
+	var version sql.NullInt64
+	if err := db.QueryRow("select max(version) from schema_version").Scan(&version); err != nil {
+		return fmt.Errorf("snapshot is not a countmyreps db: %w", err)
+	}
+	if int(version.Int64) > len(migrations) {
+		return fmt.Errorf("snapshot is at schema version %d, newer than this countmyreps (%d)", version.Int64, len(migrations))
+	}
+
+	for _, table := range []string{"users", "reps", "exercises", "teams"} {
+		var n int
+		if err := db.QueryRow("select count(*) from " + table).Scan(&n); err != nil {
+			return fmt.Errorf("snapshot is missing %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// RestoreDB validates the snapshot and swaps it in for the db at DBPath. The db it replaces is kept next to it, and its path is
+// returned. Stop the server first: a running server keeps writing to the file it opened
+func RestoreDB(c *config.Config, snapshot string) (string, error) {
+	if err := ValidateSnapshot(snapshot); err != nil {
+		return "", err
+	}
+
+	// copy rather than move, so the snapshot stays in BackupPath for another restore
+	tmp := c.DBPath + ".restore"
+	if err := copyFile(snapshot, tmp); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("unable to copy snapshot: %w", err)
+	}
+
+	var previous string
+	if _, err := os.Stat(c.DBPath); err == nil {
+		previous = c.DBPath + ".pre-restore-" + time.Now().UTC().Format(backupFormat)
+		if err := os.Rename(c.DBPath, previous); err != nil {
+			os.Remove(tmp)
+			return "", fmt.Errorf("unable to move current db aside: %w", err)
+		}
+	}
+	// a journal belongs to the db that was moved aside, and must not be replayed into the snapshot
+	os.Remove(c.DBPath + "-journal")
+
+	if err := os.Rename(tmp, c.DBPath); err != nil {
+		return previous, fmt.Errorf("unable to move snapshot into place: %w", err)
+	}
+	return previous, nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// GetBackups lists the db snapshots, newest first
+func (s *Server) GetBackups(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+
+	backups, err := s.getBackups()
+	if err != nil {
+		log.Printf("unable to GetBackups: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(struct{ Backups []Backup }{backups}); err != nil {
+		log.Println("GetBackups marshal err ", err.Error())
+	}
+}
+
+// PostBackups takes a snapshot now, outside of the schedule, and then applies retention
+func (s *Server) PostBackups(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+	if s.conf.BackupPath == "" {
+		http.Error(w, "backups are disabled; set backup_path to enable them", http.StatusConflict)
+		return
+	}
+
+	b, err := s.backupDB(time.Now())
+	if err != nil {
+		log.Printf("unable to PostBackups: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	removed, err := s.pruneBackups()
+	if err != nil {
+		log.Printf("unable to prune backups: %s", err)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(struct {
+		Backup  *Backup
+		Removed int
+	}{b, removed}); err != nil {
+		log.Println("PostBackups marshal err ", err.Error())
+	}
+}
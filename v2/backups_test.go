@@ -0,0 +1,111 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sethgrid/countmyreps/v2/config"
+)
+
+func TestBackups(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.conf.Admins = []string{"admin@twilio.com"}
+	s.conf.BackupPath = filepath.Join(filepath.Dir(s.conf.DBPath), "backups")
+	s.conf.BackupInterval = 24 * time.Hour
+	s.conf.BackupKeep = 2
+	day := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+
+	uid := mustCreateUser(t, s, "lifter@twilio.com")
+	mustInsertReps(t, s, uid, "Push Ups", 20, day)
+
+	if err := s.runBackups(day); err != nil {
+		t.Fatal(err)
+	}
+	// a later rep is not in the first snapshot
+	mustInsertReps(t, s, uid, "Squats", 30, day)
+
+	// not due yet, then due
+	for _, at := range []time.Time{day.Add(time.Hour), day.Add(24 * time.Hour), day.Add(48 * time.Hour)} {
+		if err := s.runBackups(at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := s.getBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(backups), 2; got != want {
+		t.Fatalf("got %d backups, want the %d kept", got, want)
+	}
+	if got, want := backups[0].Name, "cmr-20201113T120000Z.db"; got != want {
+		t.Errorf("got newest backup %s, want %s", got, want)
+	}
+
+	admin := newTestClient(t, s, "admin@twilio.com")
+	lifter := newTestClient(t, s, "lifter@twilio.com")
+	if got, want := lifter.do("POST", "/v3/admin/backups", "").Code, http.StatusForbidden; got != want {
+		t.Errorf("got %d backing up as a non admin, want %d", got, want)
+	}
+	w := admin.do("POST", "/v3/admin/backups", "")
+	if got, want := w.Code, http.StatusCreated; got != want {
+		t.Fatalf("got %d, want %d: %s", got, want, w.Body)
+	}
+	var data struct {
+		Backup  *Backup
+		Removed int
+	}
+	if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := data.Removed, 1; got != want {
+		t.Errorf("got %d removed, want %d", got, want)
+	}
+	snapshot := filepath.Join(s.conf.BackupPath, data.Backup.Name)
+	if err := ValidateSnapshot(snapshot); err != nil {
+		t.Fatalf("got %v validating a fresh snapshot", err)
+	}
+
+	garbage := filepath.Join(s.conf.BackupPath, "garbage.db")
+	if err := ioutil.WriteFile(garbage, []byte("not a db"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateSnapshot(garbage); err == nil {
+		t.Errorf("got a garbage snapshot validated, want an error")
+	}
+
+	// restore over an existing db, which is kept aside
+	c := new(config.Config)
+	*c = *s.conf
+	c.DBPath = filepath.Join(filepath.Dir(s.conf.DBPath), "restored.db")
+	other, err := NewCommandServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.DB.Close()
+	if _, err := RestoreDB(c, garbage); err == nil {
+		t.Errorf("got a garbage snapshot restored, want an error")
+	}
+	previous, err := RestoreDB(c, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous == "" {
+		t.Errorf("got no path for the replaced db")
+	}
+	restored, err := NewCommandServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.DB.Close()
+	reps, err := restored.getReps(uid, 0, int(time.Now().Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(reps), 2; got != want {
+		t.Errorf("got %d restored reps, want %d", got, want)
+	}
+}
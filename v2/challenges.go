@@ -0,0 +1,426 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Challenge is a head to head between teams that opted in, over Start through End (UTC days). ExerciseID 0 counts every exercise
+type Challenge struct {
+	ID         int
+	Name       string
+	ExerciseID int    `json:",omitempty"`
+	Exercise   string `json:",omitempty"`
+	Start      string
+	End        string
+	CreatedOn  int
+	Teams      []Team
+}
+
+// ChallengeScore is a team's standing in a challenge. Teams are ranked by PointsPerActiveMember,
+// the points divided by the members who logged anything during the challenge, so big and small teams can compete fairly.
+// Total and PerActiveMember are the same in reps
+type ChallengeScore struct {
+	TeamID                int
+	Name                  string
+	Rank                  int
+	Members               int
+	ActiveMembers         int
+	Total                 int
+	PerActiveMember       int
+	Points                int
+	PointsPerActiveMember int
+}
+
+// window is the challenge as [start, end) unix times
+func (c *Challenge) window() (int, int) {
+	start := dayStart(c.Start, time.UTC)
+	end := dayStart(c.End, time.UTC).AddDate(0, 0, 1)
+	return int(start.Unix()), int(end.Unix())
+}
+
+func (s *Server) getChallenges() ([]Challenge, error) {
+	return s.queryChallenges("order by start_day desc, id desc")
+}
+
+// getChallenge returns nil if there is no such challenge
+func (s *Server) getChallenge(challengeID int) (*Challenge, error) {
+	challenges, err := s.queryChallenges("where id=?", challengeID)
+	if err != nil || len(challenges) == 0 {
+		return nil, err
+	}
+	return &challenges[0], nil
+}
+
+func (s *Server) queryChallenges(where string, args ...interface{}) ([]Challenge, error) {
+	q := "select id, name, exercise_id, start_day, end_day, created_on from challenges " + where
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query challenges: %w", err)
+	}
+	defer rows.Close()
+
+	challenges := make([]Challenge, 0)
+	for rows.Next() {
+		var c Challenge
+		if err := rows.Scan(&c.ID, &c.Name, &c.ExerciseID, &c.Start, &c.End, &c.CreatedOn); err != nil {
+			return nil, fmt.Errorf("unable to scan challenges: %w", err)
+		}
+		if ex, ok := s.getExerciseByID(c.ExerciseID); ok {
+			c.Exercise = ex.Name
+		}
+		challenges = append(challenges, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning challenges: %w", err)
+	}
+	rows.Close()
+
+	for i := range challenges {
+		challenges[i].Teams, err = s.getChallengeTeams(challenges[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return challenges, nil
+}
+
+func (s *Server) getChallengeTeams(challengeID int) ([]Team, error) {
+	q := "select teams.id, teams.name from challenge_teams join teams on teams.id=challenge_teams.team_id where challenge_teams.challenge_id=? order by teams.name"
+	rows, err := s.DB.Query(q, challengeID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getChallengeTeams: %w", err)
+	}
+	defer rows.Close()
+
+	teams := make([]Team, 0)
+	for rows.Next() {
+		var t Team
+		if err := rows.Scan(&t.ID, &t.Name); err != nil {
+			return nil, fmt.Errorf("unable to scan getChallengeTeams: %w", err)
+		}
+		teams = append(teams, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getChallengeTeams: %w", err)
+	}
+	return teams, nil
+}
+
+// postChallenge creates the challenge with teamID as its first team
+func (s *Server) postChallenge(uid int, teamID int, c *Challenge) error {
+	c.CreatedOn = int(time.Now().Unix())
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to begin postChallenge: %w", err)
+	}
+	q := "insert into challenges (name, exercise_id, start_day, end_day, created_by_user_id, created_on) values (?, ?, ?, ?, ?, ?)"
+	res, err := tx.Exec(q, c.Name, c.ExerciseID, c.Start, c.End, uid, c.CreatedOn)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to insert challenge: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to get last insert id for challenge: %w", err)
+	}
+	if _, err := tx.Exec("insert into challenge_teams (challenge_id, team_id, joined_on) values (?, ?, ?)", id, teamID, c.CreatedOn); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to insert challenge team: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit challenge: %w", err)
+	}
+
+	c.ID = int(id)
+	return nil
+}
+
+// joinChallenge opts the team in. Joining twice is a no-op
+func (s *Server) joinChallenge(challengeID, teamID int) error {
+	q := "insert or ignore into challenge_teams (challenge_id, team_id, joined_on) values (?, ?, ?)"
+	if _, err := s.DB.Exec(q, challengeID, teamID, time.Now().Unix()); err != nil {
+		return fmt.Errorf("unable to joinChallenge: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) leaveChallenge(challengeID, teamID int) error {
+	if _, err := s.DB.Exec("delete from challenge_teams where challenge_id=? and team_id=?", challengeID, teamID); err != nil {
+		return fmt.Errorf("unable to leaveChallenge: %w", err)
+	}
+	return nil
+}
+
+// hideChallengeTeams drops the invite-only teams the caller cannot see from the challenge, so listing challenges or
+// their scoreboards does not give those teams away. Admins see every team
+func (s *Server) hideChallengeTeams(r *http.Request, c *Challenge) error {
+	if s.isAdmin(r) {
+		return nil
+	}
+	hidden, err := s.getHiddenTeams(r.Context().Value(ctxUID).(int))
+	if err != nil {
+		return err
+	}
+	visible := make([]Team, 0, len(c.Teams))
+	for _, t := range c.Teams {
+		if !inIntList(t.ID, hidden) {
+			visible = append(visible, t)
+		}
+	}
+	c.Teams = visible
+	return nil
+}
+
+// getScoreboard ranks the challenge's teams by points per active member
+func (s *Server) getScoreboard(c *Challenge) ([]ChallengeScore, error) {
+	start, end := c.window()
+
+	scores := make([]ChallengeScore, 0, len(c.Teams))
+	for _, team := range c.Teams {
+		score := ChallengeScore{TeamID: team.ID, Name: team.Name}
+
+		q := "select count(*) from (" + teamMembersSQL + ")"
+		if err := s.DB.QueryRow(q, team.ID).Scan(&score.Members); err != nil {
+			return nil, fmt.Errorf("unable to scan getScoreboard members: %w", err)
+		}
+
+		var points float64
+		q = "select count(distinct user_id), coalesce(sum(count), 0), coalesce(sum(points), 0) from reps where user_id in (" + teamMembersSQL + ") and created_on>=? and created_on<? and (?=0 or exercise_id=?)"
+		if err := s.DB.QueryRow(q, team.ID, start, end, c.ExerciseID, c.ExerciseID).Scan(&score.ActiveMembers, &score.Total, &points); err != nil {
+			return nil, fmt.Errorf("unable to scan getScoreboard totals: %w", err)
+		}
+		score.Points = roundPoints(points)
+		if score.ActiveMembers > 0 {
+			score.PerActiveMember = score.Total / score.ActiveMembers
+			score.PointsPerActiveMember = score.Points / score.ActiveMembers
+		}
+
+		scores = append(scores, score)
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].PointsPerActiveMember != scores[j].PointsPerActiveMember {
+			return scores[i].PointsPerActiveMember > scores[j].PointsPerActiveMember
+		}
+		if scores[i].Points != scores[j].Points {
+			return scores[i].Points > scores[j].Points
+		}
+		return scores[i].Name < scores[j].Name
+	})
+	for i := range scores {
+		scores[i].Rank = i + 1
+	}
+	return scores, nil
+}
+
+func (s *Server) GetChallenges(w http.ResponseWriter, r *http.Request) {
+	data, err := s.getChallenges()
+	if err != nil {
+		log.Printf("unable to GetChallenges: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range data {
+		if err := s.hideChallengeTeams(r, &data[i]); err != nil {
+			log.Printf("unable to GetChallenges: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Challenges []Challenge }{data}); err != nil {
+		log.Println("GetChallenges marshal err ", err.Error())
+	}
+}
+
+func (s *Server) GetChallenge(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.challengeFromURL(w, r)
+	if !ok {
+		return
+	}
+	if err := s.hideChallengeTeams(r, c); err != nil {
+		log.Printf("unable to GetChallenge: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		log.Println("GetChallenge marshal err ", err.Error())
+	}
+}
+
+// PostChallenges starts a challenge with one of your teams. Body: {"Name", "Exercise" or "ExerciseID" (optional), "Start", "End", "TeamID"}
+func (s *Server) PostChallenges(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Challenge
+		TeamID int
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c := &req.Challenge
+
+	if c.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if c.ExerciseID != 0 || c.Exercise != "" {
+		ex, ok := s.getExerciseByID(c.ExerciseID)
+		if !ok {
+			ex, ok = s.getExerciseByName(c.Exercise)
+		}
+		if !ok {
+			http.Error(w, "unknown exercise; set ExerciseID or Exercise to one of GET /v3/exercises, or neither to count every exercise", http.StatusBadRequest)
+			return
+		}
+		c.ExerciseID, c.Exercise = ex.ID, ex.Name
+	}
+	_, startErr := time.Parse(dayFormat, c.Start)
+	_, endErr := time.Parse(dayFormat, c.End)
+	if startErr != nil || endErr != nil || c.End < c.Start {
+		http.Error(w, "Start and End must be YYYY-MM-DD dates, with End on or after Start", http.StatusBadRequest)
+		return
+	}
+
+	owner, found, err := s.getTeamOwner(req.TeamID)
+	if err != nil {
+		log.Printf("unable to PostChallenges: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "TeamID must be one of your teams", http.StatusBadRequest)
+		return
+	}
+	if owner != uid && !s.isAdmin(r) {
+		http.Error(w, "only the team owner can enter the team in a challenge", http.StatusForbidden)
+		return
+	}
+
+	if err := s.postChallenge(uid, req.TeamID, c); err != nil {
+		log.Printf("unable to PostChallenges: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	created, err := s.getChallenge(c.ID)
+	if err != nil {
+		log.Printf("unable to PostChallenges: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.auditRequest(r, owner, AuditEntry{Action: "challenge.create", SubjectType: "challenge", SubjectID: c.ID, After: auditJSON(created)})
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		log.Println("PostChallenges marshal err ", err.Error())
+	}
+}
+
+// PostChallengeTeam opts a team into a challenge that has not ended. Team owners only
+func (s *Server) PostChallengeTeam(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.challengeFromURL(w, r)
+	if !ok {
+		return
+	}
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+	if time.Now().UTC().Format(dayFormat) > c.End {
+		http.Error(w, "the challenge is over", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.joinChallenge(c.ID, teamID); err != nil {
+		log.Printf("unable to PostChallengeTeam: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.teamAuditRequest(r, teamID, AuditEntry{Action: "challenge.join", SubjectType: "challenge", SubjectID: c.ID, After: auditJSON(struct{ TeamID int }{teamID})})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteChallengeTeam opts a team out of a challenge. Team owners only
+func (s *Server) DeleteChallengeTeam(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.challengeFromURL(w, r)
+	if !ok {
+		return
+	}
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.leaveChallenge(c.ID, teamID); err != nil {
+		log.Printf("unable to DeleteChallengeTeam: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.teamAuditRequest(r, teamID, AuditEntry{Action: "challenge.leave", SubjectType: "challenge", SubjectID: c.ID, Before: auditJSON(struct{ TeamID int }{teamID})})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) GetScoreboard(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.challengeFromURL(w, r)
+	if !ok {
+		return
+	}
+	if err := s.hideChallengeTeams(r, c); err != nil {
+		log.Printf("unable to GetScoreboard: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	scores, err := s.getScoreboard(c)
+	if err != nil {
+		log.Printf("unable to GetScoreboard: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Challenge *Challenge
+		Scores    []ChallengeScore
+	}{c, scores}
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("GetScoreboard marshal err ", err.Error())
+	}
+}
+
+// challengeFromURL loads the challenge in the challengeID url param. It writes the error response when not ok
+func (s *Server) challengeFromURL(w http.ResponseWriter, r *http.Request) (*Challenge, bool) {
+	challengeID, err := strconv.Atoi(chi.URLParam(r, "challengeID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	c, err := s.getChallenge(challengeID)
+	if err != nil {
+		log.Printf("unable to get challenge: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if c == nil {
+		http.Error(w, "challenge not found", http.StatusNotFound)
+		return nil, false
+	}
+	return c, true
+}
@@ -0,0 +1,177 @@
+package countmyreps
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestScoreboard(t *testing.T) {
+	s, _ := newTestServer(t)
+	day := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+
+	// four lifters, three of whom show up, against one very dedicated lifter
+	captain := mustCreateUser(t, s, "captain@twilio.com")
+	big, err := s.postTeam("Big Team", captain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsertReps(t, s, captain, "Push Ups", 100, day)
+	for i, count := range []int{100, 100, 0} {
+		uid := mustCreateUser(t, s, fmt.Sprintf("member%d@twilio.com", i))
+		if err := s.postMyTeams(big.ID, uid); err != nil {
+			t.Fatal(err)
+		}
+		if count > 0 {
+			mustInsertReps(t, s, uid, "Push Ups", count, day)
+		}
+	}
+
+	solo := mustCreateUser(t, s, "solo@twilio.com")
+	small, err := s.postTeam("Small Team", solo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsertReps(t, s, solo, "Push Ups", 150, day)
+	// outside the challenge and a different exercise; neither count
+	mustInsertReps(t, s, solo, "Push Ups", 1000, day.AddDate(0, 0, -7))
+	mustInsertReps(t, s, solo, "Squats", 1000, day)
+
+	ex, _ := s.getExerciseByName("Push Ups")
+	c := &Challenge{Name: "Push Off", ExerciseID: ex.ID, Start: "2020-11-10", End: "2020-11-12"}
+	if err := s.postChallenge(captain, big.ID, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.joinChallenge(c.ID, small.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = s.getChallenge(c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores, err := s.getScoreboard(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ChallengeScore{
+		{TeamID: small.ID, Name: "Small Team", Rank: 1, Members: 1, ActiveMembers: 1, Total: 150, PerActiveMember: 150, Points: 150, PointsPerActiveMember: 150},
+		{TeamID: big.ID, Name: "Big Team", Rank: 2, Members: 4, ActiveMembers: 3, Total: 300, PerActiveMember: 100, Points: 300, PointsPerActiveMember: 100},
+	}
+	if got := len(scores); got != len(want) {
+		t.Fatalf("got %d scores, want %d", got, len(want))
+	}
+	for i := range want {
+		if scores[i] != want[i] {
+			t.Errorf("got score %+v, want %+v", scores[i], want[i])
+		}
+	}
+
+	if err := s.leaveChallenge(c.ID, small.ID); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = s.getChallenge(c.ID)
+	if got, want := len(c.Teams), 1; got != want {
+		t.Errorf("got %d teams after leaving, want %d", got, want)
+	}
+}
+
+func TestChallengeTeamOwner(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	owner := mustCreateUser(t, s, "owner@twilio.com")
+	member := mustCreateUser(t, s, "member@twilio.com")
+	home, err := s.postTeam("Home Team", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	away, err := s.postTeam("Away Team", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postMyTeams(away.ID, member); err != nil {
+		t.Fatal(err)
+	}
+
+	end := time.Now().UTC().AddDate(0, 0, 7).Format(dayFormat)
+	c := &Challenge{Name: "Open", Start: "2020-11-01", End: end}
+	if err := s.postChallenge(owner, home.ID, c); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := chi.NewRouter()
+	mux.Post("/challenges/{challengeID}/teams/{teamID}", s.PostChallengeTeam)
+	join := func(uid, teamID int) int {
+		r := httptest.NewRequest("POST", fmt.Sprintf("/challenges/%d/teams/%d", c.ID, teamID), nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxUID, uid))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if got, want := join(member, away.ID), http.StatusForbidden; got != want {
+		t.Errorf("got %d for a member entering the team, want %d", got, want)
+	}
+	if got, want := join(owner, 9999), http.StatusNotFound; got != want {
+		t.Errorf("got %d for an unknown team, want %d", got, want)
+	}
+	if got, want := join(owner, away.ID), http.StatusNoContent; got != want {
+		t.Errorf("got %d for the owner entering the team, want %d", got, want)
+	}
+
+	c, _ = s.getChallenge(c.ID)
+	if got, want := len(c.Teams), 2; got != want {
+		t.Errorf("got %d teams, want %d", got, want)
+	}
+}
+
+func TestTeamGoalProgress(t *testing.T) {
+	s, _ := newTestServer(t)
+	now := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+
+	owner := mustCreateUser(t, s, "owner@twilio.com")
+	member := mustCreateUser(t, s, "member@twilio.com")
+	team, err := s.postTeam("Goal Getters", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postMyTeams(team.ID, member); err != nil {
+		t.Fatal(err)
+	}
+	mustInsertReps(t, s, owner, "Squats", 300, now.Add(-time.Hour))
+	mustInsertReps(t, s, member, "Squats", 200, now.Add(-2*time.Hour))
+
+	g := &Goal{TeamID: team.ID, Exercise: "Squats", Target: 1000, Period: goalWeek, Start: "2020-11-01"}
+	if err := s.validateGoal(g); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postGoal(owner, g); err != nil {
+		t.Fatal(err)
+	}
+
+	goals, err := s.getTeamGoals(team.ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(goals), 1; got != want {
+		t.Fatalf("got %d team goals, want %d", got, want)
+	}
+	if got, want := goals[0].Progress.Count, 500; got != want {
+		t.Errorf("got team progress %d, want %d", got, want)
+	}
+
+	// team goals are not personal goals
+	personal, err := s.getGoals(owner, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(personal); got != 0 {
+		t.Errorf("got %d personal goals, want the team goal kept separate", got)
+	}
+}
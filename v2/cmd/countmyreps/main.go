@@ -1,13 +1,31 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/kelseyhightower/envconfig"
 	countmyreps "github.com/sethgrid/countmyreps/v2"
 	"github.com/sethgrid/countmyreps/v2/config"
 )
 
+const usage = `usage: countmyreps [command]
+
+With no command, serve countmyreps. Commands:
+  import -email {:email:} [-dry-run] file.csv   add historical reps from a CSV with date, exercise, and count columns
+  import -rollback {:import_id:}                remove the reps added by an import
+  migrate-v1 -dsn {:mysql_dsn:} [-dry-run]       copy v1's users, teams, and reps from MySQL, and print a reconciliation report
+  restore [-check] snapshot.db                  check a backup and swap it in for the db; stop the server first
+`
+
 func main() {
 
 	c := &config.Config{}
@@ -16,6 +34,21 @@ func main() {
 		log.Fatalf("config error: unable to start countmyreps - %s", err)
 	}
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			runImport(c, os.Args[2:])
+		case "migrate-v1":
+			runMigrateV1(c, os.Args[2:])
+		case "restore":
+			runRestore(c, os.Args[2:])
+		default:
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		return
+	}
+
 	s, err := countmyreps.NewServer(c)
 	if err != nil {
 		log.Fatalf("unable to create server: %s", err)
@@ -25,3 +58,163 @@ func main() {
 		log.Fatalf("unable to continue serving countmyreps: %s", err)
 	}
 }
+
+// runImport imports a CSV, or rolls an import back. The report is printed as json; a CSV with errors exits 1 without importing anything
+func runImport(c *config.Config, args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	email := flags.String("email", "", "who the reps are logged for, unless the CSV has an email column")
+	dryRun := flags.Bool("dry-run", false, "only check the CSV and report any errors")
+	rollback := flags.Int("rollback", 0, "the import id to roll back instead of importing")
+	flags.Parse(args)
+
+	if *rollback == 0 && (*email == "" || flags.NArg() != 1) {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	s, err := countmyreps.NewCommandServer(c)
+	if err != nil {
+		log.Fatalf("unable to open countmyreps: %s", err)
+	}
+	defer s.DB.Close()
+
+	if *rollback != 0 {
+		removed, err := s.RollbackImport(*rollback)
+		if err != nil {
+			log.Fatalf("unable to roll back import %d: %s", *rollback, err)
+		}
+		if removed < 0 {
+			log.Fatalf("import %d not found or already rolled back", *rollback)
+		}
+		log.Printf("rolled back import %d, removing %d reps", *rollback, removed)
+		return
+	}
+
+	var in io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("unable to open %s: %s", path, err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	report, err := s.ImportCSV(*email, in, *dryRun)
+	if err != nil {
+		log.Fatalf("unable to import: %s", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if len(report.Errors) > 0 {
+		s.DB.Close()
+		os.Exit(1)
+	}
+}
+
+// runMigrateV1 copies v1 into v2 and prints how the totals compare. It exits 1 when they do not reconcile
+func runMigrateV1(c *config.Config, args []string) {
+	flags := flag.NewFlagSet("migrate-v1", flag.ExitOnError)
+	dsn := flags.String("dsn", "", "v1's MySQL data source name, like user:pass@tcp(localhost:3306)/countmyreps")
+	dryRun := flags.Bool("dry-run", false, "report what would be copied, then roll it back")
+	flags.Parse(args)
+
+	if *dsn == "" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// v1 timestamps are read as UTC, the same as v1 did
+	mysqlConf, err := mysql.ParseDSN(*dsn)
+	if err != nil {
+		log.Fatalf("unable to parse dsn: %s", err)
+	}
+	mysqlConf.ParseTime = true
+	v1, err := sql.Open("mysql", mysqlConf.FormatDSN())
+	if err != nil {
+		log.Fatalf("unable to open v1 db: %s", err)
+	}
+	defer v1.Close()
+	if err := v1.Ping(); err != nil {
+		log.Fatalf("unable to reach v1 db: %s", err)
+	}
+
+	s, err := countmyreps.NewCommandServer(c)
+	if err != nil {
+		log.Fatalf("unable to open countmyreps: %s", err)
+	}
+	defer s.DB.Close()
+
+	report, err := s.MigrateV1(v1, *dryRun)
+	if err != nil {
+		log.Fatalf("unable to migrate v1: %s", err)
+	}
+
+	fmt.Printf("users: %d (%d new)\n", report.Users, report.UsersCreated)
+	fmt.Printf("offices and teams: %d and %d (%d new teams)\n", report.Offices, report.Teams, report.TeamsCreated)
+	fmt.Printf("memberships: %d (%d new)\n\n", report.Memberships, report.MembershipsAdded)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "exercise\tv1 names\tv1 entries\tv1 count\tv2 entries\tv2 count\tskipped entries\tskipped count")
+	for _, ex := range report.Exercises {
+		name := ex.Exercise
+		if name == "" {
+			name = "(no match)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n", name, strings.Join(ex.V1Exercises, ", "), ex.V1Entries, ex.V1Count, ex.V2Entries, ex.V2Count, ex.SkippedEntries, ex.SkippedCount)
+	}
+	tw.Flush()
+	fmt.Println()
+
+	switch {
+	case !report.Reconciled:
+		fmt.Println("totals do not reconcile; nothing was kept")
+	case report.DryRun:
+		fmt.Println("dry run; nothing was kept")
+	default:
+		fmt.Printf("copied as import %d; undo with: countmyreps import -rollback %d\n", report.ImportID, report.ImportID)
+	}
+	if !report.Reconciled {
+		v1.Close()
+		s.DB.Close()
+		os.Exit(1)
+	}
+}
+
+// runRestore swaps a backup in for the db, or with -check only validates it. The replaced db is kept beside the new one
+func runRestore(c *config.Config, args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	check := flags.Bool("check", false, "only validate the snapshot")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	snapshot := flags.Arg(0)
+
+	if *check {
+		if err := countmyreps.ValidateSnapshot(snapshot); err != nil {
+			log.Fatalf("snapshot %s is not usable: %s", snapshot, err)
+		}
+		log.Printf("snapshot %s is usable", snapshot)
+		return
+	}
+
+	previous, err := countmyreps.RestoreDB(c, snapshot)
+	if err != nil {
+		log.Fatalf("unable to restore %s: %s", snapshot, err)
+	}
+	if previous != "" {
+		log.Printf("moved the old db to %s", previous)
+	}
+
+	// bring an older snapshot up to this version's schema now rather than on the next start
+	s, err := countmyreps.NewCommandServer(c)
+	if err != nil {
+		log.Fatalf("restored %s but unable to open it: %s", snapshot, err)
+	}
+	s.DB.Close()
+	log.Printf("restored %s to %s", snapshot, c.DBPath)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -19,8 +20,83 @@ type Config struct {
 
 	// When set to true, the server will not contact Google OAuth2. Instead, the handler will take the passed in `code` and store that as the user's email address
 	DevMode bool `envconfig:"dev_mode" default:"false"`
+
+	// EmailBackend selects how outbound mail is delivered: "sendgrid", "smtp", "outbox", or "none" to only log messages
+	EmailBackend string `envconfig:"email_backend" default:"none"`
+	EmailFrom    string `envconfig:"email_from" default:"automailer@countmyreps.com"`
+	EmailName    string `envconfig:"email_name" default:"CountMyReps"`
+
+	SendGridAPIKey string `envconfig:"sendgrid_api_key"`
+
+	SMTPHost string `envconfig:"smtp_host" default:"localhost"`
+	SMTPPort int    `envconfig:"smtp_port" default:"25"`
+	SMTPUser string `envconfig:"smtp_user"`
+	SMTPPass string `envconfig:"smtp_pass"`
+
+	// OutboxPath is the directory the "outbox" email backend writes .eml files to. Useful for local dev and tests
+	OutboxPath string `envconfig:"outbox_path" default:"outbox"`
+
+	// TemplatesPath defaults to a relative directory to the running binary of ./templates, holding the email templates
+	TemplatesPath string `envconfig:"templates_path" default:"templates"`
+
+	// ChallengeStart and ChallengeEnd bound the current challenge as YYYY-MM-DD (end inclusive). When unset, the current calendar month is used
+	ChallengeStart string `envconfig:"challenge_start"`
+	ChallengeEnd   string `envconfig:"challenge_end"`
+
+	// SchedulerInterval is how often scheduled jobs (digests, etc) check for work
+	SchedulerInterval time.Duration `envconfig:"scheduler_interval" default:"10m"`
+	// DigestHour is the hour of the day, in the user's timezone, that digests go out
+	DigestHour int `envconfig:"digest_hour" default:"8"`
+	// DigestWeekday is the day of the week weekly digests go out
+	DigestWeekday string `envconfig:"digest_weekday" default:"monday"`
+
+	// ReminderHour is the hour of the day, in the user's timezone, to remind users who have not logged yet that day. Set to -1 to disable
+	ReminderHour int `envconfig:"reminder_hour" default:"15"`
+	// ReminderIdleDays reminds users who have not logged anything for this many days. Set to 0 to disable
+	ReminderIdleDays int `envconfig:"reminder_idle_days" default:"3"`
+	// ReminderWeeklyCap is the most reminders any one user will get in a rolling week
+	ReminderWeeklyCap int `envconfig:"reminder_weekly_cap" default:"3"`
+
+	// SlackSigningSecret verifies requests to the Slack slash command endpoint. The endpoint is disabled when empty
+	SlackSigningSecret string `envconfig:"slack_signing_secret"`
+	// SlackBotToken is used to look up a Slack user's email address. Requires the users:read.email scope
+	SlackBotToken string `envconfig:"slack_bot_token"`
+
+	// Admins are the email addresses allowed to use admin features, like webhooks for every user's events
+	Admins []string `envconfig:"admins"`
+	// AccountDeletion is what DELETE /v3/me does: "anonymize" keeps the user's reps and memberships under a placeholder so team
+	// totals do not change, and "delete" removes them
+	AccountDeletion string `envconfig:"account_deletion" default:"anonymize"`
+
+	// WebhookPollInterval is how often the webhook queue is checked for deliveries that are due for a retry
+	WebhookPollInterval time.Duration `envconfig:"webhook_poll_interval" default:"5s"`
+	// WebhookMaxAttempts is how many times a delivery is tried, with exponential backoff, before it is marked failed
+	WebhookMaxAttempts int `envconfig:"webhook_max_attempts" default:"8"`
+	// WebhookAllowPrivate lets webhooks reach loopback, private, and link-local addresses, for trying webhooks out locally. Leave
+	// it off anywhere users can register webhooks, or they can reach services on the server's own network
+	WebhookAllowPrivate bool `envconfig:"webhook_allow_private" default:"false"`
+
+	// StreakFreezes is how many rest days a user can take per challenge without breaking their streak. 0 disables rest days
+	StreakFreezes int `envconfig:"streak_freezes" default:"0"`
+
+	// StreamHeartbeat is how often an idle /v3/stream connection gets a comment line to keep proxies from closing it
+	StreamHeartbeat time.Duration `envconfig:"stream_heartbeat" default:"15s"`
+	// StreamDisplayToken lets shared displays, which cannot sign in, open /v3/stream with ?display_token=. Empty, the default,
+	// means the stream needs a signed in user like every other endpoint
+	StreamDisplayToken string `envconfig:"stream_display_token"`
+
+	// BackupPath is the directory db snapshots are written to. Backups are disabled when empty
+	BackupPath string `envconfig:"backup_path" default:"backups"`
+	// BackupInterval is how often a snapshot is taken. Set to 0 to only take them on demand
+	BackupInterval time.Duration `envconfig:"backup_interval" default:"24h"`
+	// BackupKeep is how many snapshots to keep; older ones are deleted after each new one
+	BackupKeep int `envconfig:"backup_keep" default:"7"`
+
 	// computed
-	FullAddr string
+	FullAddr          string
+	DigestDay         time.Weekday
+	challengeStartDay time.Time
+	challengeEndDay   time.Time
 }
 
 // Sanitize will clean up fixable config errors and error out on validation problems
@@ -34,6 +110,94 @@ func (c *Config) Sanitize() error {
 		c.DevMode = false
 	}
 
+	c.EmailBackend = strings.ToLower(strings.TrimSpace(c.EmailBackend))
+	switch c.EmailBackend {
+	case "", "none":
+		c.EmailBackend = "none"
+	case "sendgrid":
+		if c.SendGridAPIKey == "" {
+			return fmt.Errorf("sendgrid_api_key required when email_backend is sendgrid")
+		}
+	case "smtp":
+		if c.SMTPHost == "" {
+			return fmt.Errorf("smtp_host required when email_backend is smtp")
+		}
+	case "outbox":
+		if c.OutboxPath == "" {
+			return fmt.Errorf("outbox_path required when email_backend is outbox")
+		}
+	default:
+		return fmt.Errorf("unknown email_backend %q", c.EmailBackend)
+	}
+
+	if c.ChallengeStart != "" || c.ChallengeEnd != "" {
+		start, err := time.Parse("2006-01-02", c.ChallengeStart)
+		if err != nil {
+			return fmt.Errorf("challenge_start must be YYYY-MM-DD: %w", err)
+		}
+		end, err := time.Parse("2006-01-02", c.ChallengeEnd)
+		if err != nil {
+			return fmt.Errorf("challenge_end must be YYYY-MM-DD: %w", err)
+		}
+		if end.Before(start) {
+			return fmt.Errorf("challenge_end cannot be before challenge_start")
+		}
+		c.challengeStartDay, c.challengeEndDay = start, end
+	}
+
+	if c.SchedulerInterval <= 0 {
+		c.SchedulerInterval = 10 * time.Minute
+	}
+	if c.DigestHour < 0 || c.DigestHour > 23 {
+		return fmt.Errorf("digest_hour must be between 0 and 23")
+	}
+	if c.ReminderHour < -1 || c.ReminderHour > 23 {
+		return fmt.Errorf("reminder_hour must be between 0 and 23, or -1 to disable")
+	}
+	if c.ReminderIdleDays < 0 {
+		return fmt.Errorf("reminder_idle_days cannot be negative")
+	}
+
+	if c.WebhookPollInterval <= 0 {
+		c.WebhookPollInterval = 5 * time.Second
+	}
+	if c.WebhookMaxAttempts <= 0 {
+		c.WebhookMaxAttempts = 1
+	}
+	if c.StreakFreezes < 0 {
+		return fmt.Errorf("streak_freezes cannot be negative")
+	}
+	if c.StreamHeartbeat <= 0 {
+		c.StreamHeartbeat = 15 * time.Second
+	}
+	if c.BackupInterval < 0 {
+		return fmt.Errorf("backup_interval cannot be negative")
+	}
+	if c.BackupKeep < 1 {
+		c.BackupKeep = 1
+	}
+	for i, admin := range c.Admins {
+		c.Admins[i] = strings.ToLower(strings.TrimSpace(admin))
+	}
+
+	if c.SlackSigningSecret != "" && c.SlackBotToken == "" {
+		return fmt.Errorf("slack_bot_token required when slack_signing_secret is set")
+	}
+
+	digestDay, ok := weekdays[strings.ToLower(c.DigestWeekday)]
+	if !ok {
+		return fmt.Errorf("unknown digest_weekday %q", c.DigestWeekday)
+	}
+	c.DigestDay = digestDay
+
+	switch c.AccountDeletion {
+	case "":
+		c.AccountDeletion = "anonymize"
+	case "anonymize", "delete":
+	default:
+		return fmt.Errorf("account_deletion must be anonymize or delete, not %q", c.AccountDeletion)
+	}
+
 	scheme := "https"
 	if !c.UseHTTPS {
 		scheme = "http"
@@ -41,3 +205,33 @@ func (c *Config) Sanitize() error {
 	c.FullAddr = fmt.Sprintf("%s://%s", scheme, c.Addr)
 	return nil
 }
+
+// IsAdmin reports if the email address is one of the configured admins
+func (c *Config) IsAdmin(email string) bool {
+	email = strings.ToLower(strings.TrimSpace(email))
+	for _, admin := range c.Admins {
+		if admin != "" && admin == email {
+			return true
+		}
+	}
+	return false
+}
+
+// Challenge returns the start and end (exclusive) of the current challenge. Without configured dates, it is the calendar month of now
+func (c *Config) Challenge(now time.Time) (time.Time, time.Time) {
+	if !c.challengeStartDay.IsZero() {
+		return c.challengeStartDay, c.challengeEndDay.AddDate(0, 0, 1)
+	}
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
@@ -38,27 +38,50 @@ type Server struct {
 	httpSrv     *http.Server
 	googleCreds Credentials
 	oAuthConf   *oauth2.Config
+	emailer     Emailer
 	tokenCache  *cache.Cache
 	rand        *rand.Rand
 
+	emailTemplates map[string]emailTemplate
+	slackAPIURL    string
+
+	// webhookKick wakes the webhook delivery worker when deliveries are queued
+	webhookKick   chan struct{}
+	webhookClient *http.Client
+
+	// events are published by db writes for side effects like webhooks to subscribe to
+	events *eventBus
+	// stream fans leaderboard updates out to /v3/stream clients
+	stream *streamHub
+
+	// done is closed on shutdown to stop background work like the scheduler
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// backupMu keeps scheduled and on demand backups from writing or pruning at the same time
+	backupMu sync.Mutex
+
 	mu             *sync.Mutex
 	exerciseByID   map[int]Exercise
 	exerciseByName map[string]Exercise
 }
 
 func NewServer(c *config.Config) (*Server, error) {
-	s := &Server{
-		conf:           c,
-		DevMode:        c.DevMode,
-		mu:             &sync.Mutex{},
-		exerciseByID:   make(map[int]Exercise),
-		exerciseByName: make(map[string]Exercise),
+	if err := c.Sanitize(); err != nil {
+		return nil, err
 	}
 
-	s.tokenCache = cache.New(60*time.Minute, 15*time.Minute)
-	s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	s := newServer(c)
 
-	if err := c.Sanitize(); err != nil {
+	var err error
+
+	s.emailer, err = NewEmailer(c)
+	if err != nil {
+		return nil, err
+	}
+
+	s.emailTemplates, err = loadEmailTemplates(c.TemplatesPath)
+	if err != nil {
 		return nil, err
 	}
 
@@ -105,7 +128,50 @@ func NewServer(c *config.Config) (*Server, error) {
 	return s, nil
 }
 
+// NewCommandServer opens the db for command line tools. Unlike NewServer, it does not need Google credentials or
+// email templates, and it does not serve http. Close the DB when done
+func NewCommandServer(c *config.Config) (*Server, error) {
+	if err := c.Sanitize(); err != nil {
+		return nil, err
+	}
+
+	s := newServer(c)
+	if err := s.InitDB(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newServer sets up the in memory state of a server from a sanitized config. It does not touch the db, network, or disk
+func newServer(c *config.Config) *Server {
+	s := &Server{
+		conf:           c,
+		DevMode:        c.DevMode,
+		mu:             &sync.Mutex{},
+		exerciseByID:   make(map[int]Exercise),
+		exerciseByName: make(map[string]Exercise),
+		emailer:        &LogEmailer{},
+		tokenCache:     cache.New(60*time.Minute, 15*time.Minute),
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		slackAPIURL:    "https://slack.com/api",
+		webhookKick:    make(chan struct{}, 1),
+		events:         newEventBus(),
+		stream:         newStreamHub(),
+		done:           make(chan struct{}),
+	}
+	s.webhookClient = s.newWebhookClient()
+
+	s.events.subscribe("webhooks", s.handleWebhookEvent)
+	s.events.subscribe("stream", s.handleStreamEvent)
+	s.events.subscribe("achievements", s.handleAchievementEvent)
+
+	return s
+}
+
 func (s *Server) Serve() error {
+	go s.runScheduler()
+	go s.runWebhookDeliveries()
+
 	log.Printf("serving on :%d", s.conf.Port)
 	if err := s.httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		// don't overwrite the existing error needed to show why the server failed, but still capture any problems with the server shutting down
@@ -120,6 +186,8 @@ func (s *Server) Serve() error {
 func (s *Server) Close() error {
 	defer s.DB.Close()
 
+	s.closeOnce.Do(func() { close(s.done) })
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer func() {
 		// extra handling here
@@ -130,7 +198,18 @@ func (s *Server) Close() error {
 		log.Fatalf("Server Shutdown Failed:%+v", err)
 	}
 
+	// let subscribers finish with events from requests that completed before shutdown
+	s.events.close()
+
 	if s.conf.RemoveDBOnShutdown {
+		// keep a last snapshot of the db about to be removed, when backups are on
+		if s.conf.BackupPath != "" {
+			if b, err := s.backupDB(time.Now()); err != nil {
+				log.Printf("unable to back up db before removing it: %s", err)
+			} else {
+				log.Printf("backed up db to %s before removing it", b.Name)
+			}
+		}
 		if err := os.Remove(s.conf.DBPath); err != nil {
 			return fmt.Errorf("unable to remove db - %w", err)
 		}
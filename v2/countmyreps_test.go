@@ -0,0 +1,114 @@
+package countmyreps
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sethgrid/countmyreps/v2/config"
+)
+
+// newTestServer returns a server backed by a fresh, seeded db in a temp dir. Sent email is captured by the returned FakeEmailer
+func newTestServer(t *testing.T) (*Server, *FakeEmailer) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "cmr_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &config.Config{
+		Addr:           "localhost:5000",
+		DBPath:         filepath.Join(dir, "cmr.db"),
+		TemplatesPath:  filepath.Join("cmd", "countmyreps", "templates"),
+		ChallengeStart: "2020-11-01",
+		ChallengeEnd:   "2020-11-30",
+		DigestHour:     8,
+		DigestWeekday:  "monday",
+
+		ReminderHour:      15,
+		ReminderIdleDays:  3,
+		ReminderWeeklyCap: 3,
+
+		WebhookMaxAttempts: 3,
+	}
+	if err := c.Sanitize(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer(c)
+	emailer := &FakeEmailer{}
+	s.emailer = emailer
+
+	if err := s.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	s.emailTemplates, err = loadEmailTemplates(c.TemplatesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.events.close()
+		s.DB.Close()
+		os.RemoveAll(dir)
+	})
+
+	return s, emailer
+}
+
+func mustCreateUser(t *testing.T, s *Server, email string) int {
+	t.Helper()
+	uid, err := s.getOrCreateUser(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uid
+}
+
+// mustInsertReps adds reps directly so tests control created_on
+func mustInsertReps(t *testing.T, s *Server, uid int, exerciseName string, count int, at time.Time) {
+	t.Helper()
+	ex, ok := s.getExerciseByName(exerciseName)
+	if !ok {
+		t.Fatalf("unknown exercise %q", exerciseName)
+	}
+	_, err := s.DB.Exec("insert into reps (exercise_id, user_id, count, points, created_on) values (?, ?, ?, ?, ?)", ex.ID, uid, count, ex.points(count), at.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testClient calls the server's routes as a signed in user
+type testClient struct {
+	t     *testing.T
+	mux   *chi.Mux
+	token string
+	UID   int
+}
+
+func newTestClient(t *testing.T, s *Server, email string) *testClient {
+	t.Helper()
+	uid := mustCreateUser(t, s, email)
+	token, err := s.createAndStoreToken(uid, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := chi.NewRouter()
+	s.setRoutes(mux)
+	return &testClient{t: t, mux: mux, token: token.Token, UID: uid}
+}
+
+func (c *testClient) do(method, path, body string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+c.token)
+	w := httptest.NewRecorder()
+	c.mux.ServeHTTP(w, r)
+	return w
+}
@@ -6,8 +6,11 @@ import (
 	"log"
 	"math"
 	"os"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/sethgrid/countmyreps/v2/teamname"
 )
 
 var exercises []Exercise
@@ -91,6 +94,11 @@ type Exercise struct {
 	Name      string
 	ValueType string
 	Count     int
+	// Points is Count scored at the exercise's weight, so different exercises can be added up fairly
+	Points int
+	// Weight is the points for every Per of the ValueType; Running at a Weight of 1 Per 10 is a point every 10 meters. Only set on the exercise list
+	Weight float64 `json:",omitempty"`
+	Per    int     `json:",omitempty"`
 }
 
 type Stats struct {
@@ -104,7 +112,7 @@ func (s *Server) getStats(uids []int, start, end int) ([]Stats, error) {
 		uidStrs = append(uidStrs, fmt.Sprintf("%d", uid))
 	}
 
-	q := "SELECT exercise_id, count, created_on FROM reps where created_on>=? and created_on<=?"
+	q := "SELECT exercise_id, count, points, created_on FROM reps where created_on>=? and created_on<=?"
 
 	if len(uids) > 0 {
 		q += fmt.Sprintf(" and user_id in (%s)", strings.Join(uidStrs, ","))
@@ -119,13 +127,14 @@ func (s *Server) getStats(uids []int, start, end int) ([]Stats, error) {
 
 	for rows.Next() {
 		var exerciseID, count int
+		var points float64
 		var createdOn string
-		err := rows.Scan(&exerciseID, &count, &createdOn)
+		err := rows.Scan(&exerciseID, &count, &points, &createdOn)
 		if err != nil {
 			return nil, fmt.Errorf("unable to scan getStats: %w", err)
 		}
 		ex, _ := s.getExerciseByID(exerciseID)
-		m[createdOn] = append(m[createdOn], Exercise{ID: exerciseID, Name: ex.Name, ValueType: ex.ValueType, Count: count})
+		m[createdOn] = append(m[createdOn], Exercise{ID: exerciseID, Name: ex.Name, ValueType: ex.ValueType, Count: count, Points: roundPoints(points)})
 	}
 
 	if rows.Err() != nil {
@@ -141,7 +150,7 @@ func (s *Server) getStats(uids []int, start, end int) ([]Stats, error) {
 	return stats, nil
 }
 func (s *Server) getStatsForTeam(teamID int, start, end int) ([]Stats, error) {
-	q := "SELECT exercise_id, count, created_on FROM reps where created_on>=? and created_on<=? and user_id in (select user_id from user_teams where team_id=?)"
+	q := "SELECT exercise_id, count, points, created_on FROM reps where created_on>=? and created_on<=? and user_id in (" + teamMembersSQL + ")"
 
 	rows, err := s.DB.Query(q, start, end, teamID)
 	if err != nil && err != sql.ErrNoRows {
@@ -154,13 +163,14 @@ func (s *Server) getStatsForTeam(teamID int, start, end int) ([]Stats, error) {
 
 	for rows.Next() {
 		var exerciseID, count int
+		var points float64
 		var createdOn string
-		err := rows.Scan(&exerciseID, &count, &createdOn)
+		err := rows.Scan(&exerciseID, &count, &points, &createdOn)
 		if err != nil {
 			return nil, fmt.Errorf("unable to scan getStatsForTeam: %w", err)
 		}
 		ex, _ := s.getExerciseByID(exerciseID)
-		m[createdOn] = append(m[createdOn], Exercise{ID: exerciseID, Name: ex.Name, ValueType: ex.ValueType, Count: count})
+		m[createdOn] = append(m[createdOn], Exercise{ID: exerciseID, Name: ex.Name, ValueType: ex.ValueType, Count: count, Points: roundPoints(points)})
 	}
 
 	if rows.Err() != nil {
@@ -177,9 +187,22 @@ func (s *Server) getStatsForTeam(teamID int, start, end int) ([]Stats, error) {
 
 }
 
-func (s *Server) postStats(uid int, exs Exercises) error {
-	var queries []string
-	var args []interface{}
+// Rep is a single logged entry, as stored in the reps table
+type Rep struct {
+	ID         int
+	ExerciseID int
+	Name       string
+	ValueType  string
+	Count      int
+	Points     int
+	CreatedOn  int
+	// points is the unrounded score stored with the rep
+	points float64
+}
+
+func (s *Server) postStats(uid int, exs Exercises) ([]Rep, error) {
+	var reps []Rep
+	now := int(time.Now().Unix())
 
 	for _, ex := range exs.Collection {
 		eid := ex.ID
@@ -194,23 +217,122 @@ func (s *Server) postStats(uid int, exs Exercises) error {
 		// if id is still not set, we can't find it
 		if eid == 0 {
 			log.Printf("%#v", s.exerciseByName)
-			return fmt.Errorf("bad exercise option, id or name not found: %#v", ex)
+			return nil, fmt.Errorf("bad exercise option, id or name not found: %#v", ex)
 		}
-		queries = append(queries, "insert into reps (exercise_id, user_id, count, created_on) values (?, ?, ?, ?)")
-		args = append(args, eid, uid, int(math.Abs(float64(ex.Count))), int(time.Now().Unix()))
+		e, _ := s.getExerciseByID(eid)
+		count := int(math.Abs(float64(ex.Count)))
+		points := e.points(count)
+		reps = append(reps, Rep{ExerciseID: eid, Name: e.Name, ValueType: e.ValueType, Count: count, Points: roundPoints(points), CreatedOn: now, points: points})
 	}
 
-	_, err := s.DB.Exec(strings.Join(queries, "; "), args...)
+	tx, err := s.DB.Begin()
 	if err != nil {
-		log.Printf("insert error: %q (%v)", strings.Join(queries, "; "), args)
-		return fmt.Errorf("unable to insert reps into db: %w", err)
+		return nil, fmt.Errorf("unable to begin postStats: %w", err)
+	}
+	q := "insert into reps (exercise_id, user_id, count, points, created_on) values (?, ?, ?, ?, ?)"
+	for i, rep := range reps {
+		res, err := tx.Exec(q, rep.ExerciseID, uid, rep.Count, rep.points, rep.CreatedOn)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("insert error: %q (%v)", q, rep)
+			return nil, fmt.Errorf("unable to insert reps into db: %w", err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("unable to get last insert id for reps: %w", err)
+		}
+		reps[i].ID = int(id)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("unable to commit reps into db: %w", err)
 	}
 
-	return nil
+	s.events.publish(RepsLogged{UserID: uid, Reps: reps, At: time.Unix(int64(now), 0)})
+	return reps, nil
+}
+
+// getReps returns the user's individual entries between start and end (inclusive), newest first
+func (s *Server) getReps(uid int, start, end int) ([]Rep, error) {
+	q := "select id, exercise_id, count, points, created_on from reps where user_id=? and created_on>=? and created_on<=? order by created_on desc, id desc"
+	rows, err := s.DB.Query(q, uid, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getReps: %w", err)
+	}
+	defer rows.Close()
+
+	reps := make([]Rep, 0)
+	for rows.Next() {
+		var rep Rep
+		if err := rows.Scan(&rep.ID, &rep.ExerciseID, &rep.Count, &rep.points, &rep.CreatedOn); err != nil {
+			return nil, fmt.Errorf("unable to scan getReps: %w", err)
+		}
+		ex, _ := s.getExerciseByID(rep.ExerciseID)
+		rep.Name, rep.ValueType, rep.Points = ex.Name, ex.ValueType, roundPoints(rep.points)
+		reps = append(reps, rep)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getReps: %w", err)
+	}
+	return reps, nil
+}
+
+// getRep returns nil if the rep does not exist or belongs to someone else
+func (s *Server) getRep(repID, uid int) (*Rep, error) {
+	q := "select id, exercise_id, count, points, created_on from reps where id=? and user_id=?"
+	var rep Rep
+	err := s.DB.QueryRow(q, repID, uid).Scan(&rep.ID, &rep.ExerciseID, &rep.Count, &rep.points, &rep.CreatedOn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan getRep: %w", err)
+	}
+	ex, _ := s.getExerciseByID(rep.ExerciseID)
+	rep.Name, rep.ValueType, rep.Points = ex.Name, ex.ValueType, roundPoints(rep.points)
+	return &rep, nil
+}
+
+// putRep changes the count of one of the user's reps. It returns nil if there is no such rep
+func (s *Server) putRep(repID, uid int, count int) (*Rep, error) {
+	previous, err := s.getRep(repID, uid)
+	if err != nil || previous == nil {
+		return nil, err
+	}
+
+	rep := *previous
+	rep.Count = int(math.Abs(float64(count)))
+	ex, _ := s.getExerciseByID(rep.ExerciseID)
+	rep.points = ex.points(rep.Count)
+	rep.Points = roundPoints(rep.points)
+
+	q := "update reps set count=?, points=? where id=? and user_id=?"
+	if _, err := s.DB.Exec(q, rep.Count, rep.points, repID, uid); err != nil {
+		return nil, fmt.Errorf("unable to putRep: %w", err)
+	}
+
+	s.events.publish(RepEdited{UserID: uid, Rep: rep, Previous: *previous, At: time.Now()})
+	return &rep, nil
+}
+
+// deleteRep removes one of the user's reps. It returns false if there was no such rep
+func (s *Server) deleteRep(repID, uid int) (bool, error) {
+	previous, err := s.getRep(repID, uid)
+	if err != nil || previous == nil {
+		return false, err
+	}
+
+	q := "delete from reps where id=? and user_id=?"
+	if _, err := s.DB.Exec(q, repID, uid); err != nil {
+		return false, fmt.Errorf("unable to deleteRep: %w", err)
+	}
+
+	s.events.publish(RepDeleted{UserID: uid, Previous: *previous, At: time.Now()})
+	return true, nil
 }
 
 func (s *Server) getExercises() (*Exercises, error) {
-	q := fmt.Sprintf("SELECT id, name, value_type FROM exercises")
+	q := fmt.Sprintf("SELECT id, name, value_type, weight, per FROM exercises")
 	rows, err := s.DB.Query(q)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, fmt.Errorf("unable to getExercises: %w", err)
@@ -219,13 +341,14 @@ func (s *Server) getExercises() (*Exercises, error) {
 	exs := &Exercises{Collection: make([]Exercise, 0)}
 
 	for rows.Next() {
-		var id int
+		var id, per int
 		var name, valueType string
-		err := rows.Scan(&id, &name, &valueType)
+		var weight float64
+		err := rows.Scan(&id, &name, &valueType, &weight, &per)
 		if err != nil {
 			return nil, fmt.Errorf("unable to scan getExercises: %w", err)
 		}
-		exs.Collection = append(exs.Collection, Exercise{ID: id, Name: name, ValueType: valueType})
+		exs.Collection = append(exs.Collection, Exercise{ID: id, Name: name, ValueType: valueType, Weight: weight, Per: per})
 	}
 
 	if rows.Err() != nil {
@@ -243,6 +366,8 @@ func (s *Server) getExercises() (*Exercises, error) {
 			ID:        v.ID,
 			Name:      v.Name,
 			ValueType: v.ValueType,
+			Weight:    v.Weight,
+			Per:       v.Per,
 		}
 		exByID[v.ID] = ex
 		exByName[v.Name] = ex
@@ -263,6 +388,25 @@ type Teams struct {
 type Team struct {
 	Name string
 	ID   int
+	// HeadCount is the owner's expected number of people on the team, 0 when unset
+	HeadCount int `json:",omitempty"`
+	// ParentID is the team this one rolls up into, 0 for a top level team
+	ParentID int `json:",omitempty"`
+	// Visibility is who can find and join the team: public, private, or invite-only
+	Visibility string `json:",omitempty"`
+	// Children is only filled in for the team tree
+	Children []Team `json:",omitempty"`
+}
+
+// teamMembersSQL selects the users on a team or any team under it, each once. Its one argument is the team id
+const teamMembersSQL = "with recursive subtree(id) as (select ? union select teams.id from teams join subtree on teams.parent_id=subtree.id) select distinct user_id from user_teams where team_id in (select id from subtree)"
+
+// teamHeadCount is the per person denominator for a team: the expected head count, but never fewer than the members actually on it
+func teamHeadCount(headCount, members int) int {
+	if headCount > members {
+		return headCount
+	}
+	return members
 }
 
 // getAllTeams for the given uid. If the uid is <0, return all teams
@@ -272,10 +416,10 @@ func (s *Server) getAllTeams(uid int) (*Teams, error) {
 	var err error
 
 	if uid < 0 {
-		q = "select id, name from teams"
+		q = "select id, name, head_count, parent_id, visibility from teams"
 		rows, err = s.DB.Query(q)
 	} else {
-		q = "select id, name from teams where created_by_user_id = ?"
+		q = "select id, name, head_count, parent_id, visibility from teams where created_by_user_id = ?"
 		rows, err = s.DB.Query(q, uid)
 	}
 
@@ -284,13 +428,12 @@ func (s *Server) getAllTeams(uid int) (*Teams, error) {
 	}
 	teams := &Teams{Collection: make([]Team, 0)}
 	for rows.Next() {
-		var id int
-		var name string
-		err := rows.Scan(&id, &name)
+		var t Team
+		err := rows.Scan(&t.ID, &t.Name, &t.HeadCount, &t.ParentID, &t.Visibility)
 		if err != nil {
 			return nil, fmt.Errorf("unable to scan getAllTeams: %w", err)
 		}
-		teams.Collection = append(teams.Collection, Team{ID: id, Name: name})
+		teams.Collection = append(teams.Collection, t)
 	}
 
 	if rows.Err() != nil {
@@ -300,26 +443,78 @@ func (s *Server) getAllTeams(uid int) (*Teams, error) {
 	return teams, nil
 }
 
-// getTeamByName will return nil if no team exists
+// getTeamByName will return nil if no team exists. Names are compared by their teamname.Key, so case, accents typed either way, and extra spaces do not matter
 func (s *Server) getTeamByName(teamName string) (*Team, error) {
-	q := "select id, name from teams where name=?"
-	row := s.DB.QueryRow(q, teamName)
+	rows, err := s.DB.Query("select id, name from teams order by id")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getTeamByName: %w", err)
+	}
+	defer rows.Close()
 
+	key := teamname.Key(teamName)
 	var id int
-	var name string
-	err := row.Scan(&id, &name)
-	if err != nil && err != sql.ErrNoRows {
-		return nil, fmt.Errorf("unable to scan getTeamByName: %w", err)
+	for rows.Next() {
+		var teamID int
+		var name string
+		if err := rows.Scan(&teamID, &name); err != nil {
+			return nil, fmt.Errorf("unable to scan getTeamByName: %w", err)
+		}
+		if id == 0 && teamname.Key(name) == key {
+			id = teamID
+		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getTeamByName: %w", err)
+	}
+	rows.Close()
 
 	if id == 0 {
 		return nil, nil
 	}
+	return s.getTeamByID(id)
+}
+
+// getTeamByID will return nil if no team exists
+func (s *Server) getTeamByID(teamID int) (*Team, error) {
+	q := "select id, name, head_count, parent_id, visibility from teams where id=?"
+	row := s.DB.QueryRow(q, teamID)
+
+	var t Team
+	err := row.Scan(&t.ID, &t.Name, &t.HeadCount, &t.ParentID, &t.Visibility)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("unable to scan getTeamByID: %w", err)
+	}
 
-	return &Team{ID: id, Name: name}, nil
+	if t.ID == 0 {
+		return nil, nil
+	}
+
+	return &t, nil
+}
+
+// putTeamHeadCount sets the team's expected head count. 0 goes back to counting members
+func (s *Server) putTeamHeadCount(teamID, headCount int) error {
+	if _, err := s.DB.Exec("update teams set head_count=? where id=?", headCount, teamID); err != nil {
+		return fmt.Errorf("unable to putTeamHeadCount: %w", err)
+	}
+	return nil
+}
+
+// getTeamOwner returns the id of the user that created the team, or -1 for the seeded teams. It returns false if there is no such team
+func (s *Server) getTeamOwner(teamID int) (int, bool, error) {
+	var owner int
+	err := s.DB.QueryRow("select created_by_user_id from teams where id=?", teamID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to scan getTeamOwner: %w", err)
+	}
+	return owner, true, nil
 }
 
 func (s *Server) postTeam(teamName string, uid int) (*Team, error) {
+	teamName = teamname.Normalize(teamName)
 	existingTeam, err := s.getTeamByName(teamName)
 	if err != nil {
 		return nil, fmt.Errorf("unable to postTeam: %w", err)
@@ -338,20 +533,36 @@ func (s *Server) postTeam(teamName string, uid int) (*Team, error) {
 		return nil, fmt.Errorf("unable to get last insert id for teamName: %w", err)
 	}
 
+	team := &Team{ID: int(id), Name: teamName}
+	s.events.publish(TeamCreated{UserID: uid, Team: *team, At: time.Now()})
+
 	err = s.postMyTeams(int(id), uid)
 	if err != nil {
 		return nil, fmt.Errorf("unable to associate new team to user in postTeam: %w", err)
 	}
 
-	return &Team{ID: int(id), Name: teamName}, nil
+	return team, nil
 }
 
 func (s *Server) deleteTeam(teamID, uid int) error {
+	var parentID int
+	err := s.DB.QueryRow("select parent_id from teams where id=?", teamID).Scan(&parentID)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("unable to scan deleteTeam parent: %w", err)
+	}
+
 	q := "delete from teams where id=? and created_by_user_id=?"
-	_, err := s.DB.Exec(q, teamID, uid)
+	res, err := s.DB.Exec(q, teamID, uid)
 	if err != nil {
 		return fmt.Errorf("unable to deleteTeam: %w", err)
 	}
+
+	// the deleted team's children move up a level so they still roll up into the rest of the tree
+	if n, _ := res.RowsAffected(); n > 0 {
+		if _, err := s.DB.Exec("update teams set parent_id=? where parent_id=?", parentID, teamID); err != nil {
+			return fmt.Errorf("unable to reparent deleteTeam children: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -377,11 +588,15 @@ func (s *Server) getMyTeams(uid int) (*Teams, error) {
 }
 
 func (s *Server) postMyTeams(teamID, uid int) error {
-	// easy way to prevent duplicates; remove the pairing if it already exists
-	err := s.deleteMyTeams(teamID, uid)
+	// prevent duplicates; joining a team you are already on is a no-op
+	var count int
+	err := s.DB.QueryRow("select count(*) from user_teams where team_id=? and user_id=?", teamID, uid).Scan(&count)
 	if err != nil {
 		return fmt.Errorf("unable to postMyTeams: %w", err)
 	}
+	if count > 0 {
+		return nil
+	}
 
 	q := "insert into user_teams (team_id, user_id) values (?, ?)"
 	_, err = s.DB.Exec(q, teamID, uid)
@@ -389,18 +604,228 @@ func (s *Server) postMyTeams(teamID, uid int) error {
 		return fmt.Errorf("unable to postMyTeams: %w", err)
 	}
 
+	s.events.publish(TeamJoined{UserID: uid, TeamID: teamID, At: time.Now()})
 	return nil
 }
 
 func (s *Server) deleteMyTeams(teamID, uid int) error {
 	q := "delete from user_teams where team_id=? and user_id=?"
-	_, err := s.DB.Exec(q, teamID, uid)
+	res, err := s.DB.Exec(q, teamID, uid)
 	if err != nil {
 		return fmt.Errorf("unable to deleteMyTeam: %w", err)
 	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.events.publish(TeamLeft{UserID: uid, TeamID: teamID, At: time.Now()})
+	}
+	return nil
+}
+
+// Preferences are the user's notification settings
+type Preferences struct {
+	// Timezone is an IANA name like America/Denver, used to decide when a user's day starts
+	Timezone string
+	// Digest is "daily", "weekly", or empty to not receive digest emails
+	Digest string
+	// Reminders is true when the user wants "you haven't logged today" style reminders. Defaults to true
+	Reminders bool
+}
+
+func (s *Server) getPreferences(uid int) (*Preferences, error) {
+	q := "select timezone, digest, reminders from users where id=?"
+	row := s.DB.QueryRow(q, uid)
+
+	p := &Preferences{}
+	err := row.Scan(&p.Timezone, &p.Digest, &p.Reminders)
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan getPreferences: %w", err)
+	}
+	return p, nil
+}
+
+func (s *Server) putPreferences(uid int, p *Preferences) error {
+	q := "update users set timezone=?, digest=?, reminders=? where id=?"
+	_, err := s.DB.Exec(q, p.Timezone, p.Digest, p.Reminders, uid)
+	if err != nil {
+		return fmt.Errorf("unable to putPreferences: %w", err)
+	}
 	return nil
 }
 
+// getExerciseTotals sums each exercise for the user between start (inclusive) and end (exclusive). If the uid is <0, sum everyone's reps
+func (s *Server) getExerciseTotals(uid int, start, end int) ([]Exercise, error) {
+	var rows *sql.Rows
+	var err error
+
+	if uid < 0 {
+		q := "select exercise_id, sum(count), sum(points) from reps where created_on>=? and created_on<? group by exercise_id order by exercise_id"
+		rows, err = s.DB.Query(q, start, end)
+	} else {
+		q := "select exercise_id, sum(count), sum(points) from reps where user_id=? and created_on>=? and created_on<? group by exercise_id order by exercise_id"
+		rows, err = s.DB.Query(q, uid, start, end)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getExerciseTotals: %w", err)
+	}
+	defer rows.Close()
+
+	exs := make([]Exercise, 0)
+	for rows.Next() {
+		var exerciseID, count int
+		var points float64
+		if err := rows.Scan(&exerciseID, &count, &points); err != nil {
+			return nil, fmt.Errorf("unable to scan getExerciseTotals: %w", err)
+		}
+		ex, _ := s.getExerciseByID(exerciseID)
+		exs = append(exs, Exercise{ID: exerciseID, Name: ex.Name, ValueType: ex.ValueType, Count: count, Points: roundPoints(points)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getExerciseTotals: %w", err)
+	}
+	return exs, nil
+}
+
+// getTeamExerciseTotals sums each exercise for the team's members, including the teams under it, between start (inclusive) and end (exclusive)
+func (s *Server) getTeamExerciseTotals(teamID int, start, end int) ([]Exercise, error) {
+	q := "select exercise_id, sum(count), sum(points) from reps where user_id in (" + teamMembersSQL + ") and created_on>=? and created_on<? group by exercise_id order by exercise_id"
+	rows, err := s.DB.Query(q, teamID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getTeamExerciseTotals: %w", err)
+	}
+	defer rows.Close()
+
+	exs := make([]Exercise, 0)
+	for rows.Next() {
+		var exerciseID, count int
+		var points float64
+		if err := rows.Scan(&exerciseID, &count, &points); err != nil {
+			return nil, fmt.Errorf("unable to scan getTeamExerciseTotals: %w", err)
+		}
+		ex, _ := s.getExerciseByID(exerciseID)
+		exs = append(exs, Exercise{ID: exerciseID, Name: ex.Name, ValueType: ex.ValueType, Count: count, Points: roundPoints(points)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getTeamExerciseTotals: %w", err)
+	}
+	return exs, nil
+}
+
+// TeamRank is a team's place amongst all teams with members, ranked by points per person.
+// HeadCount is the expected head count when the owner set one, otherwise Members
+type TeamRank struct {
+	TeamID          int
+	Name            string
+	Rank            int
+	Members         int
+	HeadCount       int
+	TotalReps       int
+	RepsPerPerson   int
+	TotalPoints     int
+	PointsPerPerson int
+}
+
+// getTeamRankings ranks every team with members by points per person between start (inclusive) and end (exclusive).
+// A team's members include everyone on the teams under it, counted once even if they are on several of them. The rankings are
+// shared by everyone, so invite-only teams are left off, though their members still count toward the teams above them
+func (s *Server) getTeamRankings(start, end int) ([]TeamRank, error) {
+	teams, err := s.getAllTeams(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	// distinct membership so a duplicated user_teams row does not count reps twice
+	rows, err := s.DB.Query("select distinct team_id, user_id from user_teams")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getTeamRankings members: %w", err)
+	}
+	defer rows.Close()
+
+	members := make(map[int][]int)
+	for rows.Next() {
+		var teamID, uid int
+		if err := rows.Scan(&teamID, &uid); err != nil {
+			return nil, fmt.Errorf("unable to scan getTeamRankings members: %w", err)
+		}
+		members[teamID] = append(members[teamID], uid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getTeamRankings members: %w", err)
+	}
+
+	rows, err = s.DB.Query("select user_id, sum(count), sum(points) from reps where created_on>=? and created_on<? group by user_id", start, end)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getTeamRankings totals: %w", err)
+	}
+	defer rows.Close()
+
+	totals := make(map[int]int)
+	points := make(map[int]float64)
+	for rows.Next() {
+		var uid, total int
+		var userPoints float64
+		if err := rows.Scan(&uid, &total, &userPoints); err != nil {
+			return nil, fmt.Errorf("unable to scan getTeamRankings totals: %w", err)
+		}
+		totals[uid] = total
+		points[uid] = userPoints
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getTeamRankings totals: %w", err)
+	}
+
+	children := teamChildren(teams.Collection)
+	ranks := make([]TeamRank, 0)
+	for _, t := range teams.Collection {
+		if t.Visibility == teamInviteOnly {
+			continue
+		}
+		users := make(map[int]bool)
+		for _, teamID := range teamSubtree(t.ID, children) {
+			for _, uid := range members[teamID] {
+				users[uid] = true
+			}
+		}
+		if len(users) == 0 {
+			continue
+		}
+
+		tr := TeamRank{TeamID: t.ID, Name: t.Name, Members: len(users), HeadCount: teamHeadCount(t.HeadCount, len(users))}
+		var teamPoints float64
+		for uid := range users {
+			tr.TotalReps += totals[uid]
+			teamPoints += points[uid]
+		}
+		tr.RepsPerPerson = tr.TotalReps / tr.HeadCount
+		tr.TotalPoints = roundPoints(teamPoints)
+		tr.PointsPerPerson = tr.TotalPoints / tr.HeadCount
+		ranks = append(ranks, tr)
+	}
+
+	sort.Slice(ranks, func(i, j int) bool {
+		if ranks[i].PointsPerPerson != ranks[j].PointsPerPerson {
+			return ranks[i].PointsPerPerson > ranks[j].PointsPerPerson
+		}
+		if ranks[i].TotalPoints != ranks[j].TotalPoints {
+			return ranks[i].TotalPoints > ranks[j].TotalPoints
+		}
+		return ranks[i].Name < ranks[j].Name
+	})
+	for i := range ranks {
+		ranks[i].Rank = i + 1
+	}
+
+	return ranks, nil
+}
+
+func (s *Server) getUserEmail(uid int) (string, error) {
+	var email string
+	err := s.DB.QueryRow("select email from users where id=?", uid).Scan(&email)
+	if err != nil {
+		return "", fmt.Errorf("unable to scan getUserEmail: %w", err)
+	}
+	return email, nil
+}
+
 func (s *Server) getOrCreateUser(email string) (int, error) {
 	q := "select id from users where email = ?;"
 	row := s.DB.QueryRow(q, email)
@@ -454,6 +879,155 @@ func (s *Server) InitDB() error {
 
 	s.DB = db
 
+	if err := s.migrateDB(); err != nil {
+		return fmt.Errorf("unable to migrate db - %w", err)
+	}
+
+	return nil
+}
+
+// migrations are applied in order, once, to new and existing databases alike. seedDB creates the original tables.
+// Only ever append to this list; the index+1 of each entry is its schema version.
+var migrations = [][]string{
+	// 1: user preferences for digest emails
+	{
+		"alter table users add column timezone text not null default 'UTC';",
+		"alter table users add column digest text not null default '';",
+		"alter table users add column last_digest_on int not null default 0;",
+	},
+	// 2: reminder opt out and a log of sent reminders for de-duplication and weekly caps
+	{
+		"alter table users add column reminders integer not null default 1;",
+		"create table reminders (id integer not null primary key autoincrement, user_id integer, rule text, sent_on int);",
+		"create index reminders_user_id on reminders (user_id, sent_on);",
+	},
+	// 3: outgoing webhooks and their delivery queue
+	{
+		"create table webhooks (id integer not null primary key autoincrement, user_id integer, url text, secret text, events text, all_users integer not null default 0, created_on int);",
+		"create table webhook_deliveries (id integer not null primary key autoincrement, webhook_id integer, event text, payload text, status text, attempts integer not null default 0, next_attempt_on int, last_status_code integer not null default 0, last_error text not null default '', created_on int, delivered_on int not null default 0);",
+		"create index webhook_deliveries_pending on webhook_deliveries (status, next_attempt_on);",
+		"create index webhook_deliveries_webhook_id on webhook_deliveries (webhook_id, id);",
+	},
+	// 4: rest days that keep a streak going
+	{
+		"create table streak_freezes (id integer not null primary key autoincrement, user_id integer, day text, created_on int);",
+		"create unique index streak_freezes_user_day on streak_freezes (user_id, day);",
+	},
+	// 5: awarded badges
+	{
+		"create table achievements (id integer not null primary key autoincrement, user_id integer, achievement text, awarded_on int, created_on int);",
+		"create unique index achievements_user_achievement on achievements (user_id, achievement);",
+	},
+	// 6: personal goals
+	{
+		"create table goals (id integer not null primary key autoincrement, user_id integer, exercise_id integer, target integer, period text, start_day text, end_day text not null default '', created_on int);",
+		"create index goals_user_id on goals (user_id);",
+	},
+	// 7: team goals and team versus team challenges
+	{
+		"alter table goals add column team_id integer not null default 0;",
+		"create index goals_team_id on goals (team_id);",
+		"create table challenges (id integer not null primary key autoincrement, name text, exercise_id integer not null default 0, start_day text, end_day text, created_by_user_id integer, created_on int);",
+		"create table challenge_teams (id integer not null primary key autoincrement, challenge_id integer, team_id integer, joined_on int);",
+		"create unique index challenge_teams_challenge_team on challenge_teams (challenge_id, team_id);",
+	},
+	// 8: expected team head count
+	{
+		"alter table teams add column head_count integer not null default 0;",
+	},
+	// 9: team hierarchy
+	{
+		"alter table teams add column parent_id integer not null default 0;",
+		"create index teams_parent_id on teams (parent_id);",
+	},
+	// 10: team visibility, invites, and join requests
+	{
+		"alter table teams add column visibility text not null default 'public';",
+		"create table team_invites (id integer not null primary key autoincrement, team_id integer, code text, created_by_user_id integer, expires_on int, created_on int);",
+		"create unique index team_invites_code on team_invites (code);",
+		"create table team_join_requests (id integer not null primary key autoincrement, team_id integer, user_id integer, status text, created_on int, decided_on int not null default 0);",
+		"create unique index team_join_requests_team_user on team_join_requests (team_id, user_id);",
+	},
+	// 11: where merged teams went
+	{
+		"create table team_redirects (from_team_id integer not null primary key, to_team_id integer, created_on int);",
+	},
+	// 12: point weights, and each rep's points at the weights when it was last scored. Existing reps score a point each
+	{
+		"alter table exercises add column weight real not null default 1;",
+		"alter table exercises add column per integer not null default 1;",
+		"alter table reps add column points real not null default 0;",
+		"update reps set points=count;",
+	},
+	// 13: csv imports, so a batch of reps can be rolled back together
+	{
+		"create table imports (id integer not null primary key autoincrement, user_id integer, rows integer, created_on int, rolled_back_on int not null default 0);",
+		"alter table reps add column import_id integer not null default 0;",
+		"create index reps_import_id on reps (import_id);",
+	},
+	// 14: where an import came from: a csv, or the copy of v1
+	{
+		"alter table imports add column source text not null default 'csv';",
+	},
+	// 15: the audit log. It is append only: the triggers refuse updates and deletes
+	{
+		"create table audit (id integer not null primary key autoincrement, actor_id integer not null, source text not null, action text not null, subject_type text not null, subject_id integer not null, before_value text not null default '', after_value text not null default '', created_on int not null);",
+		"create index audit_actor_id on audit (actor_id);",
+		"create index audit_subject on audit (subject_type, subject_id);",
+		"create trigger audit_no_update before update on audit begin select raise(abort, 'the audit log is append only'); end;",
+		"create trigger audit_no_delete before delete on audit begin select raise(abort, 'the audit log is append only'); end;",
+	},
+	// 16: deleting an account redacts the before and after of the user's audit entries. That is the only change the log allows
+	{
+		"drop trigger audit_no_update;",
+		`create trigger audit_no_update before update on audit when new.id is not old.id or new.actor_id is not old.actor_id or new.source is not old.source or new.action is not old.action or new.subject_type is not old.subject_type or new.subject_id is not old.subject_id or new.created_on is not old.created_on or new.before_value not in (old.before_value, '"redacted"') or new.after_value not in (old.after_value, '"redacted"') begin select raise(abort, 'the audit log is append only'); end;`,
+	},
+	// 17: default weights for units much smaller or bigger than a rep, so a meter of running is not worth a push up. Exercises an
+	// admin already weighted are left alone; the rest, and every rep logged for them, are rescored
+	{
+		"update reps set points=count/10.0 where exercise_id in (select id from exercises where value_type='Meters' and weight=1 and per=1);",
+		"update exercises set per=10 where value_type='Meters' and weight=1 and per=1;",
+		"update reps set points=count*100.0 where exercise_id in (select id from exercises where value_type='Kilometers' and weight=1 and per=1);",
+		"update exercises set weight=100 where value_type='Kilometers' and weight=1 and per=1;",
+		"update reps set points=count/5.0 where exercise_id in (select id from exercises where value_type='Seconds' and weight=1 and per=1);",
+		"update exercises set per=5 where value_type='Seconds' and weight=1 and per=1;",
+		"update reps set points=count*12.0 where exercise_id in (select id from exercises where value_type='Minutes' and weight=1 and per=1);",
+		"update exercises set weight=12 where value_type='Minutes' and weight=1 and per=1;",
+	},
+}
+
+func (s *Server) migrateDB() error {
+	_, err := s.DB.Exec("create table if not exists schema_version (version integer not null);")
+	if err != nil {
+		return fmt.Errorf("unable to create schema_version: %w", err)
+	}
+
+	var version sql.NullInt64
+	if err := s.DB.QueryRow("select max(version) from schema_version").Scan(&version); err != nil {
+		return fmt.Errorf("unable to scan schema_version: %w", err)
+	}
+
+	for i := int(version.Int64); i < len(migrations); i++ {
+		tx, err := s.DB.Begin()
+		if err != nil {
+			return fmt.Errorf("unable to begin migration %d: %w", i+1, err)
+		}
+		for _, stmt := range migrations[i] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("unable to apply migration %d '%s': %w", i+1, stmt, err)
+			}
+		}
+		if _, err := tx.Exec("insert into schema_version (version) values (?)", i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to record migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("unable to commit migration %d: %w", i+1, err)
+		}
+		log.Printf("applied db migration %d", i+1)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,248 @@
+package countmyreps
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+// DigestData is the data needed to populate the digest email templates
+type DigestData struct {
+	SiteURL string
+	Email   string
+	// Period is "daily" or "weekly"
+	Period string
+
+	PeriodTotals    []Exercise
+	ChallengeTotals []Exercise
+
+	// Teams are the user's teams. TeamCount is how many teams are ranked in total
+	Teams     []TeamRank
+	TeamCount int
+	// MovedUp are the teams that climbed the rankings during the period, biggest climb first
+	MovedUp []RankChange
+}
+
+// RankChange is a team's movement in the rankings over a digest period
+type RankChange struct {
+	TeamID int
+	Name   string
+	From   int
+	To     int
+}
+
+type digestUser struct {
+	id           int
+	email        string
+	timezone     string
+	digest       string
+	lastDigestOn int64
+}
+
+// sendDigests emails every opted in user whose digest is due. Users without any reps in the current challenge are skipped.
+// Digests go out for a week after the challenge ends so the final weekly recap is not lost.
+func (s *Server) sendDigests(now time.Time) error {
+	challengeStart, challengeEnd := s.conf.Challenge(now)
+	if now.Before(challengeStart) || now.After(challengeEnd.AddDate(0, 0, 7)) {
+		return nil
+	}
+	challengeNow := now
+	if challengeNow.After(challengeEnd) {
+		challengeNow = challengeEnd
+	}
+
+	users, err := s.getDigestUsers()
+	if err != nil {
+		return err
+	}
+
+	// rankings are the same for every user with the same period, so only compute them once per run
+	rankings := make(map[string][]TeamRank)
+	movers := make(map[string][]RankChange)
+
+	var failed int
+	for _, u := range users {
+		periodStart, due := digestDue(u, now, s.conf.DigestHour, s.conf.DigestDay)
+		if !due {
+			continue
+		}
+		if periodStart.Before(challengeStart) {
+			periodStart = challengeStart
+		}
+
+		active, err := s.hasReps(u.id, int(challengeStart.Unix()), int(challengeNow.Unix()))
+		if err != nil {
+			return err
+		}
+		if !active {
+			continue
+		}
+
+		if _, ok := rankings[u.digest]; !ok {
+			current, err := s.getTeamRankings(int(challengeStart.Unix()), int(challengeNow.Unix()))
+			if err != nil {
+				return err
+			}
+			previous, err := s.getTeamRankings(int(challengeStart.Unix()), int(periodStart.Unix()))
+			if err != nil {
+				return err
+			}
+			rankings[u.digest] = current
+			if periodStart.After(challengeStart) {
+				movers[u.digest] = rankChanges(previous, current, 5)
+			}
+		}
+
+		if err := s.sendDigest(u, periodStart, challengeStart, challengeNow, rankings[u.digest], movers[u.digest]); err != nil {
+			// keep going; one bad address should not hold up everyone else's digest
+			log.Printf("unable to send %s digest to %s: %s", u.digest, u.email, err.Error())
+			failed++
+		}
+
+		// a failed send still counts as this period's digest, or a bad address would be retried every scheduler run
+		if _, err := s.DB.Exec("update users set last_digest_on=? where id=?", now.Unix(), u.id); err != nil {
+			return fmt.Errorf("unable to update last_digest_on: %w", err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d digests failed to send", failed)
+	}
+	return nil
+}
+
+func (s *Server) sendDigest(u digestUser, periodStart, challengeStart, challengeNow time.Time, rankings []TeamRank, movedUp []RankChange) error {
+	periodTotals, err := s.getExerciseTotals(u.id, int(periodStart.Unix()), int(challengeNow.Unix()))
+	if err != nil {
+		return err
+	}
+	challengeTotals, err := s.getExerciseTotals(u.id, int(challengeStart.Unix()), int(challengeNow.Unix()))
+	if err != nil {
+		return err
+	}
+	myTeams, err := s.getMyTeams(u.id)
+	if err != nil {
+		return err
+	}
+
+	data := DigestData{
+		SiteURL:         s.conf.FullAddr,
+		Email:           u.email,
+		Period:          u.digest,
+		PeriodTotals:    periodTotals,
+		ChallengeTotals: challengeTotals,
+		TeamCount:       len(rankings),
+		MovedUp:         movedUp,
+	}
+	for _, team := range myTeams.Collection {
+		for _, rank := range rankings {
+			if rank.TeamID == team.ID {
+				data.Teams = append(data.Teams, rank)
+			}
+		}
+	}
+
+	msg, err := s.renderEmail("digest", u.email, fmt.Sprintf("Your %s CountMyReps digest", u.digest), data)
+	if err != nil {
+		return err
+	}
+	return s.emailer.SendEmail(msg)
+}
+
+func (s *Server) getDigestUsers() ([]digestUser, error) {
+	q := "select id, email, timezone, digest, last_digest_on from users where digest in (?, ?)"
+	rows, err := s.DB.Query(q, digestDaily, digestWeekly)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getDigestUsers: %w", err)
+	}
+	defer rows.Close()
+
+	var users []digestUser
+	for rows.Next() {
+		var u digestUser
+		if err := rows.Scan(&u.id, &u.email, &u.timezone, &u.digest, &u.lastDigestOn); err != nil {
+			return nil, fmt.Errorf("unable to scan getDigestUsers: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getDigestUsers: %w", err)
+	}
+	return users, nil
+}
+
+// hasReps reports if the user logged anything between start (inclusive) and end (exclusive)
+func (s *Server) hasReps(uid int, start, end int) (bool, error) {
+	var count int
+	q := "select count(*) from reps where user_id=? and created_on>=? and created_on<?"
+	if err := s.DB.QueryRow(q, uid, start, end).Scan(&count); err != nil {
+		return false, fmt.Errorf("unable to scan hasReps: %w", err)
+	}
+	return count > 0, nil
+}
+
+// digestDue reports if the user's digest should go out at now, and the start of the period it covers.
+// Digests go out at or after hour in the user's timezone; weekly digests only on weekday.
+func digestDue(u digestUser, now time.Time, hour int, weekday time.Weekday) (time.Time, bool) {
+	loc, err := time.LoadLocation(u.timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	last := time.Unix(u.lastDigestOn, 0).In(loc)
+
+	if local.Hour() < hour {
+		return time.Time{}, false
+	}
+
+	switch u.digest {
+	case digestDaily:
+		if sameDay(local, last) {
+			return time.Time{}, false
+		}
+		return now.AddDate(0, 0, -1), true
+	case digestWeekly:
+		if local.Weekday() != weekday || sameDay(local, last) {
+			return time.Time{}, false
+		}
+		return now.AddDate(0, 0, -7), true
+	}
+	return time.Time{}, false
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// rankChanges returns up to limit teams that improved their rank from previous to current, biggest climb first
+func rankChanges(previous, current []TeamRank, limit int) []RankChange {
+	before := make(map[int]int)
+	for _, r := range previous {
+		before[r.TeamID] = r.Rank
+	}
+
+	var changes []RankChange
+	for _, r := range current {
+		from, ok := before[r.TeamID]
+		if !ok || from <= r.Rank {
+			continue
+		}
+		changes = append(changes, RankChange{TeamID: r.TeamID, Name: r.Name, From: from, To: r.Rank})
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].From-changes[i].To > changes[j].From-changes[j].To
+	})
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes
+}
@@ -0,0 +1,109 @@
+package countmyreps
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestDue(t *testing.T) {
+	// 2020-11-09 is a Monday
+	now := time.Date(2020, 11, 9, 15, 30, 0, 0, time.UTC)
+	yesterday := now.AddDate(0, 0, -1).Unix()
+
+	tests := []struct {
+		name string
+		user digestUser
+		due  bool
+	}{
+		{"daily, never sent", digestUser{digest: digestDaily, timezone: "UTC"}, true},
+		{"daily, sent yesterday", digestUser{digest: digestDaily, timezone: "UTC", lastDigestOn: yesterday}, true},
+		{"daily, sent today", digestUser{digest: digestDaily, timezone: "UTC", lastDigestOn: now.Add(-time.Hour).Unix()}, false},
+		{"daily, too early locally", digestUser{digest: digestDaily, timezone: "America/Los_Angeles"}, false},
+		{"daily, bad timezone falls back to utc", digestUser{digest: digestDaily, timezone: "Nowhere/Special"}, true},
+		{"weekly on monday", digestUser{digest: digestWeekly, timezone: "UTC", lastDigestOn: now.AddDate(0, 0, -7).Unix()}, true},
+		{"weekly, already sent", digestUser{digest: digestWeekly, timezone: "UTC", lastDigestOn: now.Add(-time.Hour).Unix()}, false},
+		{"weekly, still sunday locally", digestUser{digest: digestWeekly, timezone: "Pacific/Honolulu"}, false},
+		{"opted out", digestUser{digest: "", timezone: "UTC"}, false},
+	}
+
+	for _, test := range tests {
+		_, due := digestDue(test.user, now, 8, time.Monday)
+		if got, want := due, test.due; got != want {
+			t.Errorf("%s: got due %t, want %t", test.name, got, want)
+		}
+	}
+}
+
+func TestSendDigests(t *testing.T) {
+	s, emailer := newTestServer(t)
+	now := time.Date(2020, 11, 10, 9, 0, 0, 0, time.UTC)
+
+	active := mustCreateUser(t, s, "active@twilio.com")
+	idle := mustCreateUser(t, s, "idle@twilio.com")
+	optedOut := mustCreateUser(t, s, "optedout@twilio.com")
+	for _, uid := range []int{active, idle} {
+		if err := s.putPreferences(uid, &Preferences{Timezone: "UTC", Digest: digestDaily}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	denver, err := s.getTeamByName("Denver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postMyTeams(denver.ID, active); err != nil {
+		t.Fatal(err)
+	}
+
+	mustInsertReps(t, s, active, "Push Ups", 20, now.Add(-2*time.Hour))
+	mustInsertReps(t, s, active, "Push Ups", 30, now.AddDate(0, 0, -3))
+	mustInsertReps(t, s, optedOut, "Squats", 30, now.Add(-time.Hour))
+	// activity before the challenge does not count
+	mustInsertReps(t, s, idle, "Squats", 30, time.Date(2020, 10, 20, 0, 0, 0, 0, time.UTC))
+
+	if err := s.sendDigests(now); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(emailer.Sent), 1; got != want {
+		t.Fatalf("got %d digests, want %d", got, want)
+	}
+	msg := emailer.Sent[0]
+	t.Logf("Digest:\n%s", msg.Text)
+
+	if got, want := msg.To, "active@twilio.com"; got != want {
+		t.Errorf("got digest to %s, want %s", got, want)
+	}
+	for _, want := range []string{
+		"Since your last digest you logged:\n  - 20 Push Ups",
+		"So far this challenge:\n  - 50 Push Ups",
+		"Denver: 1 of 1 with 50 points per person",
+	} {
+		if !strings.Contains(msg.Text, want) {
+			t.Errorf("did not find %q in digest", want)
+		}
+	}
+
+	// a second run the same day must not send again
+	if err := s.sendDigests(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(emailer.Sent), 1; got != want {
+		t.Errorf("got %d digests after rerun, want %d", got, want)
+	}
+
+	// a failed send is not retried until the next day's digest
+	emailer.Err = errors.New("mailbox unavailable")
+	tomorrow := now.AddDate(0, 0, 1)
+	if err := s.sendDigests(tomorrow); err == nil {
+		t.Errorf("got no error when the digest failed to send")
+	}
+	if err := s.sendDigests(tomorrow.Add(time.Hour)); err != nil {
+		t.Errorf("got %v rerunning after a failed send, want no retry", err)
+	}
+	if got, want := len(emailer.Sent), 2; got != want {
+		t.Errorf("got %d digests after a failed send and a rerun, want %d", got, want)
+	}
+}
@@ -0,0 +1,305 @@
+package countmyreps
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go"
+	sgmail "github.com/sendgrid/sendgrid-go/helpers/mail"
+	"github.com/sethgrid/countmyreps/v2/config"
+)
+
+// Message is a single outbound email. HTML and Text are both optional, but at least one should be set.
+// When both are set, the message is sent as multipart/alternative.
+type Message struct {
+	To      string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Emailer allows us to swap out how we send email (SendGrid, SMTP, files on disk, or a fake for tests)
+type Emailer interface {
+	SendEmail(m Message) error
+}
+
+// NewEmailer returns the Emailer selected by the config's EmailBackend
+func NewEmailer(c *config.Config) (Emailer, error) {
+	from := mail.Address{Name: c.EmailName, Address: c.EmailFrom}
+
+	switch c.EmailBackend {
+	case "sendgrid":
+		return &SendGridEmailer{From: from, APIKey: c.SendGridAPIKey}, nil
+	case "smtp":
+		return &SMTPEmailer{From: from, Host: c.SMTPHost, Port: c.SMTPPort, User: c.SMTPUser, Pass: c.SMTPPass}, nil
+	case "outbox":
+		if err := os.MkdirAll(c.OutboxPath, 0755); err != nil {
+			return nil, fmt.Errorf("unable to create outbox dir %q - %w", c.OutboxPath, err)
+		}
+		return &OutboxEmailer{From: from, Dir: c.OutboxPath}, nil
+	case "", "none":
+		return &LogEmailer{}, nil
+	}
+	return nil, fmt.Errorf("unknown email backend %q", c.EmailBackend)
+}
+
+// LogEmailer only logs that a message would have been sent. It is the default when no backend is configured
+type LogEmailer struct{}
+
+// SendEmail logs the recipient and subject
+func (LogEmailer) SendEmail(m Message) error {
+	log.Printf("email backend disabled; not sending %q to %s", m.Subject, m.To)
+	return nil
+}
+
+// FakeEmailer is useful for testing. It records every message it is asked to send
+type FakeEmailer struct {
+	Err error
+
+	mu   sync.Mutex
+	Sent []Message
+}
+
+// SendEmail records the message and returns what ever error we need
+func (f *FakeEmailer) SendEmail(m Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Sent = append(f.Sent, m)
+	return f.Err
+}
+
+// SendGridEmailer sends email through the SendGrid v3 API
+type SendGridEmailer struct {
+	From   mail.Address
+	APIKey string
+}
+
+// SendEmail sends an email through SendGrid
+func (e *SendGridEmailer) SendEmail(m Message) error {
+	from := sgmail.NewEmail(e.From.Name, e.From.Address)
+	to := sgmail.NewEmail(recipientName(m.To), m.To)
+
+	msg := sgmail.NewV3Mail()
+	msg.SetFrom(from)
+	msg.Subject = m.Subject
+	p := sgmail.NewPersonalization()
+	p.AddTos(to)
+	msg.AddPersonalizations(p)
+	// SendGrid requires text/plain to come before text/html
+	if m.Text != "" {
+		msg.AddContent(sgmail.NewContent("text/plain", m.Text))
+	}
+	if m.HTML != "" {
+		msg.AddContent(sgmail.NewContent("text/html", m.HTML))
+	}
+
+	request := sendgrid.GetRequest(e.APIKey, "/v3/mail/send", "https://api.sendgrid.com")
+	request.Method = "POST"
+	request.Body = sgmail.GetRequestBody(msg)
+	response, err := sendgrid.API(request)
+	if err != nil {
+		return fmt.Errorf("unable to send through sendgrid: %w", err)
+	}
+	if !(response.StatusCode == http.StatusOK || response.StatusCode == http.StatusAccepted) {
+		return fmt.Errorf("unexpected status code from SendGrid: %d - %q", response.StatusCode, response.Body)
+	}
+	return nil
+}
+
+// SMTPEmailer sends email through a plain SMTP relay. Auth is only used when User is set
+type SMTPEmailer struct {
+	From mail.Address
+	Host string
+	Port int
+	User string
+	Pass string
+}
+
+// SendEmail sends an email through the configured SMTP server
+func (e *SMTPEmailer) SendEmail(m Message) error {
+	body, err := buildMIME(e.From, m, time.Now())
+	if err != nil {
+		return fmt.Errorf("unable to build smtp message: %w", err)
+	}
+
+	var auth smtp.Auth
+	if e.User != "" {
+		auth = smtp.PlainAuth("", e.User, e.Pass, e.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", e.Host, e.Port)
+	if err := smtp.SendMail(addr, auth, e.From.Address, []string{m.To}, body); err != nil {
+		return fmt.Errorf("unable to send through smtp %s: %w", addr, err)
+	}
+	return nil
+}
+
+// OutboxEmailer writes each message as an .eml file in Dir instead of sending it. Open them with any mail client
+type OutboxEmailer struct {
+	From mail.Address
+	Dir  string
+}
+
+// SendEmail writes the message to the outbox directory
+func (e *OutboxEmailer) SendEmail(m Message) error {
+	now := time.Now()
+	body, err := buildMIME(e.From, m, now)
+	if err != nil {
+		return fmt.Errorf("unable to build outbox message: %w", err)
+	}
+
+	name := fmt.Sprintf("%d_%s.eml", now.UnixNano(), sanitizeFileName(m.To))
+	if err := ioutil.WriteFile(filepath.Join(e.Dir, name), body, 0644); err != nil {
+		return fmt.Errorf("unable to write to outbox: %w", err)
+	}
+	return nil
+}
+
+// emailTemplate is the html and plain text version of one notification email
+type emailTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// loadEmailTemplates parses every {name}.html and {name}.txt pair in {dir}/email, keyed by name.
+// Like the v1 page templates, these are parsed once; restart the process to load file changes.
+func loadEmailTemplates(dir string) (map[string]emailTemplate, error) {
+	funcs := map[string]interface{}{
+		"join": strings.Join,
+	}
+
+	htmlFiles, err := filepath.Glob(filepath.Join(dir, "email", "*.html"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list email templates: %w", err)
+	}
+
+	tmpls := make(map[string]emailTemplate)
+	for _, htmlFile := range htmlFiles {
+		name := strings.TrimSuffix(filepath.Base(htmlFile), ".html")
+		textFile := strings.TrimSuffix(htmlFile, ".html") + ".txt"
+
+		h, err := htmltemplate.New(filepath.Base(htmlFile)).Funcs(funcs).ParseFiles(htmlFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse email template %q: %w", htmlFile, err)
+		}
+		t, err := texttemplate.New(filepath.Base(textFile)).Funcs(funcs).ParseFiles(textFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse email template %q: %w", textFile, err)
+		}
+		tmpls[name] = emailTemplate{html: h, text: t}
+	}
+
+	return tmpls, nil
+}
+
+// renderEmail executes both versions of the named email template with the same data
+func (s *Server) renderEmail(name string, to string, subject string, data interface{}) (Message, error) {
+	tmpl, ok := s.emailTemplates[name]
+	if !ok {
+		return Message{}, fmt.Errorf("no email template named %q", name)
+	}
+
+	var htmlBuf, textBuf bytes.Buffer
+	if err := tmpl.html.Execute(&htmlBuf, data); err != nil {
+		return Message{}, fmt.Errorf("unable to execute %s html template: %w", name, err)
+	}
+	if err := tmpl.text.Execute(&textBuf, data); err != nil {
+		return Message{}, fmt.Errorf("unable to execute %s text template: %w", name, err)
+	}
+
+	return Message{To: to, Subject: subject, HTML: htmlBuf.String(), Text: textBuf.String()}, nil
+}
+
+// buildMIME renders the message as RFC 5322 bytes. Messages with both HTML and Text become multipart/alternative
+func buildMIME(from mail.Address, m Message, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+
+	to := mail.Address{Name: recipientName(m.To), Address: m.To}
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+
+	if m.HTML == "" || m.Text == "" {
+		contentType, content := "text/plain", m.Text
+		if m.HTML != "" {
+			contentType, content = "text/html", m.HTML
+		}
+		fmt.Fprintf(&buf, "Content-Type: %s; charset=utf-8\r\n", contentType)
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&buf, content); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	// order matters: clients display the last part they understand, so html goes last
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain", m.Text},
+		{"text/html", m.HTML},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to create %s part: %w", part.contentType, err)
+		}
+		if err := writeQuotedPrintable(w, part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("unable to close multipart writer: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, content string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return fmt.Errorf("unable to encode body: %w", err)
+	}
+	return qp.Close()
+}
+
+// recipientName guesses a display name from the address. firstname.lastname@twilio.com gives firstname
+func recipientName(addr string) string {
+	name := strings.Split(addr, ".")[0]
+	if strings.Contains(name, "@") {
+		name = strings.Split(name, "@")[0]
+	}
+	return name
+}
+
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_', r == '@':
+			return r
+		}
+		return '_'
+	}, s)
+}
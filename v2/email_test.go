@@ -0,0 +1,107 @@
+package countmyreps
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sethgrid/countmyreps/v2/config"
+)
+
+func TestBuildMIME(t *testing.T) {
+	from := mail.Address{Name: "CountMyReps", Address: "automailer@countmyreps.com"}
+	date := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		msg       Message
+		wanted    []string
+		notWanted []string
+		multipart bool
+	}{
+		{
+			name:      "multipart",
+			msg:       Message{To: "seth.ammons@twilio.com", Subject: "Success!", HTML: "<h3>Keep it up!</h3>", Text: "Keep it up!"},
+			wanted:    []string{"To: \"seth\" <seth.ammons@twilio.com>", "Subject: Success!", "text/plain; charset=utf-8", "text/html; charset=utf-8", "Keep it up!"},
+			multipart: true,
+		},
+		{
+			name:      "html only",
+			msg:       Message{To: "someone@twilio.com", Subject: "Hi", HTML: "<p>hi</p>"},
+			wanted:    []string{"Content-Type: text/html; charset=utf-8", "<p>hi</p>"},
+			notWanted: []string{"multipart/alternative", "text/plain"},
+		},
+		{
+			name:      "text only",
+			msg:       Message{To: "someone@twilio.com", Subject: "Hi", Text: "hi"},
+			wanted:    []string{"Content-Type: text/plain; charset=utf-8"},
+			notWanted: []string{"multipart/alternative", "text/html"},
+		},
+	}
+
+	for _, test := range tests {
+		body, err := buildMIME(from, test.msg, date)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+
+		parsed, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: unable to parse generated message: %v\n%s", test.name, err, body)
+		}
+		if got, want := strings.HasPrefix(parsed.Header.Get("Content-Type"), "multipart/alternative"), test.multipart; got != want {
+			t.Errorf("%s: got multipart %t, want %t", test.name, got, want)
+		}
+
+		for _, want := range test.wanted {
+			if !bytes.Contains(body, []byte(want)) {
+				t.Errorf("%s: did not find %q in\n%s", test.name, want, body)
+			}
+		}
+		for _, notWant := range test.notWanted {
+			if bytes.Contains(body, []byte(notWant)) {
+				t.Errorf("%s: found (and don't want) %q in\n%s", test.name, notWant, body)
+			}
+		}
+	}
+}
+
+func TestOutboxEmailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmr_outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{EmailBackend: "outbox", OutboxPath: filepath.Join(dir, "outbox"), EmailFrom: "automailer@countmyreps.com"}
+	emailer, err := NewEmailer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := emailer.SendEmail(Message{To: "seth.ammons@twilio.com", Subject: "Success!", HTML: "<b>15</b>", Text: "15"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(c.OutboxPath, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(files), 1; got != want {
+		t.Fatalf("got %d eml files, want %d", got, want)
+	}
+	if !strings.Contains(files[0], "seth.ammons@twilio.com") {
+		t.Errorf("got file name %q, want it to contain the recipient", files[0])
+	}
+}
+
+func TestNewEmailerUnknownBackend(t *testing.T) {
+	if _, err := NewEmailer(&config.Config{EmailBackend: "pigeon"}); err == nil {
+		t.Error("got no error, want error for unknown email backend")
+	}
+}
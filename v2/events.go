@@ -0,0 +1,164 @@
+package countmyreps
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// eventQueueSize is how many events a subscriber can fall behind before new events are dropped for it
+const eventQueueSize = 1024
+
+// Event is something that happened, published after it is committed to the db. Subscribers type switch on the events they care about
+type Event interface {
+	eventName() string
+}
+
+// RepsLogged is published when a user submits reps
+type RepsLogged struct {
+	UserID int
+	Reps   []Rep
+	At     time.Time
+}
+
+// RepEdited is published when a user corrects the count of a rep
+type RepEdited struct {
+	UserID   int
+	Rep      Rep
+	Previous Rep
+	At       time.Time
+}
+
+// RepDeleted is published when a user removes a rep
+type RepDeleted struct {
+	UserID   int
+	Previous Rep
+	At       time.Time
+}
+
+// RepsDeleted is published when an import is rolled back, once per user with every rep of theirs it removed, so a big
+// rollback is not thousands of RepDeleted events
+type RepsDeleted struct {
+	UserID   int
+	Previous []Rep
+	At       time.Time
+}
+
+// TeamCreated is published when a new team is created. The creator joining it is published separately as TeamJoined
+type TeamCreated struct {
+	UserID int
+	Team   Team
+	At     time.Time
+}
+
+// TeamJoined is published when a user joins a team they were not already on
+type TeamJoined struct {
+	UserID int
+	TeamID int
+	At     time.Time
+}
+
+// TeamLeft is published when a user leaves a team they were on
+type TeamLeft struct {
+	UserID int
+	TeamID int
+	At     time.Time
+}
+
+func (RepsLogged) eventName() string  { return "RepsLogged" }
+func (RepEdited) eventName() string   { return "RepEdited" }
+func (RepDeleted) eventName() string  { return "RepDeleted" }
+func (RepsDeleted) eventName() string { return "RepsDeleted" }
+func (TeamCreated) eventName() string { return "TeamCreated" }
+func (TeamJoined) eventName() string  { return "TeamJoined" }
+func (TeamLeft) eventName() string    { return "TeamLeft" }
+
+// eventBus fans published events out to subscribers. Each subscriber gets its own queue and goroutine, so it sees events in
+// publish order, and a slow, failing, or panicking subscriber never holds up the publisher or other subscribers.
+type eventBus struct {
+	mu      sync.Mutex
+	subs    []*subscription
+	closed  bool
+	pending sync.WaitGroup
+}
+
+type subscription struct {
+	name   string
+	handle func(Event) error
+	queue  chan Event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{}
+}
+
+// subscribe registers handle to be called with every event published from now on. name is used in logs
+func (b *eventBus) subscribe(name string, handle func(Event) error) {
+	sub := &subscription{name: name, handle: handle, queue: make(chan Event, eventQueueSize)}
+
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+
+	go func() {
+		for e := range sub.queue {
+			if err := sub.run(e); err != nil {
+				log.Printf("%s subscriber failed on %s: %s", sub.name, e.eventName(), err.Error())
+			}
+			b.pending.Done()
+		}
+	}()
+}
+
+// run calls the handler, turning a panic into an error so one bad event does not stop the subscriber
+func (sub *subscription) run(e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return sub.handle(e)
+}
+
+// publish queues the event for every subscriber without waiting for them to handle it
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		log.Printf("dropped %s event published after shutdown", e.eventName())
+		return
+	}
+
+	for _, sub := range b.subs {
+		b.pending.Add(1)
+		select {
+		case sub.queue <- e:
+		default:
+			b.pending.Done()
+			log.Printf("dropped %s event for %s subscriber, its queue is full", e.eventName(), sub.name)
+		}
+	}
+}
+
+// wait blocks until every event published so far has been handled
+func (b *eventBus) wait() {
+	b.pending.Wait()
+}
+
+// close stops accepting events and waits for subscribers to finish the ones already queued
+func (b *eventBus) close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	for _, sub := range b.subs {
+		close(sub.queue)
+	}
+	b.mu.Unlock()
+
+	b.pending.Wait()
+}
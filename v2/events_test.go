@@ -0,0 +1,106 @@
+package countmyreps
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	b := newEventBus()
+
+	var mu sync.Mutex
+	var got []int
+	b.subscribe("recorder", func(e Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, e.(TeamJoined).TeamID)
+		return nil
+	})
+	b.subscribe("failing", func(e Event) error {
+		return fmt.Errorf("always fails")
+	})
+	b.subscribe("panicking", func(e Event) error {
+		panic("always panics")
+	})
+
+	for i := 1; i <= 100; i++ {
+		b.publish(TeamJoined{UserID: 1, TeamID: i})
+	}
+	b.wait()
+
+	mu.Lock()
+	if got, want := len(got), 100; got != want {
+		t.Fatalf("got %d events, want %d", got, want)
+	}
+	for i, id := range got {
+		if id != i+1 {
+			t.Fatalf("got team %d at position %d, want events in publish order", id, i)
+		}
+	}
+	mu.Unlock()
+
+	b.close()
+	// publishing after close is dropped, not a panic
+	b.publish(TeamJoined{UserID: 1, TeamID: 101})
+}
+
+func TestPublishedEvents(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	var mu sync.Mutex
+	var events []Event
+	s.events.subscribe("recorder", func(e Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+		return nil
+	})
+	s.events.subscribe("failing", func(e Event) error {
+		return fmt.Errorf("subscriber errors do not fail the request")
+	})
+
+	uid := mustCreateUser(t, s, "seth.ammons@twilio.com")
+	team, err := s.postTeam("Lunch Lifters", uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reps, err := s.postStats(uid, Exercises{Collection: []Exercise{{Name: "Push Ups", Count: 20}, {Name: "Squats", Count: 15}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.putRep(reps[0].ID, uid, 25); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.deleteRep(reps[1].ID, uid); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.deleteMyTeams(team.ID, uid); err != nil {
+		t.Fatal(err)
+	}
+	// leaving a team you are not on is not an event
+	if err := s.deleteMyTeams(team.ID, uid); err != nil {
+		t.Fatal(err)
+	}
+	s.events.wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{"TeamCreated", "TeamJoined", "RepsLogged", "RepEdited", "RepDeleted", "TeamLeft"}
+	if got, want := len(events), len(want); got != want {
+		t.Fatalf("got %d events, want %d: %#v", got, want, events)
+	}
+	for i, e := range events {
+		if got, want := e.eventName(), want[i]; got != want {
+			t.Errorf("got event %q at position %d, want %q", got, i, want)
+		}
+	}
+
+	if logged := events[2].(RepsLogged); len(logged.Reps) != 2 || logged.UserID != uid {
+		t.Errorf("got %+v, want 2 reps for uid %d", logged, uid)
+	}
+	if edited := events[3].(RepEdited); edited.Previous.Count != 20 || edited.Rep.Count != 25 {
+		t.Errorf("got edit from %d to %d, want 20 to 25", edited.Previous.Count, edited.Rep.Count)
+	}
+}
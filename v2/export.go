@@ -0,0 +1,234 @@
+package countmyreps
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportRow is one logged entry in an export. Teams are the teams the person is on now, not when they logged
+type ExportRow struct {
+	RepID     int
+	Email     string
+	Exercise  string
+	ValueType string
+	Count     int
+	Points    int
+	CreatedOn int
+	Timestamp string
+	Teams     []string
+}
+
+var exportHeader = []string{"rep_id", "email", "exercise", "value_type", "count", "points", "created_on", "timestamp", "teams"}
+
+// exportFlushEvery is how many rows are written between flushes, so big exports reach the client as they go
+const exportFlushEvery = 500
+
+// getMemberTeamNames maps each user to the names of the teams they are on. If the uid is <0, map every user. If the teamID
+// is >0, only that team and the teams under it are named
+func (s *Server) getMemberTeamNames(uid, teamID int) (map[int][]string, error) {
+	q := "select distinct user_teams.user_id, teams.name from user_teams join teams on teams.id=user_teams.team_id where (?<0 or user_teams.user_id=?)"
+	args := []interface{}{uid, uid}
+	if teamID > 0 {
+		q = "with recursive subtree(id) as (select ? union select teams.id from teams join subtree on teams.parent_id=subtree.id) " + q + " and teams.id in (select id from subtree)"
+		args = append([]interface{}{teamID}, args...)
+	}
+	rows, err := s.DB.Query(q+" order by teams.name", args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getMemberTeamNames: %w", err)
+	}
+	defer rows.Close()
+
+	names := make(map[int][]string)
+	for rows.Next() {
+		var userID int
+		var name string
+		if err := rows.Scan(&userID, &name); err != nil {
+			return nil, fmt.Errorf("unable to scan getMemberTeamNames: %w", err)
+		}
+		names[userID] = append(names[userID], name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getMemberTeamNames: %w", err)
+	}
+	return names, nil
+}
+
+// exportReps calls fn with every rep matching where, oldest first, as they are read rather than loading them all.
+// If the uid is <0, memberships are looked up for everyone. If the teamID is >0, each row's Teams are only that team and
+// the teams under it, so a team export does not show the other teams its members are on
+func (s *Server) exportReps(uid, teamID int, where string, args []interface{}, fn func(ExportRow) error) error {
+	// memberships are read up front; the connection is busy streaming reps after this
+	teams, err := s.getMemberTeamNames(uid, teamID)
+	if err != nil {
+		return err
+	}
+
+	q := "select reps.id, reps.user_id, users.email, reps.exercise_id, reps.count, reps.points, reps.created_on from reps join users on users.id=reps.user_id where " + where + " order by reps.created_on, reps.id"
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return fmt.Errorf("unable to query exportReps: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row ExportRow
+		var userID, exerciseID int
+		var points float64
+		if err := rows.Scan(&row.RepID, &userID, &row.Email, &exerciseID, &row.Count, &points, &row.CreatedOn); err != nil {
+			return fmt.Errorf("unable to scan exportReps: %w", err)
+		}
+		ex, _ := s.getExerciseByID(exerciseID)
+		row.Exercise, row.ValueType, row.Points = ex.Name, ex.ValueType, roundPoints(points)
+		row.Timestamp = time.Unix(int64(row.CreatedOn), 0).UTC().Format(time.RFC3339)
+		row.Teams = teams[userID]
+		if row.Teams == nil {
+			row.Teams = make([]string, 0)
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unexpected error after scanning exportReps: %w", err)
+	}
+	return nil
+}
+
+// exportWriter writes rows as csv or a json {"Entries": [...]} document. Nothing is sent until the first row or close,
+// so a failed query can still get an error response
+type exportWriter struct {
+	w        http.ResponseWriter
+	format   string
+	filename string
+	csv      *csv.Writer
+	begun    bool
+	rows     int
+}
+
+func newExportWriter(w http.ResponseWriter, format, filename string) (*exportWriter, bool) {
+	if format == "" {
+		format = "json"
+	}
+	if format != "csv" && format != "json" {
+		return nil, false
+	}
+	return &exportWriter{w: w, format: format, filename: filename}, true
+}
+
+func (e *exportWriter) start() error {
+	e.begun = true
+	if e.format == "csv" {
+		e.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		e.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.filename+".csv"))
+		e.csv = csv.NewWriter(e.w)
+		return e.csv.Write(exportHeader)
+	}
+	e.w.Header().Set("Content-Type", "application/json")
+	e.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.filename+".json"))
+	_, err := e.w.Write([]byte(`{"Entries":[`))
+	return err
+}
+
+func (e *exportWriter) row(row ExportRow) error {
+	if !e.begun {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+
+	if e.format == "csv" {
+		err := e.csv.Write([]string{
+			strconv.Itoa(row.RepID), row.Email, row.Exercise, row.ValueType, strconv.Itoa(row.Count), strconv.Itoa(row.Points),
+			strconv.Itoa(row.CreatedOn), row.Timestamp, strings.Join(row.Teams, ";"),
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		b, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if e.rows > 0 {
+			b = append([]byte(","), b...)
+		}
+		if _, err := e.w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	e.rows++
+	if e.rows%exportFlushEvery == 0 {
+		e.flush()
+	}
+	return nil
+}
+
+func (e *exportWriter) flush() {
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+	if flusher, ok := e.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (e *exportWriter) close() error {
+	if !e.begun {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+	if e.format == "csv" {
+		e.csv.Flush()
+		return e.csv.Error()
+	}
+	_, err := e.w.Write([]byte("]}\n"))
+	return err
+}
+
+// export streams the rows from run. Once a row has been sent the status can no longer change, so later errors are only logged
+func (s *Server) export(w http.ResponseWriter, r *http.Request, filename string, run func(fn func(ExportRow) error) error) {
+	ew, ok := newExportWriter(w, r.URL.Query().Get("format"), filename)
+	if !ok {
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	if err := run(ew.row); err != nil {
+		log.Printf("unable to export %s: %s", filename, err)
+		if !ew.begun {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := ew.close(); err != nil {
+		log.Printf("unable to finish export %s: %s", filename, err)
+	}
+}
+
+// GetExport downloads every entry you have logged. Options: ?format=csv|json (default json)
+func (s *Server) GetExport(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	s.export(w, r, "countmyreps", func(fn func(ExportRow) error) error {
+		return s.exportReps(uid, 0, "reps.user_id=?", []interface{}{uid}, fn)
+	})
+}
+
+// GetTeamExport is for team owners and admins. It downloads every entry logged by the team's members, including the teams under it.
+// Options: ?format=csv|json (default json)
+func (s *Server) GetTeamExport(w http.ResponseWriter, r *http.Request) {
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+	s.export(w, r, fmt.Sprintf("countmyreps-team-%d", teamID), func(fn func(ExportRow) error) error {
+		return s.exportReps(-1, teamID, "reps.user_id in ("+teamMembersSQL+")", []interface{}{teamID}, fn)
+	})
+}
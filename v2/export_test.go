@@ -0,0 +1,112 @@
+package countmyreps
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	s, _ := newTestServer(t)
+	day := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+
+	owner := newTestClient(t, s, "owner@twilio.com")
+	member := newTestClient(t, s, "member@twilio.com")
+	outsider := newTestClient(t, s, "outsider@twilio.com")
+	team, err := s.postTeam("Exporters", owner.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postMyTeams(team.ID, member.UID); err != nil {
+		t.Fatal(err)
+	}
+	mustInsertReps(t, s, member.UID, "Push Ups", 20, day)
+	mustInsertReps(t, s, member.UID, "Running", 3000, day.Add(time.Hour))
+	mustInsertReps(t, s, outsider.UID, "Squats", 50, day)
+
+	w := member.do("GET", "/v3/export?format=csv", "")
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		exportHeader,
+		{"", "member@twilio.com", "Push Ups", "Reps", "20", "20", fmt.Sprint(day.Unix()), "2020-11-11T12:00:00Z", "Exporters"},
+		{"", "member@twilio.com", "Running", "Meters", "3000", "300", fmt.Sprint(day.Add(time.Hour).Unix()), "2020-11-11T13:00:00Z", "Exporters"},
+	}
+	if got := len(records); got != len(want) {
+		t.Fatalf("got %d csv records, want %d", got, len(want))
+	}
+	for i := range want {
+		// rep ids depend on insert order, so skip them
+		if i > 0 {
+			want[i][0] = records[i][0]
+		}
+		if got := strings.Join(records[i], ","); got != strings.Join(want[i], ",") {
+			t.Errorf("got record %q, want %q", got, strings.Join(want[i], ","))
+		}
+	}
+
+	w = outsider.do("GET", "/v3/export", "")
+	var data struct{ Entries []ExportRow }
+	if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(data.Entries), 1; got != want {
+		t.Fatalf("got %d json entries, want %d", got, want)
+	}
+	if got, want := data.Entries[0].Exercise, "Squats"; got != want {
+		t.Errorf("got exercise %q, want %q", got, want)
+	}
+	if got := len(data.Entries[0].Teams); got != 0 {
+		t.Errorf("got %d teams for someone on none, want 0", got)
+	}
+
+	if got, want := member.do("GET", "/v3/export?format=xml", "").Code, http.StatusBadRequest; got != want {
+		t.Errorf("got %d for an unknown format, want %d", got, want)
+	}
+
+	path := fmt.Sprintf("/v3/teams/%d/export", team.ID)
+	if got, want := member.do("GET", path, "").Code, http.StatusForbidden; got != want {
+		t.Errorf("got %d for a member exporting the team, want %d", got, want)
+	}
+	w = owner.do("GET", path, "")
+	data.Entries = nil
+	if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(data.Entries), 2; got != want {
+		t.Errorf("got %d team entries, want the member's %d", got, want)
+	}
+
+	// the team export only names the team and the teams under it, not the other teams its members are on
+	other, err := s.postTeam("Somewhere Else", outsider.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postMyTeams(other.ID, member.UID); err != nil {
+		t.Fatal(err)
+	}
+	data.Entries = nil
+	if err := json.NewDecoder(owner.do("GET", path, "").Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range data.Entries {
+		if got, want := strings.Join(row.Teams, ","), "Exporters"; got != want {
+			t.Errorf("got teams %q in the team export, want %q", got, want)
+		}
+	}
+
+	// an empty export is still a whole document
+	w = owner.do("GET", "/v3/export", "")
+	if got, want := strings.TrimSpace(w.Body.String()), `{"Entries":[]}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
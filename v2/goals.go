@@ -0,0 +1,640 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	goalDay   = "day"
+	goalWeek  = "week"
+	goalMonth = "month"
+	// goalTotal is one target for the whole goal, from Start through End
+	goalTotal = "total"
+)
+
+// Goal is a personal target like 100 push ups a day or 50,000 meters of running a month.
+// Start and End are YYYY-MM-DD days in the user's timezone, or UTC for team goals; End is optional except for total goals.
+type Goal struct {
+	ID int
+	// TeamID is set for a team's collective goal, counting every member's reps
+	TeamID     int `json:",omitempty"`
+	ExerciseID int
+	Exercise   string
+	Target     int
+	Period     string
+	Start      string
+	End        string
+	CreatedOn  int
+
+	Progress *GoalProgress `json:",omitempty"`
+}
+
+// GoalProgress is how the goal is going in the period containing now, or the nearest period if the goal has not started or has ended
+type GoalProgress struct {
+	// PeriodStart and PeriodEnd are the first and last days of the period
+	PeriodStart string
+	PeriodEnd   string
+	Count       int
+	Percent     int
+	Done        bool
+	// ProjectedCount is where the period ends up at the current pace
+	ProjectedCount int
+	// ProjectedCompletionOn is when the target is reached at the current pace. 0 when already done or there is no pace yet
+	ProjectedCompletionOn int
+	// OnTrack is true when the current pace reaches the target before the period ends
+	OnTrack bool
+}
+
+// goalPeriod returns the period of the goal containing now, clipped to the goal's start and end. Times are in loc.
+// Total goals always have an End, so the period always has an end.
+func goalPeriod(g *Goal, now time.Time, loc *time.Location) (time.Time, time.Time) {
+	first := dayStart(g.Start, loc)
+	var last time.Time
+	if g.End != "" {
+		last = dayStart(g.End, loc).AddDate(0, 0, 1)
+	}
+
+	ref := now.In(loc)
+	if ref.Before(first) {
+		ref = first
+	}
+	if !last.IsZero() && !ref.Before(last) {
+		ref = last.Add(-time.Second)
+	}
+
+	var start, end time.Time
+	midnight := time.Date(ref.Year(), ref.Month(), ref.Day(), 0, 0, 0, 0, loc)
+	switch g.Period {
+	case goalDay:
+		start, end = midnight, midnight.AddDate(0, 0, 1)
+	case goalWeek:
+		// weeks start on monday
+		start = midnight.AddDate(0, 0, -((int(midnight.Weekday()) + 6) % 7))
+		end = start.AddDate(0, 0, 7)
+	case goalMonth:
+		start = time.Date(ref.Year(), ref.Month(), 1, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 1, 0)
+	default:
+		start, end = first, last
+	}
+
+	if start.Before(first) {
+		start = first
+	}
+	if !last.IsZero() && end.After(last) {
+		end = last
+	}
+	return start, end
+}
+
+// projectGoal works out progress from the count so far in the period [start, end) and the pace since start
+func projectGoal(count, target int, start, end, now time.Time) GoalProgress {
+	p := GoalProgress{
+		PeriodStart:    start.Format(dayFormat),
+		PeriodEnd:      end.AddDate(0, 0, -1).Format(dayFormat),
+		Count:          count,
+		Done:           count >= target,
+		ProjectedCount: count,
+	}
+	if target > 0 {
+		p.Percent = count * 100 / target
+	}
+	if p.Done {
+		p.OnTrack = true
+		return p
+	}
+
+	if now.After(end) {
+		now = end
+	}
+	elapsed := now.Sub(start)
+	if elapsed <= 0 || count == 0 {
+		return p
+	}
+
+	perSecond := float64(count) / elapsed.Seconds()
+	p.ProjectedCount = count + int(perSecond*end.Sub(now).Seconds())
+	completion := start.Add(time.Duration(float64(target)/perSecond) * time.Second)
+	p.ProjectedCompletionOn = int(completion.Unix())
+	p.OnTrack = !completion.After(end)
+	return p
+}
+
+// getGoalProgress reuses the per exercise totals used by stats and digests
+func (s *Server) getGoalProgress(uid int, g *Goal, now time.Time, loc *time.Location) (*GoalProgress, error) {
+	start, end := goalPeriod(g, now, loc)
+
+	var totals []Exercise
+	var err error
+	if g.TeamID != 0 {
+		totals, err = s.getTeamExerciseTotals(g.TeamID, int(start.Unix()), int(end.Unix()))
+	} else {
+		totals, err = s.getExerciseTotals(uid, int(start.Unix()), int(end.Unix()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var count int
+	for _, ex := range totals {
+		if ex.ID == g.ExerciseID {
+			count = ex.Count
+		}
+	}
+
+	p := projectGoal(count, g.Target, start, end, now)
+	return &p, nil
+}
+
+func (s *Server) userLocation(uid int) (*time.Location, error) {
+	prefs, err := s.getPreferences(uid)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(prefs.Timezone)
+	if err != nil {
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
+// getGoals returns the user's personal goals with their progress as of now
+func (s *Server) getGoals(uid int, now time.Time) ([]Goal, error) {
+	loc, err := s.userLocation(uid)
+	if err != nil {
+		return nil, err
+	}
+	return s.queryGoals(uid, now, loc, "where user_id=? and team_id=0 order by id", uid)
+}
+
+// getGoal returns nil if the goal does not exist or is not one of the user's personal goals
+func (s *Server) getGoal(goalID, uid int, now time.Time) (*Goal, error) {
+	loc, err := s.userLocation(uid)
+	if err != nil {
+		return nil, err
+	}
+	goals, err := s.queryGoals(uid, now, loc, "where id=? and user_id=? and team_id=0", goalID, uid)
+	if err != nil || len(goals) == 0 {
+		return nil, err
+	}
+	return &goals[0], nil
+}
+
+// getTeamGoals returns the team's goals with their progress as of now. Team goals use UTC days, like challenges
+func (s *Server) getTeamGoals(teamID int, now time.Time) ([]Goal, error) {
+	return s.queryGoals(0, now, time.UTC, "where team_id=? order by id", teamID)
+}
+
+// getTeamGoal returns nil if the goal does not exist or belongs to another team
+func (s *Server) getTeamGoal(goalID, teamID int, now time.Time) (*Goal, error) {
+	goals, err := s.queryGoals(0, now, time.UTC, "where id=? and team_id=?", goalID, teamID)
+	if err != nil || len(goals) == 0 {
+		return nil, err
+	}
+	return &goals[0], nil
+}
+
+func (s *Server) queryGoals(uid int, now time.Time, loc *time.Location, where string, args ...interface{}) ([]Goal, error) {
+	q := "select id, team_id, exercise_id, target, period, start_day, end_day, created_on from goals " + where
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query goals: %w", err)
+	}
+	defer rows.Close()
+
+	goals := make([]Goal, 0)
+	for rows.Next() {
+		var g Goal
+		if err := rows.Scan(&g.ID, &g.TeamID, &g.ExerciseID, &g.Target, &g.Period, &g.Start, &g.End, &g.CreatedOn); err != nil {
+			return nil, fmt.Errorf("unable to scan goals: %w", err)
+		}
+		goals = append(goals, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning goals: %w", err)
+	}
+	rows.Close()
+
+	for i := range goals {
+		ex, _ := s.getExerciseByID(goals[i].ExerciseID)
+		goals[i].Exercise = ex.Name
+		goals[i].Progress, err = s.getGoalProgress(uid, &goals[i], now, loc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return goals, nil
+}
+
+func (s *Server) postGoal(uid int, g *Goal) error {
+	g.CreatedOn = int(time.Now().Unix())
+	q := "insert into goals (user_id, team_id, exercise_id, target, period, start_day, end_day, created_on) values (?, ?, ?, ?, ?, ?, ?, ?)"
+	res, err := s.DB.Exec(q, uid, g.TeamID, g.ExerciseID, g.Target, g.Period, g.Start, g.End, g.CreatedOn)
+	if err != nil {
+		return fmt.Errorf("unable to insert goal: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("unable to get last insert id for goal: %w", err)
+	}
+	g.ID = int(id)
+	return nil
+}
+
+// putGoal saves changes to a goal. Callers check the goal is the user's, or their team's, first
+func (s *Server) putGoal(g *Goal) error {
+	q := "update goals set exercise_id=?, target=?, period=?, start_day=?, end_day=? where id=?"
+	if _, err := s.DB.Exec(q, g.ExerciseID, g.Target, g.Period, g.Start, g.End, g.ID); err != nil {
+		return fmt.Errorf("unable to putGoal: %w", err)
+	}
+	return nil
+}
+
+// deleteGoal removes one of the user's personal goals. It returns false if there was no such goal
+func (s *Server) deleteGoal(goalID, uid int) (bool, error) {
+	res, err := s.DB.Exec("delete from goals where id=? and user_id=? and team_id=0", goalID, uid)
+	if err != nil {
+		return false, fmt.Errorf("unable to deleteGoal: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// deleteTeamGoal returns false if the team has no such goal
+func (s *Server) deleteTeamGoal(goalID, teamID int) (bool, error) {
+	res, err := s.DB.Exec("delete from goals where id=? and team_id=?", goalID, teamID)
+	if err != nil {
+		return false, fmt.Errorf("unable to deleteTeamGoal: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// validateGoal fills in the exercise from either its ID or name, and checks the goal makes sense. Errors are user facing
+func (s *Server) validateGoal(g *Goal) error {
+	ex, ok := s.getExerciseByID(g.ExerciseID)
+	if !ok && g.Exercise != "" {
+		ex, ok = s.getExerciseByName(g.Exercise)
+	}
+	if !ok {
+		return fmt.Errorf("unknown exercise; set ExerciseID or Exercise to one of GET /v3/exercises")
+	}
+	g.ExerciseID, g.Exercise = ex.ID, ex.Name
+
+	if g.Target <= 0 {
+		return fmt.Errorf("Target must be greater than 0")
+	}
+	if !inList(g.Period, []string{goalDay, goalWeek, goalMonth, goalTotal}) {
+		return fmt.Errorf("Period must be one of %s, %s, %s, or %s", goalDay, goalWeek, goalMonth, goalTotal)
+	}
+	if _, err := time.Parse(dayFormat, g.Start); err != nil {
+		return fmt.Errorf("Start must be a YYYY-MM-DD date")
+	}
+	if g.End != "" {
+		if _, err := time.Parse(dayFormat, g.End); err != nil {
+			return fmt.Errorf("End must be a YYYY-MM-DD date")
+		}
+		if g.End < g.Start {
+			return fmt.Errorf("End cannot be before Start")
+		}
+	}
+	if g.Period == goalTotal && g.End == "" {
+		return fmt.Errorf("total goals need an End")
+	}
+	return nil
+}
+
+func (s *Server) GetGoals(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	data, err := s.getGoals(uid, time.Now())
+	if err != nil {
+		log.Printf("unable to GetGoals: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Goals []Goal }{data}); err != nil {
+		log.Println("GetGoals marshal err ", err.Error())
+	}
+}
+
+func (s *Server) GetGoal(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	goalID, err := strconv.Atoi(chi.URLParam(r, "goalID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	g, err := s.getGoal(goalID, uid, time.Now())
+	if err != nil {
+		log.Printf("unable to GetGoal: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if g == nil {
+		http.Error(w, "goal not found", http.StatusNotFound)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(g); err != nil {
+		log.Println("GetGoal marshal err ", err.Error())
+	}
+}
+
+// PostGoals creates a goal. Start defaults to today in your timezone
+func (s *Server) PostGoals(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := &Goal{}
+	if err := json.Unmarshal(body, g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.TeamID = 0
+
+	now := time.Now()
+	if g.Start == "" {
+		loc, err := s.userLocation(uid)
+		if err != nil {
+			log.Printf("unable to PostGoals: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		g.Start = now.In(loc).Format(dayFormat)
+	}
+	if err := s.validateGoal(g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.postGoal(uid, g); err != nil {
+		log.Printf("unable to PostGoals: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	created, err := s.getGoal(g.ID, uid, now)
+	if err != nil {
+		log.Printf("unable to PostGoals: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		log.Println("PostGoals marshal err ", err.Error())
+	}
+}
+
+// PutGoal updates only the fields present in the body
+func (s *Server) PutGoal(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	goalID, err := strconv.Atoi(chi.URLParam(r, "goalID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	g, err := s.getGoal(goalID, uid, now)
+	if err != nil {
+		log.Printf("unable to PutGoal: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if g == nil {
+		http.Error(w, "goal not found", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// changing the exercise by name only should not be overridden by the old ExerciseID
+	var update struct{ ExerciseID *int }
+	json.Unmarshal(body, &update)
+	if err := json.Unmarshal(body, g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.ID, g.TeamID = goalID, 0
+	if update.ExerciseID == nil {
+		g.ExerciseID = 0
+	}
+
+	if err := s.validateGoal(g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.putGoal(g); err != nil {
+		log.Printf("unable to PutGoal: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := s.getGoal(goalID, uid, now)
+	if err != nil {
+		log.Printf("unable to PutGoal: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		log.Println("PutGoal marshal err ", err.Error())
+	}
+}
+
+func (s *Server) DeleteGoal(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	goalID, err := strconv.Atoi(chi.URLParam(r, "goalID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	found, err := s.deleteGoal(goalID, uid)
+	if err != nil {
+		log.Printf("unable to DeleteGoal: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "goal not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) GetTeamGoals(w http.ResponseWriter, r *http.Request) {
+	teamID, err := strconv.Atoi(chi.URLParam(r, "teamID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hidden, err := s.isTeamHidden(r, teamID)
+	if err != nil {
+		log.Printf("unable to GetTeamGoals: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hidden {
+		http.Error(w, "team not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := s.getTeamGoals(teamID, time.Now())
+	if err != nil {
+		log.Printf("unable to GetTeamGoals: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Goals []Goal }{data}); err != nil {
+		log.Println("GetTeamGoals marshal err ", err.Error())
+	}
+}
+
+// PostTeamGoals sets a collective target for the team. Team owners only. Start defaults to today (UTC)
+func (s *Server) PostTeamGoals(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := &Goal{}
+	if err := json.Unmarshal(body, g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.TeamID = teamID
+
+	now := time.Now()
+	if g.Start == "" {
+		g.Start = now.UTC().Format(dayFormat)
+	}
+	if err := s.validateGoal(g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.postGoal(uid, g); err != nil {
+		log.Printf("unable to PostTeamGoals: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	created, err := s.getTeamGoal(g.ID, teamID, now)
+	if err != nil {
+		log.Printf("unable to PostTeamGoals: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		log.Println("PostTeamGoals marshal err ", err.Error())
+	}
+}
+
+// PutTeamGoal updates only the fields present in the body. Team owners only
+func (s *Server) PutTeamGoal(w http.ResponseWriter, r *http.Request) {
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+	goalID, err := strconv.Atoi(chi.URLParam(r, "goalID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	g, err := s.getTeamGoal(goalID, teamID, now)
+	if err != nil {
+		log.Printf("unable to PutTeamGoal: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if g == nil {
+		http.Error(w, "goal not found", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var update struct{ ExerciseID *int }
+	json.Unmarshal(body, &update)
+	if err := json.Unmarshal(body, g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.ID, g.TeamID = goalID, teamID
+	if update.ExerciseID == nil {
+		g.ExerciseID = 0
+	}
+
+	if err := s.validateGoal(g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.putGoal(g); err != nil {
+		log.Printf("unable to PutTeamGoal: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := s.getTeamGoal(goalID, teamID, now)
+	if err != nil {
+		log.Printf("unable to PutTeamGoal: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		log.Println("PutTeamGoal marshal err ", err.Error())
+	}
+}
+
+// DeleteTeamGoal is for team owners only
+func (s *Server) DeleteTeamGoal(w http.ResponseWriter, r *http.Request) {
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+	goalID, err := strconv.Atoi(chi.URLParam(r, "goalID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	found, err := s.deleteTeamGoal(goalID, teamID)
+	if err != nil {
+		log.Printf("unable to DeleteTeamGoal: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "goal not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,146 @@
+package countmyreps
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGoalPeriod(t *testing.T) {
+	// wednesday
+	now := time.Date(2020, 11, 11, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		goal      Goal
+		wantStart string
+		wantEnd   string
+	}{
+		{"day", Goal{Period: goalDay, Start: "2020-11-01"}, "2020-11-11", "2020-11-12"},
+		{"week starts monday", Goal{Period: goalWeek, Start: "2020-11-01"}, "2020-11-09", "2020-11-16"},
+		{"week clipped to start", Goal{Period: goalWeek, Start: "2020-11-10"}, "2020-11-10", "2020-11-16"},
+		{"month", Goal{Period: goalMonth, Start: "2020-10-15"}, "2020-11-01", "2020-12-01"},
+		{"month clipped to end", Goal{Period: goalMonth, Start: "2020-11-01", End: "2020-11-20"}, "2020-11-01", "2020-11-21"},
+		{"total", Goal{Period: goalTotal, Start: "2020-11-05", End: "2020-11-25"}, "2020-11-05", "2020-11-26"},
+		{"not started", Goal{Period: goalDay, Start: "2020-12-01"}, "2020-12-01", "2020-12-02"},
+		{"ended", Goal{Period: goalWeek, Start: "2020-10-01", End: "2020-10-31"}, "2020-10-26", "2020-11-01"},
+	}
+	for _, test := range tests {
+		start, end := goalPeriod(&test.goal, now, time.UTC)
+		if got, want := start.Format(dayFormat), test.wantStart; got != want {
+			t.Errorf("%s: got start %s, want %s", test.name, got, want)
+		}
+		if got, want := end.Format(dayFormat), test.wantEnd; got != want {
+			t.Errorf("%s: got end %s, want %s", test.name, got, want)
+		}
+	}
+}
+
+func TestProjectGoal(t *testing.T) {
+	start := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 30)
+
+	// 10 days in, a third of the way to 3000
+	p := projectGoal(1000, 3000, start, end, start.AddDate(0, 0, 10))
+	if got, want := p.ProjectedCount, 3000; got != want {
+		t.Errorf("got projected %d, want %d", got, want)
+	}
+	if got, want := p.ProjectedCompletionOn, int(end.Unix()); got != want {
+		t.Errorf("got completion %s, want %s", time.Unix(int64(got), 0).UTC(), end)
+	}
+	if !p.OnTrack || p.Done || p.Percent != 33 {
+		t.Errorf("got %+v, want on track, not done, 33 percent", p)
+	}
+
+	// behind pace
+	p = projectGoal(500, 3000, start, end, start.AddDate(0, 0, 10))
+	if p.OnTrack || p.ProjectedCount != 1500 {
+		t.Errorf("got %+v, want off track, projected 1500", p)
+	}
+
+	// done
+	p = projectGoal(3100, 3000, start, end, start.AddDate(0, 0, 10))
+	if !p.Done || p.ProjectedCompletionOn != 0 {
+		t.Errorf("got %+v, want done with no projection", p)
+	}
+
+	// nothing yet
+	p = projectGoal(0, 3000, start, end, start.AddDate(0, 0, 10))
+	if p.OnTrack || p.ProjectedCompletionOn != 0 {
+		t.Errorf("got %+v, want no projection without a pace", p)
+	}
+}
+
+func TestGetGoals(t *testing.T) {
+	s, _ := newTestServer(t)
+	uid := mustCreateUser(t, s, "seth.ammons@twilio.com")
+	now := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+
+	mustInsertReps(t, s, uid, "Push Ups", 60, now.Add(-2*time.Hour))
+	mustInsertReps(t, s, uid, "Push Ups", 60, now.Add(-26*time.Hour))
+	mustInsertReps(t, s, uid, "Running", 5000, now.Add(-26*time.Hour))
+
+	daily := &Goal{Exercise: "Push Ups", Target: 100, Period: goalDay, Start: "2020-11-01"}
+	if err := s.validateGoal(daily); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postGoal(uid, daily); err != nil {
+		t.Fatal(err)
+	}
+	monthly := &Goal{Exercise: "Running", Target: 50000, Period: goalMonth, Start: "2020-11-01"}
+	if err := s.validateGoal(monthly); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postGoal(uid, monthly); err != nil {
+		t.Fatal(err)
+	}
+
+	goals, err := s.getGoals(uid, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(goals), 2; got != want {
+		t.Fatalf("got %d goals, want %d", got, want)
+	}
+	if got, want := goals[0].Progress.Count, 60; got != want {
+		t.Errorf("got today's push ups %d, want %d", got, want)
+	}
+	if got, want := goals[1].Progress.Count, 5000; got != want {
+		t.Errorf("got this month's running %d, want %d", got, want)
+	}
+	if goals[1].Progress.OnTrack {
+		t.Errorf("got on track for 5k of 50k a third of the way through the month, want off track")
+	}
+
+	other := mustCreateUser(t, s, "someone@twilio.com")
+	if g, err := s.getGoal(daily.ID, other, now); err != nil || g != nil {
+		t.Errorf("got %+v, %v, want no goal for another user", g, err)
+	}
+	if found, err := s.deleteGoal(daily.ID, uid); err != nil || !found {
+		t.Errorf("got found %t, %v, want the goal deleted", found, err)
+	}
+}
+
+func TestValidateGoal(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		name string
+		goal Goal
+		ok   bool
+	}{
+		{"by name", Goal{Exercise: "Squats", Target: 100, Period: goalDay, Start: "2020-11-01"}, true},
+		{"by id", Goal{ExerciseID: 1, Target: 100, Period: goalWeek, Start: "2020-11-01"}, true},
+		{"unknown exercise", Goal{Exercise: "Jumping Jacks", Target: 100, Period: goalDay, Start: "2020-11-01"}, false},
+		{"no target", Goal{Exercise: "Squats", Period: goalDay, Start: "2020-11-01"}, false},
+		{"bad period", Goal{Exercise: "Squats", Target: 100, Period: "fortnight", Start: "2020-11-01"}, false},
+		{"bad start", Goal{Exercise: "Squats", Target: 100, Period: goalDay, Start: "11/01/2020"}, false},
+		{"end before start", Goal{Exercise: "Squats", Target: 100, Period: goalDay, Start: "2020-11-01", End: "2020-10-01"}, false},
+		{"total without end", Goal{Exercise: "Squats", Target: 100, Period: goalTotal, Start: "2020-11-01"}, false},
+	}
+	for _, test := range tests {
+		err := s.validateGoal(&test.goal)
+		if got, want := err == nil, test.ok; got != want {
+			t.Errorf("%s: got ok %t, want %t (%v)", test.name, got, want, err)
+		}
+	}
+}
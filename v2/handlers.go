@@ -8,12 +8,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/sethgrid/countmyreps/v2/teamname"
 )
 
 func (s *Server) setRoutes(mux *chi.Mux) {
@@ -25,22 +27,86 @@ func (s *Server) setRoutes(mux *chi.Mux) {
 
 	mux.Get("/v3/token", s.TokenHandler)
 
+	// slack requests are authenticated with the signing secret instead of a bearer token
+	if s.conf.SlackSigningSecret != "" {
+		mux.Post("/slack/command", s.SlackCommandHandler)
+	}
+
 	// authenticated endpoints
 	mux.Route("/v3", func(r chi.Router) {
 		r.With(s.authMiddleware).Get("/exercises", s.GetExercises)
 
+		// shared displays can use the display token instead of signing in, when one is set
+		r.With(s.streamAuth).Get("/stream", s.StreamHandler)
+
 		r.With(s.authMiddleware).Get("/stats", s.GetStats)
 		r.With(s.authMiddleware).Post("/stats", s.PostStats)
 		r.With(s.authMiddleware).Post("/stats/all", s.GetStatsAll)
-		r.With(s.authMiddleware).Get("/stats/team/{teamID}", s.GetStatsForTeam)
+		r.With(s.authMiddleware, s.teamRedirect).Get("/stats/team/{teamID}", s.GetStatsForTeam)
 
 		r.With(s.authMiddleware).Get("/teams", s.GetTeams)
 		r.With(s.authMiddleware).Post("/teams", s.PostTeams)
 		r.With(s.authMiddleware).Delete("/team/{teamID}", s.DeleteTeam)
+		r.With(s.authMiddleware, s.teamRedirect).Put("/teams/{teamID}", s.PutTeam)
+		r.With(s.authMiddleware, s.teamRedirect).Get("/teams/{teamID}/members", s.GetTeamMembers)
+		r.With(s.authMiddleware, s.teamRedirect).Delete("/teams/{teamID}/members/{userID}", s.DeleteTeamMember)
+		r.With(s.authMiddleware, s.teamRedirect).Get("/teams/{teamID}/invites", s.GetTeamInvites)
+		r.With(s.authMiddleware, s.teamRedirect).Post("/teams/{teamID}/invites", s.PostTeamInvites)
+		r.With(s.authMiddleware, s.teamRedirect).Delete("/teams/{teamID}/invites/{code}", s.DeleteTeamInvite)
+		r.With(s.authMiddleware, s.teamRedirect).Get("/teams/{teamID}/requests", s.GetJoinRequests)
+		r.With(s.authMiddleware, s.teamRedirect).Post("/teams/{teamID}/requests/{requestID}/approve", s.PostApproveJoinRequest)
+		r.With(s.authMiddleware, s.teamRedirect).Post("/teams/{teamID}/requests/{requestID}/reject", s.PostRejectJoinRequest)
+		r.With(s.authMiddleware).Post("/invites/{code}", s.PostInvite)
+		r.With(s.authMiddleware, s.teamRedirect).Get("/teams/{teamID}/summary", s.GetTeamSummary)
+		r.With(s.authMiddleware, s.teamRedirect).Get("/teams/{teamID}/export", s.GetTeamExport)
+		r.With(s.authMiddleware, s.teamRedirect).Get("/teams/{teamID}/goals", s.GetTeamGoals)
+		r.With(s.authMiddleware, s.teamRedirect).Post("/teams/{teamID}/goals", s.PostTeamGoals)
+		r.With(s.authMiddleware, s.teamRedirect).Put("/teams/{teamID}/goals/{goalID}", s.PutTeamGoal)
+		r.With(s.authMiddleware, s.teamRedirect).Delete("/teams/{teamID}/goals/{goalID}", s.DeleteTeamGoal)
+
+		r.With(s.authMiddleware).Get("/challenges", s.GetChallenges)
+		r.With(s.authMiddleware).Post("/challenges", s.PostChallenges)
+		r.With(s.authMiddleware).Get("/challenges/{challengeID}", s.GetChallenge)
+		r.With(s.authMiddleware).Get("/challenges/{challengeID}/scoreboard", s.GetScoreboard)
+		r.With(s.authMiddleware, s.teamRedirect).Post("/challenges/{challengeID}/teams/{teamID}", s.PostChallengeTeam)
+		r.With(s.authMiddleware, s.teamRedirect).Delete("/challenges/{challengeID}/teams/{teamID}", s.DeleteChallengeTeam)
 
 		r.With(s.authMiddleware).Get("/myteams", s.GetMyTeams)
-		r.With(s.authMiddleware).Post("/myteams/{teamID}", s.PostMyTeams)
-		r.With(s.authMiddleware).Delete("/myteams/{teamID}", s.DeleteMyTeams)
+		r.With(s.authMiddleware, s.teamRedirect).Post("/myteams/{teamID}", s.PostMyTeams)
+		r.With(s.authMiddleware, s.teamRedirect).Delete("/myteams/{teamID}", s.DeleteMyTeams)
+
+		r.With(s.authMiddleware).Get("/me/data", s.GetMyData)
+		r.With(s.authMiddleware).Delete("/me", s.DeleteMe)
+		r.With(s.authMiddleware).Get("/me/preferences", s.GetPreferences)
+		r.With(s.authMiddleware).Put("/me/preferences", s.PutPreferences)
+		r.With(s.authMiddleware).Get("/me/streaks", s.GetStreaks)
+		r.With(s.authMiddleware).Post("/me/streaks/freezes", s.PostStreakFreeze)
+		r.With(s.authMiddleware).Get("/me/goals", s.GetGoals)
+		r.With(s.authMiddleware).Post("/me/goals", s.PostGoals)
+		r.With(s.authMiddleware).Get("/me/goals/{goalID}", s.GetGoal)
+		r.With(s.authMiddleware).Put("/me/goals/{goalID}", s.PutGoal)
+		r.With(s.authMiddleware).Delete("/me/goals/{goalID}", s.DeleteGoal)
+		r.With(s.authMiddleware).Get("/me/achievements", s.GetMyAchievements)
+		r.With(s.authMiddleware).Get("/users/{userID}/achievements", s.GetUserAchievements)
+		r.With(s.authMiddleware).Post("/admin/achievements/backfill", s.PostAchievementsBackfill)
+		r.With(s.authMiddleware).Post("/admin/teams/{teamID}/merge", s.PostTeamMerge)
+		r.With(s.authMiddleware).Put("/admin/exercises/{exerciseID}", s.PutExerciseWeight)
+		r.With(s.authMiddleware).Get("/admin/backups", s.GetBackups)
+		r.With(s.authMiddleware).Post("/admin/backups", s.PostBackups)
+		r.With(s.authMiddleware).Get("/admin/audit", s.GetAudit)
+
+		r.With(s.authMiddleware).Get("/export", s.GetExport)
+		r.With(s.authMiddleware).Get("/imports", s.GetImports)
+		r.With(s.authMiddleware).Post("/imports", s.PostImports)
+		r.With(s.authMiddleware).Delete("/imports/{importID}", s.DeleteImport)
+		r.With(s.authMiddleware).Get("/reps", s.GetReps)
+		r.With(s.authMiddleware).Put("/reps/{repID}", s.PutRep)
+		r.With(s.authMiddleware).Delete("/reps/{repID}", s.DeleteRep)
+
+		r.With(s.authMiddleware).Get("/webhooks", s.GetWebhooks)
+		r.With(s.authMiddleware).Post("/webhooks", s.PostWebhooks)
+		r.With(s.authMiddleware).Delete("/webhooks/{webhookID}", s.DeleteWebhook)
+		r.With(s.authMiddleware).Get("/webhooks/{webhookID}/deliveries", s.GetWebhookDeliveries)
 
 	})
 
@@ -196,6 +262,14 @@ type googleAuthResp struct {
 	HD            string `json:"hd"`
 }
 
+// allowedEmailDomain is the only domain, along with its subdomains, that can sign in
+const allowedEmailDomain = "twilio.com"
+
+func allowedEmail(email string) bool {
+	email = strings.ToLower(email)
+	return strings.HasSuffix(email, "@"+allowedEmailDomain) || strings.HasSuffix(email, "."+allowedEmailDomain)
+}
+
 // oAuthValidate returns the email address of the signed in user via Google OAuthv2, or an error
 func (s *Server) oAuthValidate(code string) (*googleAuthResp, error) {
 	if s.DevMode {
@@ -229,8 +303,8 @@ func (s *Server) oAuthValidate(code string) (*googleAuthResp, error) {
 		return nil, fmt.Errorf("unable to oAuthValidate marshal: %w", err)
 	}
 
-	if !strings.HasSuffix(authResp.Email, "twilio.com") {
-		return nil, fmt.Errorf("invalid email address: twilio.com required")
+	if !allowedEmail(authResp.Email) {
+		return nil, fmt.Errorf("invalid email address: %s required", allowedEmailDomain)
 	}
 
 	return &authResp, nil
@@ -242,6 +316,13 @@ func (s *Server) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	s.TokenHandler(w, r)
 }
 
+// StatsResponse is your own stats, along with your streaks, for GET /v3/stats?streaks=true
+type StatsResponse struct {
+	Stats   []Stats
+	Streaks *Streaks
+}
+
+// GetStats is your own stats. Options: ?streaks=true to wrap them in a StatsResponse with your streaks
 func (s *Server) GetStats(w http.ResponseWriter, r *http.Request) {
 	uid, _ := r.Context().Value(ctxUID).(int)
 	start, end := getStartAndEndTS(r)
@@ -251,8 +332,19 @@ func (s *Server) GetStats(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if withStreaks, _ := strconv.ParseBool(r.URL.Query().Get("streaks")); !withStreaks {
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
 
-	json.NewEncoder(w).Encode(stats)
+	streaks, err := s.getStreaks(uid, time.Now())
+	if err != nil {
+		log.Printf("unable to getStreaks: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(StatsResponse{Stats: stats, Streaks: streaks})
 }
 
 func (s *Server) GetStatsAll(w http.ResponseWriter, r *http.Request) {
@@ -273,6 +365,18 @@ func (s *Server) GetStatsForTeam(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+
+	hidden, err := s.isTeamHidden(r, teamID)
+	if err != nil {
+		log.Printf("unable to GetStatsForTeam: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hidden {
+		http.Error(w, "team not found", http.StatusNotFound)
+		return
+	}
+
 	start, end := getStartAndEndTS(r)
 	stats, err := s.getStatsForTeam(teamID, start, end)
 	if err != nil {
@@ -316,12 +420,13 @@ func (s *Server) PostStats(w http.ResponseWriter, r *http.Request) {
 	}
 
 	uid, _ := r.Context().Value(ctxUID).(int)
-	err = s.postStats(uid, exs)
+	reps, err := s.postStats(uid, exs)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.auditRepsLogged(uid, auditAPI, reps)
 
 	w.WriteHeader(http.StatusCreated)
 }
@@ -339,13 +444,33 @@ func (s *Server) GetExercises(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetTeams lists every team, except invite-only teams you are not on. Options: ?tree=true to nest teams under their parents
 func (s *Server) GetTeams(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
 	data, err := s.getAllTeams(-1)
 	if err != nil {
 		log.Println("error GetTeams ", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !s.isAdmin(r) {
+		hidden, err := s.getHiddenTeams(uid)
+		if err != nil {
+			log.Println("error GetTeams ", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		visible := make([]Team, 0, len(data.Collection))
+		for _, t := range data.Collection {
+			if !inIntList(t.ID, hidden) {
+				visible = append(visible, t)
+			}
+		}
+		data.Collection = visible
+	}
+	if tree, _ := strconv.ParseBool(r.URL.Query().Get("tree")); tree {
+		data.Collection = buildTeamTree(data.Collection)
+	}
 
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		log.Println("GetTeams marshal err ", err.Error())
@@ -355,31 +480,80 @@ func (s *Server) PostTeams(w http.ResponseWriter, r *http.Request) {
 	uid := r.Context().Value(ctxUID).(int)
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println("error reading body PostTeams: %s", err.Error())
+		log.Printf("error reading body PostTeams: %s", err.Error())
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	team := &Team{}
+	var team struct {
+		Name string
+		// Force creates the team even if it looks like a duplicate of another
+		Force bool
+	}
 
-	err = json.Unmarshal(body, team)
+	err = json.Unmarshal(body, &team)
 	if err != nil {
-		log.Println("error marshalling body PostTeams: %s", err.Error())
+		log.Printf("error marshalling body PostTeams: %s", err.Error())
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	team.Name = teamname.Normalize(team.Name)
 	if team.Name == "" {
 		http.Error(w, "team name required", http.StatusBadRequest)
 		return
 	}
 
+	existing, err := s.getTeamByName(team.Name)
+	if err != nil {
+		log.Printf("error postTeam %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		// an invite-only team the caller cannot see is only a taken name, not a team to hand back
+		hidden, err := s.isTeamHidden(r, existing.ID)
+		if err != nil {
+			log.Printf("error postTeam %s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hidden {
+			http.Error(w, fmt.Sprintf("there is already a team named %q", team.Name), http.StatusConflict)
+			return
+		}
+	}
+	if existing == nil && !team.Force {
+		similar, err := s.similarTeams(team.Name, uid)
+		if err != nil {
+			log.Printf("error postTeam %s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(similar) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			data := struct {
+				Message     string
+				Suggestions []Team
+			}{fmt.Sprintf("%q looks like a team that already exists; join one of these, or send Force: true to create it anyway", team.Name), similar}
+			if err := json.NewEncoder(w).Encode(data); err != nil {
+				log.Println("PostTeams marshal err ", err.Error())
+			}
+			return
+		}
+	}
+
 	newTeam, err := s.postTeam(team.Name, uid)
 	if err != nil {
 		log.Printf("error postTeam %s", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// posting an existing name hands back that team without changing anything
+	if existing == nil {
+		s.auditRequest(r, uid, AuditEntry{Action: "team.create", SubjectType: "team", SubjectID: newTeam.ID, After: auditJSON(newTeam)})
+		s.auditRequest(r, uid, AuditEntry{Action: "team.join", SubjectType: "team", SubjectID: newTeam.ID, After: auditJSON(auditMember{uid})})
+	}
 
 	if err := json.NewEncoder(w).Encode(newTeam); err != nil {
 		log.Println("PostTeams marshal err ", err.Error())
@@ -398,21 +572,66 @@ func (s *Server) DeleteTeam(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	team, err := s.getTeamByID(teamID)
+	if err != nil {
+		log.Printf("unable to DeleteTeam: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owner, _, err := s.getTeamOwner(teamID)
+	if err != nil {
+		log.Printf("unable to DeleteTeam: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	err = s.deleteTeam(teamID, uid)
 	if err != nil {
-		log.Println("unable to DeleteTeam: %s", err.Error())
+		log.Printf("unable to DeleteTeam: %s", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// only the owner's delete removes anything
+	if team != nil && owner == uid {
+		s.auditRequest(r, uid, AuditEntry{Action: "team.delete", SubjectType: "team", SubjectID: teamID, Before: auditJSON(team)})
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// authorizeTeamOwner parses the teamID url param and checks the caller created the team or is an admin. Seeded teams are admin only.
+// It writes the error response when not ok
+func (s *Server) authorizeTeamOwner(w http.ResponseWriter, r *http.Request) (int, bool) {
+	uid := r.Context().Value(ctxUID).(int)
+	teamID, err := strconv.Atoi(chi.URLParam(r, "teamID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+
+	owner, found, err := s.getTeamOwner(teamID)
+	if err != nil {
+		log.Printf("unable to authorize team owner: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	if !found {
+		http.Error(w, "team not found", http.StatusNotFound)
+		return 0, false
+	}
+	if owner != uid && !s.isAdmin(r) {
+		http.Error(w, "only the team owner can do that", http.StatusForbidden)
+		return 0, false
+	}
+
+	return teamID, true
+}
+
 func (s *Server) GetMyTeams(w http.ResponseWriter, r *http.Request) {
 	uid := r.Context().Value(ctxUID).(int)
 	data, err := s.getMyTeams(uid)
 	if err != nil {
-		log.Println("unable to GetMyTeams: %s", err.Error())
+		log.Printf("unable to GetMyTeams: %s", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -435,6 +654,8 @@ func (s *Server) GetTeamsCreatedByUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// PostMyTeams joins a public team. For a private team it asks the owner instead, responding 202 with the join request.
+// Invite-only teams can only be joined with an invite (POST /v3/invites/{code}). Owners and admins can always join
 func (s *Server) PostMyTeams(w http.ResponseWriter, r *http.Request) {
 	uid := r.Context().Value(ctxUID).(int)
 	teamID, err := strconv.Atoi(chi.URLParam(r, "teamID"))
@@ -443,12 +664,59 @@ func (s *Server) PostMyTeams(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	team, err := s.getTeamByID(teamID)
+	if err != nil {
+		log.Printf("unable to PostMyTeams: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if team == nil {
+		http.Error(w, "team not found", http.StatusNotFound)
+		return
+	}
+	owner, _, err := s.getTeamOwner(teamID)
+	if err != nil {
+		log.Printf("unable to PostMyTeams: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	member, err := s.isTeamMember(teamID, uid)
+	if err != nil {
+		log.Printf("unable to PostMyTeams: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !member && owner != uid && !s.isAdmin(r) {
+		switch team.Visibility {
+		case teamInviteOnly:
+			// same as a team that does not exist, so invite-only teams cannot be found by guessing ids
+			http.Error(w, "team not found", http.StatusNotFound)
+			return
+		case teamPrivate:
+			jr, err := s.postJoinRequest(teamID, uid)
+			if err != nil {
+				log.Printf("unable to PostMyTeams: %s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			if err := json.NewEncoder(w).Encode(jr); err != nil {
+				log.Println("PostMyTeams marshal err ", err.Error())
+			}
+			return
+		}
+	}
+
 	err = s.postMyTeams(teamID, uid)
 	if err != nil {
-		log.Println("unable to PostMyTeams: %s", err)
+		log.Printf("unable to PostMyTeams: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !member {
+		s.auditRequest(r, uid, AuditEntry{Action: "team.join", SubjectType: "team", SubjectID: teamID, After: auditJSON(auditMember{uid})})
+	}
 
 	w.WriteHeader(http.StatusCreated)
 }
@@ -461,16 +729,187 @@ func (s *Server) DeleteMyTeams(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	member, err := s.isTeamMember(teamID, uid)
+	if err != nil {
+		log.Printf("unable to DeleteMyTeams: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	err = s.deleteMyTeams(teamID, uid)
 	if err != nil {
-		log.Println("unable to PostMyTeams: %s", err)
+		log.Printf("unable to PostMyTeams: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if member {
+		s.auditRequest(r, uid, AuditEntry{Action: "team.leave", SubjectType: "team", SubjectID: teamID, Before: auditJSON(auditMember{uid})})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) GetPreferences(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	data, err := s.getPreferences(uid)
+	if err != nil {
+		log.Printf("unable to GetPreferences: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("GetPreferences marshal err ", err.Error())
+	}
+}
+
+// PutPreferences updates only the fields present in the body
+func (s *Server) PutPreferences(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	prefs, err := s.getPreferences(uid)
+	if err != nil {
+		log.Printf("unable to PutPreferences: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, prefs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := time.LoadLocation(prefs.Timezone); err != nil || prefs.Timezone == "" {
+		http.Error(w, fmt.Sprintf("unknown timezone %q", prefs.Timezone), http.StatusBadRequest)
+		return
+	}
+	if !(prefs.Digest == "" || prefs.Digest == digestDaily || prefs.Digest == digestWeekly) {
+		http.Error(w, "digest must be one of daily, weekly, or empty", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.putPreferences(uid, prefs); err != nil {
+		log.Printf("unable to PutPreferences: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(prefs); err != nil {
+		log.Println("PutPreferences marshal err ", err.Error())
+	}
+}
+
+// GetReps lists your individual entries, newest first. Accepts the same startdate and enddate options as GetStats
+func (s *Server) GetReps(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	start, end := getStartAndEndTS(r)
+	data, err := s.getReps(uid, start, end)
+	if err != nil {
+		log.Printf("unable to GetReps: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Reps []Rep }{data}); err != nil {
+		log.Println("GetReps marshal err ", err.Error())
+	}
+}
+
+// PutRep corrects the count of one of your entries. Body: {"Count": n}
+func (s *Server) PutRep(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	repID, err := strconv.Atoi(chi.URLParam(r, "repID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var update struct{ Count int }
+	if err := json.Unmarshal(body, &update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	previous, err := s.getRep(repID, uid)
+	if err != nil {
+		log.Printf("unable to PutRep: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if previous == nil {
+		http.Error(w, "rep not found", http.StatusNotFound)
+		return
+	}
+
+	rep, err := s.putRep(repID, uid, update.Count)
+	if err != nil {
+		log.Printf("unable to PutRep: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rep == nil {
+		http.Error(w, "rep not found", http.StatusNotFound)
+		return
+	}
+	s.auditRequest(r, uid, AuditEntry{Action: "rep.update", SubjectType: "rep", SubjectID: repID, Before: auditJSON(previous), After: auditJSON(rep)})
+
+	if err := json.NewEncoder(w).Encode(rep); err != nil {
+		log.Println("PutRep marshal err ", err.Error())
+	}
+}
+
+func (s *Server) DeleteRep(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	repID, err := strconv.Atoi(chi.URLParam(r, "repID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	previous, err := s.getRep(repID, uid)
+	if err != nil {
+		log.Printf("unable to DeleteRep: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if previous == nil {
+		http.Error(w, "rep not found", http.StatusNotFound)
+		return
+	}
+
+	found, err := s.deleteRep(repID, uid)
+	if err != nil {
+		log.Printf("unable to DeleteRep: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "rep not found", http.StatusNotFound)
+		return
+	}
+	s.auditRequest(r, uid, AuditEntry{Action: "rep.delete", SubjectType: "rep", SubjectID: repID, Before: auditJSON(previous)})
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) PrivacyHandler(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("stub page. TL;DR: your info is not shared with anyone for any reason. This service is just used internally by Twilio as a side project. We will store your email address in our db as to identify you and relate your exercise totals to you."))
+	w.Write([]byte("stub page. TL;DR: your info is not shared with anyone for any reason. This service is just used internally by Twilio as a side project. We store your email address to identify you, along with the reps you log, your teams, goals, and notification preferences. Download everything we hold about you with GET /v3/me/data, and delete your account with DELETE /v3/me?confirm=true."))
+	w.Write([]byte(" After you delete your account, the audit log keeps that you made changes, what kind, and when, tied to your user id but with the details removed."))
+
+	switch {
+	case s.conf.BackupPath == "":
+		return
+	case s.conf.BackupInterval > 0:
+		days := int(math.Ceil((s.conf.BackupInterval * time.Duration(s.conf.BackupKeep)).Hours() / 24))
+		fmt.Fprintf(w, " Database backups are taken every %g hours and the newest %d are kept, so a full copy of your data stays in them for up to %d days after you delete your account.", s.conf.BackupInterval.Hours(), s.conf.BackupKeep, days)
+	default:
+		fmt.Fprintf(w, " Database backups are taken by admins as needed and the newest %d are kept, so a full copy of your data stays in them until newer backups replace them.", s.conf.BackupKeep)
+	}
 }
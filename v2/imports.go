@@ -0,0 +1,489 @@
+package countmyreps
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// maxImportBytes caps an uploaded CSV
+const maxImportBytes = 5 << 20
+
+// importDateFormats are the date formats accepted in the date column, and whether they are only a day. Days are logged
+// at noon UTC so they land on the same day in every timezone we have offices in
+var importDateFormats = []struct {
+	layout string
+	day    bool
+}{
+	{dayFormat, true},
+	{"1/2/2006", true},
+	{time.RFC3339, false},
+	{"2006-01-02 15:04:05", false},
+}
+
+// Import is a batch of reps added from a CSV. Its reps can be removed together by rolling it back
+type Import struct {
+	ID           int
+	UserID       int
+	Rows         int
+	CreatedOn    int
+	RolledBackOn int `json:",omitempty"`
+}
+
+// ImportReport is the outcome of an import. Nothing is imported unless Errors is empty, and nothing at all for a DryRun.
+// ID is the batch to roll back, 0 when nothing was imported
+type ImportReport struct {
+	ID     int `json:",omitempty"`
+	DryRun bool
+	Rows   int
+	Users  int
+	Errors []ImportError
+}
+
+// ImportError is a problem with one line of the CSV, counting the header as line 1
+type ImportError struct {
+	Line    int
+	Message string
+}
+
+type importRow struct {
+	email     string
+	exercise  Exercise
+	count     int
+	createdOn int
+}
+
+// ImportCSV imports reps for the command line. Rows without an email column are logged for email
+func (s *Server) ImportCSV(email string, r io.Reader, dryRun bool) (*ImportReport, error) {
+	report, err := s.importCSV(email, true, r, dryRun, time.Now())
+	if err == nil && report.ID != 0 {
+		s.audit(AuditEntry{Source: auditCLI, Action: "import.create", SubjectType: "import", SubjectID: report.ID, After: auditJSON(report)})
+	}
+	// the command exits next, so let subscribers award badges and queue webhooks first
+	s.events.wait()
+	return report, err
+}
+
+// RollbackImport removes an import's reps for the command line. It returns how many reps were removed, or -1 if there is no such import
+func (s *Server) RollbackImport(importID int) (int, error) {
+	removed, err := s.rollbackImport(importID)
+	if err == nil && removed >= 0 {
+		s.audit(AuditEntry{Source: auditCLI, Action: "import.rollback", SubjectType: "import", SubjectID: importID, After: auditJSON(struct{ Removed int }{removed})})
+	}
+	s.events.wait()
+	return removed, err
+}
+
+// importCSV reads a CSV with date, exercise, and count columns, and an optional email column that only admins can
+// use to import for someone other than email. Every row is checked before anything is written, and then every row is
+// written in one transaction, so an import either goes in whole or not at all
+func (s *Server) importCSV(email string, admin bool, r io.Reader, dryRun bool, now time.Time) (*ImportReport, error) {
+	exs, err := s.getExercises()
+	if err != nil {
+		return nil, err
+	}
+	catalog := make(map[string]Exercise)
+	for _, ex := range exs.Collection {
+		catalog[strings.ToLower(ex.Name)] = ex
+	}
+
+	report := &ImportReport{DryRun: dryRun, Errors: make([]ImportError, 0)}
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		report.Errors = append(report.Errors, ImportError{Line: 1, Message: "the CSV is empty"})
+		return report, nil
+	}
+	if err != nil {
+		report.Errors = append(report.Errors, ImportError{Line: 1, Message: err.Error()})
+		return report, nil
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"date", "exercise", "count"} {
+		if _, ok := columns[name]; !ok {
+			report.Errors = append(report.Errors, ImportError{Line: 1, Message: fmt.Sprintf("missing a %q column; the header needs date, exercise, and count", name)})
+		}
+	}
+	if len(report.Errors) > 0 {
+		return report, nil
+	}
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []importRow
+	users := make(map[string]bool)
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, ImportError{Line: line, Message: err.Error()})
+			// a malformed quote can leave the reader unable to find the next line
+			if _, ok := err.(*csv.ParseError); !ok {
+				break
+			}
+			continue
+		}
+
+		row := importRow{email: email}
+		if e := strings.ToLower(field(record, "email")); e != "" && !strings.EqualFold(e, email) {
+			if !admin {
+				report.Errors = append(report.Errors, ImportError{Line: line, Message: "only admins can import reps for someone else"})
+				continue
+			}
+			row.email = e
+		}
+
+		date := field(record, "date")
+		var at time.Time
+		var day bool
+		for _, format := range importDateFormats {
+			if at, err = time.Parse(format.layout, date); err == nil {
+				day = format.day
+				break
+			}
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, ImportError{Line: line, Message: fmt.Sprintf("date %q is not YYYY-MM-DD", date)})
+			continue
+		}
+		// a date without a time is the whole day, so today is never in the future even though it is stored at noon
+		if (day && at.After(now.UTC().Truncate(24*time.Hour))) || (!day && at.After(now)) {
+			report.Errors = append(report.Errors, ImportError{Line: line, Message: fmt.Sprintf("date %q is in the future", date)})
+			continue
+		}
+		if day {
+			at = at.Add(12 * time.Hour)
+		}
+		row.createdOn = int(at.Unix())
+
+		ex, ok := catalog[strings.ToLower(field(record, "exercise"))]
+		if !ok {
+			report.Errors = append(report.Errors, ImportError{Line: line, Message: fmt.Sprintf("unknown exercise %q; use one of GET /v3/exercises", field(record, "exercise"))})
+			continue
+		}
+		row.exercise = ex
+
+		row.count, err = strconv.Atoi(field(record, "count"))
+		if err != nil || row.count <= 0 {
+			report.Errors = append(report.Errors, ImportError{Line: line, Message: fmt.Sprintf("count %q is not a whole number above 0", field(record, "count"))})
+			continue
+		}
+
+		rows = append(rows, row)
+		users[row.email] = true
+	}
+
+	report.Rows, report.Users = len(rows), len(users)
+	if len(rows) == 0 && len(report.Errors) == 0 {
+		report.Errors = append(report.Errors, ImportError{Line: 2, Message: "there are no rows to import"})
+	}
+	if dryRun || len(report.Errors) > 0 {
+		return report, nil
+	}
+
+	report.ID, err = s.insertImport(email, rows, now)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// insertImport writes the batch and its reps in one transaction, creating any users that do not exist yet
+func (s *Server) insertImport(email string, rows []importRow, now time.Time) (int, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to begin insertImport: %w", err)
+	}
+
+	uids := make(map[string]int)
+	userID := func(email string) (int, error) {
+		if uid, ok := uids[email]; ok {
+			return uid, nil
+		}
+		var uid int
+		err := tx.QueryRow("select id from users where email=?", email).Scan(&uid)
+		if err == sql.ErrNoRows {
+			res, err := tx.Exec("insert into users (email) values (?)", email)
+			if err != nil {
+				return 0, fmt.Errorf("unable to insert user in insertImport: %w", err)
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return 0, fmt.Errorf("unable to get new user id in insertImport: %w", err)
+			}
+			uid = int(id)
+		} else if err != nil {
+			return 0, fmt.Errorf("unable to scan user in insertImport: %w", err)
+		}
+		uids[email] = uid
+		return uid, nil
+	}
+
+	importer, err := userID(email)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	res, err := tx.Exec("insert into imports (user_id, rows, created_on) values (?, ?, ?)", importer, len(rows), now.Unix())
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to insert import: %w", err)
+	}
+	importID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to get last insert id for import: %w", err)
+	}
+
+	q := "insert into reps (exercise_id, user_id, count, points, created_on, import_id) values (?, ?, ?, ?, ?, ?)"
+	for _, row := range rows {
+		uid, err := userID(row.email)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if _, err := tx.Exec(q, row.exercise.ID, uid, row.count, row.exercise.points(row.count), row.createdOn, importID); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("unable to insert imported reps: %w", err)
+		}
+	}
+
+	byUser, err := s.getImportReps(tx, int(importID))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit import: %w", err)
+	}
+
+	s.publishImportReps(byUser, false, now)
+	return int(importID), nil
+}
+
+// getImports lists imports newest first. If the uid is <0, list everyone's
+func (s *Server) getImports(uid int) ([]Import, error) {
+	return s.queryImports("where ?<0 or user_id=? order by id desc", uid, uid)
+}
+
+// getImport returns nil if there is no such import
+func (s *Server) getImport(importID int) (*Import, error) {
+	imports, err := s.queryImports("where id=?", importID)
+	if err != nil || len(imports) == 0 {
+		return nil, err
+	}
+	return &imports[0], nil
+}
+
+func (s *Server) queryImports(where string, args ...interface{}) ([]Import, error) {
+	rows, err := s.DB.Query("select id, user_id, rows, created_on, rolled_back_on from imports "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query imports: %w", err)
+	}
+	defer rows.Close()
+
+	imports := make([]Import, 0)
+	for rows.Next() {
+		var i Import
+		if err := rows.Scan(&i.ID, &i.UserID, &i.Rows, &i.CreatedOn, &i.RolledBackOn); err != nil {
+			return nil, fmt.Errorf("unable to scan imports: %w", err)
+		}
+		imports = append(imports, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning imports: %w", err)
+	}
+	return imports, nil
+}
+
+// rollbackImport deletes the import's reps. Reps edited since the import are removed too. It returns -1 if there is no such import
+func (s *Server) rollbackImport(importID int) (int, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to begin rollbackImport: %w", err)
+	}
+
+	res, err := tx.Exec("update imports set rolled_back_on=? where id=? and rolled_back_on=0", time.Now().Unix(), importID)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to update rollbackImport: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return 0, fmt.Errorf("unable to get rows affected for rollbackImport: %w", err)
+		}
+		return -1, nil
+	}
+
+	byUser, err := s.getImportReps(tx, importID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	res, err = tx.Exec("delete from reps where import_id=?", importID)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to delete reps in rollbackImport: %w", err)
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to get removed reps for rollbackImport: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit rollbackImport: %w", err)
+	}
+
+	s.publishImportReps(byUser, true, time.Now())
+	return int(removed), nil
+}
+
+// getImportReps groups an import's reps by user
+func (s *Server) getImportReps(tx *sql.Tx, importID int) (map[int][]Rep, error) {
+	rows, err := tx.Query("select id, user_id, exercise_id, count, points, created_on from reps where import_id=? order by created_on, id", importID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getImportReps: %w", err)
+	}
+	defer rows.Close()
+
+	byUser := make(map[int][]Rep)
+	for rows.Next() {
+		var rep Rep
+		var uid int
+		if err := rows.Scan(&rep.ID, &uid, &rep.ExerciseID, &rep.Count, &rep.points, &rep.CreatedOn); err != nil {
+			return nil, fmt.Errorf("unable to scan getImportReps: %w", err)
+		}
+		ex, _ := s.getExerciseByID(rep.ExerciseID)
+		rep.Name, rep.ValueType, rep.Points = ex.Name, ex.ValueType, roundPoints(rep.points)
+		byUser[uid] = append(byUser[uid], rep)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getImportReps: %w", err)
+	}
+	return byUser, nil
+}
+
+// publishImportReps publishes what an import added, one RepsLogged per user like postStats, or what rolling it back removed,
+// one RepsDeleted per user. An import for many people waits for subscribers as it goes, so none of its events are dropped
+// for a full queue
+func (s *Server) publishImportReps(byUser map[int][]Rep, removed bool, at time.Time) {
+	queued := 0
+	for uid, reps := range byUser {
+		if removed {
+			s.events.publish(RepsDeleted{UserID: uid, Previous: reps, At: at})
+		} else {
+			s.events.publish(RepsLogged{UserID: uid, Reps: reps, At: at})
+		}
+		queued++
+		if queued >= eventQueueSize/2 {
+			s.events.wait()
+			queued = 0
+		}
+	}
+}
+
+// PostImports imports reps from a CSV request body with date, exercise, and count columns. Admins can add an email column.
+// Options: ?dry_run=true to only check the CSV. Responds 201 with the report, or 400 with the report when there are errors
+func (s *Server) PostImports(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	email := r.Context().Value(ctxEmail).(string)
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	report, err := s.importCSV(email, s.isAdmin(r), http.MaxBytesReader(w, r.Body, maxImportBytes), dryRun, time.Now())
+	if err != nil {
+		log.Printf("unable to PostImports: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if report.ID != 0 {
+		s.auditRequest(r, uid, AuditEntry{Action: "import.create", SubjectType: "import", SubjectID: report.ID, After: auditJSON(report)})
+	}
+
+	switch {
+	case len(report.Errors) > 0:
+		w.WriteHeader(http.StatusBadRequest)
+	case !dryRun:
+		w.WriteHeader(http.StatusCreated)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Println("PostImports marshal err ", err.Error())
+	}
+}
+
+// GetImports lists your imports. Admins see every import
+func (s *Server) GetImports(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	if s.isAdmin(r) {
+		uid = -1
+	}
+
+	data, err := s.getImports(uid)
+	if err != nil {
+		log.Printf("unable to GetImports: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Imports []Import }{data}); err != nil {
+		log.Println("GetImports marshal err ", err.Error())
+	}
+}
+
+// DeleteImport rolls back one of your imports, removing its reps. Admins can roll back any import
+func (s *Server) DeleteImport(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	importID, err := strconv.Atoi(chi.URLParam(r, "importID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	i, err := s.getImport(importID)
+	if err != nil {
+		log.Printf("unable to DeleteImport: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if i == nil || i.RolledBackOn != 0 || (i.UserID != uid && !s.isAdmin(r)) {
+		http.Error(w, "import not found", http.StatusNotFound)
+		return
+	}
+
+	removed, err := s.rollbackImport(importID)
+	if err != nil {
+		log.Printf("unable to DeleteImport: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if removed < 0 {
+		http.Error(w, "import not found", http.StatusNotFound)
+		return
+	}
+	s.auditRequest(r, i.UserID, AuditEntry{Action: "import.rollback", SubjectType: "import", SubjectID: importID, Before: auditJSON(i), After: auditJSON(struct{ Removed int }{removed})})
+	if err := json.NewEncoder(w).Encode(struct{ Removed int }{removed}); err != nil {
+		log.Println("DeleteImport marshal err ", err.Error())
+	}
+}
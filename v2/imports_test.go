@@ -0,0 +1,185 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportCSV(t *testing.T) {
+	s, _ := newTestServer(t)
+	now := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	uid := mustCreateUser(t, s, "lifter@twilio.com")
+
+	bad := `Date,Exercise,Count
+2020-11-02,push ups,20
+2020-11-03,Jumping Jacks,10
+11/4/2020,Squats,-5
+yesterday,Squats,5
+2020-12-25,Squats,5
+2020-11-05,Squats,5,extra
+`
+	report, err := s.importCSV("lifter@twilio.com", false, strings.NewReader(bad), false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, e := range report.Errors {
+		lines = append(lines, e.Line)
+	}
+	if got, want := fmt.Sprint(lines), "[3 4 5 6]"; got != want {
+		t.Errorf("got errors on lines %s, want %s: %+v", got, want, report.Errors)
+	}
+	if got, want := report.ID, 0; got != want {
+		t.Errorf("got import %d with errors, want nothing imported", got)
+	}
+	reps, _ := s.getReps(uid, 0, int(now.Unix()))
+	if got := len(reps); got != 0 {
+		t.Fatalf("got %d reps after a failed import, want none", got)
+	}
+
+	good := `date,exercise,count
+2020-11-02,push ups,20
+11/4/2020,Squats,15
+2020-11-05T07:30:00Z,Running,3000
+`
+	report, err = s.importCSV("lifter@twilio.com", false, strings.NewReader(good), true, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(report.Errors), 0; got != want {
+		t.Fatalf("got %d errors, want %d: %+v", got, want, report.Errors)
+	}
+	if got, want := report.Rows, 3; got != want {
+		t.Errorf("got %d dry run rows, want %d", got, want)
+	}
+	reps, _ = s.getReps(uid, 0, int(now.Unix()))
+	if got := len(reps); got != 0 {
+		t.Fatalf("got %d reps after a dry run, want none", got)
+	}
+
+	report, err = s.importCSV("lifter@twilio.com", false, strings.NewReader(good), false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ID == 0 {
+		t.Fatalf("got no import id, errors %+v", report.Errors)
+	}
+	reps, _ = s.getReps(uid, 0, int(now.Unix()))
+	if got, want := len(reps), 3; got != want {
+		t.Fatalf("got %d reps, want %d", got, want)
+	}
+	// days without a time are logged at noon UTC
+	if got, want := reps[1].CreatedOn, int(time.Date(2020, 11, 4, 12, 0, 0, 0, time.UTC).Unix()); got != want {
+		t.Errorf("got created on %d, want %d", got, want)
+	}
+	// imported reps are published like logged ones
+	s.events.wait()
+	achievements, err := s.getAchievements(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(achievements) == 0 || achievements[0].ID != "first-rep" {
+		t.Errorf("got achievements %+v after an import, want first-rep", achievements)
+	}
+	mustInsertReps(t, s, uid, "Push Ups", 10, now)
+
+	hook := &Webhook{URL: "http://localhost/hook", Events: []string{webhookRepDeleted}}
+	if err := s.postWebhooks(uid, hook); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := s.rollbackImport(report.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.events.wait()
+	if deliveries, _ := s.getWebhookDeliveries(hook.ID, 10); len(deliveries) != 1 {
+		t.Fatalf("got %d rep.deleted deliveries after the rollback, want one for the whole rollback", len(deliveries))
+	}
+	var payload string
+	if err := s.DB.QueryRow("select payload from webhook_deliveries where webhook_id=?", hook.ID).Scan(&payload); err != nil {
+		t.Fatal(err)
+	}
+	var p WebhookPayload
+	if err := json.Unmarshal([]byte(payload), &p); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(p.PreviousReps), 3; got != want {
+		t.Errorf("got %d reps in the rollback delivery, want %d", got, want)
+	}
+	if got, want := removed, 3; got != want {
+		t.Errorf("got %d removed, want %d", got, want)
+	}
+	reps, _ = s.getReps(uid, 0, int(now.Unix()))
+	if got, want := len(reps), 1; got != want {
+		t.Errorf("got %d reps after the rollback, want the %d logged by hand", got, want)
+	}
+	if removed, _ := s.rollbackImport(report.ID); removed != -1 {
+		t.Errorf("got %d rolling back twice, want -1", removed)
+	}
+
+	// today is not in the future before noon, tomorrow and a time later today are
+	morning := time.Date(2020, 11, 20, 8, 0, 0, 0, time.UTC)
+	today := `date,exercise,count
+2020-11-20,Squats,5
+2020-11-21,Squats,5
+2020-11-20T09:00:00Z,Squats,5
+`
+	report, err = s.importCSV("lifter@twilio.com", false, strings.NewReader(today), true, morning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = nil
+	for _, e := range report.Errors {
+		lines = append(lines, e.Line)
+	}
+	if got, want := fmt.Sprint(lines), "[3 4]"; got != want {
+		t.Errorf("got errors on lines %s importing on the morning of the 20th, want %s: %+v", got, want, report.Errors)
+	}
+}
+
+func TestImportEndpoints(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.conf.Admins = []string{"admin@twilio.com"}
+	lifter := newTestClient(t, s, "lifter@twilio.com")
+	admin := newTestClient(t, s, "admin@twilio.com")
+
+	csv := "email,date,exercise,count\nnewbie@twilio.com,2020-11-02,Burpees,12\n"
+	if got, want := lifter.do("POST", "/v3/imports", csv).Code, http.StatusBadRequest; got != want {
+		t.Errorf("got %d importing for someone else, want %d", got, want)
+	}
+
+	w := admin.do("POST", "/v3/imports", csv)
+	if got, want := w.Code, http.StatusCreated; got != want {
+		t.Fatalf("got %d, want %d: %s", got, want, w.Body)
+	}
+	var report ImportReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := report.Users, 1; got != want {
+		t.Errorf("got %d users, want %d", got, want)
+	}
+
+	path := fmt.Sprintf("/v3/imports/%d", report.ID)
+	if got, want := lifter.do("DELETE", path, "").Code, http.StatusNotFound; got != want {
+		t.Errorf("got %d rolling back someone else's import, want %d", got, want)
+	}
+	if got, want := admin.do("DELETE", path, "").Code, http.StatusOK; got != want {
+		t.Errorf("got %d rolling back, want %d", got, want)
+	}
+
+	var data struct{ Imports []Import }
+	if err := json.NewDecoder(admin.do("GET", "/v3/imports", "").Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(data.Imports), 1; got != want {
+		t.Fatalf("got %d imports, want %d", got, want)
+	}
+	if data.Imports[0].RolledBackOn == 0 {
+		t.Errorf("got an import that was not marked rolled back")
+	}
+}
@@ -0,0 +1,509 @@
+package countmyreps
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// public teams are listed and anyone can join. private teams are listed, but joining asks the owner.
+// invite-only teams are only listed for their members, and the only way in is an invite
+const (
+	teamPublic     = "public"
+	teamPrivate    = "private"
+	teamInviteOnly = "invite-only"
+)
+
+const (
+	joinPending  = "pending"
+	joinApproved = "approved"
+	joinRejected = "rejected"
+)
+
+const (
+	// inviteDays is how long an invite lasts unless the owner says otherwise, and maxInviteDays is the longest allowed
+	inviteDays    = 7
+	maxInviteDays = 30
+)
+
+// TeamInvite is a code that lets anyone who has it join the team until it expires
+type TeamInvite struct {
+	Code      string
+	TeamID    int
+	ExpiresOn int
+	CreatedOn int
+}
+
+// JoinRequest is someone asking to join a private team
+type JoinRequest struct {
+	ID        int
+	TeamID    int
+	UserID    int
+	Email     string
+	Status    string
+	CreatedOn int
+	DecidedOn int `json:",omitempty"`
+}
+
+// TeamMember is someone on the team, as seen by the team owner
+type TeamMember struct {
+	UserID int
+	Email  string
+}
+
+// inviteCode is url safe so it can be dropped straight into a link
+func inviteCode() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *Server) putTeamVisibility(teamID int, visibility string) error {
+	if _, err := s.DB.Exec("update teams set visibility=? where id=?", visibility, teamID); err != nil {
+		return fmt.Errorf("unable to putTeamVisibility: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) isTeamMember(teamID, uid int) (bool, error) {
+	var count int
+	if err := s.DB.QueryRow("select count(*) from user_teams where team_id=? and user_id=?", teamID, uid).Scan(&count); err != nil {
+		return false, fmt.Errorf("unable to scan isTeamMember: %w", err)
+	}
+	return count > 0, nil
+}
+
+// getHiddenTeams are the invite-only teams the user is neither on nor owns
+func (s *Server) getHiddenTeams(uid int) ([]int, error) {
+	q := "select id from teams where visibility=? and created_by_user_id!=? and id not in (select team_id from user_teams where user_id=?)"
+	rows, err := s.DB.Query(q, teamInviteOnly, uid, uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getHiddenTeams: %w", err)
+	}
+	defer rows.Close()
+
+	var hidden []int
+	for rows.Next() {
+		var teamID int
+		if err := rows.Scan(&teamID); err != nil {
+			return nil, fmt.Errorf("unable to scan getHiddenTeams: %w", err)
+		}
+		hidden = append(hidden, teamID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getHiddenTeams: %w", err)
+	}
+	return hidden, nil
+}
+
+// isTeamHidden is true when the team is invite-only and the caller, who is not an admin, is neither on it nor owns it
+func (s *Server) isTeamHidden(r *http.Request, teamID int) (bool, error) {
+	if s.isAdmin(r) {
+		return false, nil
+	}
+	hidden, err := s.getHiddenTeams(r.Context().Value(ctxUID).(int))
+	if err != nil {
+		return false, err
+	}
+	return inIntList(teamID, hidden), nil
+}
+
+func (s *Server) postTeamInvite(teamID, uid int, expires time.Time) (*TeamInvite, error) {
+	invite := &TeamInvite{Code: inviteCode(), TeamID: teamID, ExpiresOn: int(expires.Unix()), CreatedOn: int(time.Now().Unix())}
+	q := "insert into team_invites (team_id, code, created_by_user_id, expires_on, created_on) values (?, ?, ?, ?, ?)"
+	if _, err := s.DB.Exec(q, invite.TeamID, invite.Code, uid, invite.ExpiresOn, invite.CreatedOn); err != nil {
+		return nil, fmt.Errorf("unable to postTeamInvite: %w", err)
+	}
+	return invite, nil
+}
+
+// getTeamInvites are the team's invites that have not expired
+func (s *Server) getTeamInvites(teamID int, now time.Time) ([]TeamInvite, error) {
+	q := "select code, team_id, expires_on, created_on from team_invites where team_id=? and expires_on>? order by created_on"
+	rows, err := s.DB.Query(q, teamID, now.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getTeamInvites: %w", err)
+	}
+	defer rows.Close()
+
+	invites := make([]TeamInvite, 0)
+	for rows.Next() {
+		var invite TeamInvite
+		if err := rows.Scan(&invite.Code, &invite.TeamID, &invite.ExpiresOn, &invite.CreatedOn); err != nil {
+			return nil, fmt.Errorf("unable to scan getTeamInvites: %w", err)
+		}
+		invites = append(invites, invite)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getTeamInvites: %w", err)
+	}
+	return invites, nil
+}
+
+// getTeamInvite returns nil if there is no such invite. Expired invites are still returned
+func (s *Server) getTeamInvite(code string) (*TeamInvite, error) {
+	var invite TeamInvite
+	q := "select code, team_id, expires_on, created_on from team_invites where code=?"
+	err := s.DB.QueryRow(q, code).Scan(&invite.Code, &invite.TeamID, &invite.ExpiresOn, &invite.CreatedOn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan getTeamInvite: %w", err)
+	}
+	return &invite, nil
+}
+
+// deleteTeamInvite returns false if the team has no such invite
+func (s *Server) deleteTeamInvite(teamID int, code string) (bool, error) {
+	res, err := s.DB.Exec("delete from team_invites where team_id=? and code=?", teamID, code)
+	if err != nil {
+		return false, fmt.Errorf("unable to deleteTeamInvite: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// postJoinRequest asks to join the team. Asking again while a request is pending returns that request;
+// asking again after a rejection starts a new one
+func (s *Server) postJoinRequest(teamID, uid int) (*JoinRequest, error) {
+	existing, err := s.queryJoinRequests("where team_id=? and user_id=? and status=?", teamID, uid, joinPending)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return &existing[0], nil
+	}
+
+	q := "insert or replace into team_join_requests (team_id, user_id, status, created_on, decided_on) values (?, ?, ?, ?, 0)"
+	res, err := s.DB.Exec(q, teamID, uid, joinPending, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("unable to postJoinRequest: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get last insert id for join request: %w", err)
+	}
+
+	requests, err := s.queryJoinRequests("where team_join_requests.id=?", id)
+	if err != nil || len(requests) == 0 {
+		return nil, err
+	}
+	return &requests[0], nil
+}
+
+func (s *Server) getJoinRequests(teamID int) ([]JoinRequest, error) {
+	return s.queryJoinRequests("where team_id=? and status=? order by team_join_requests.created_on", teamID, joinPending)
+}
+
+func (s *Server) queryJoinRequests(where string, args ...interface{}) ([]JoinRequest, error) {
+	q := "select team_join_requests.id, team_id, user_id, coalesce(users.email, ''), status, team_join_requests.created_on, decided_on from team_join_requests left join users on users.id=team_join_requests.user_id " + where
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query join requests: %w", err)
+	}
+	defer rows.Close()
+
+	requests := make([]JoinRequest, 0)
+	for rows.Next() {
+		var jr JoinRequest
+		if err := rows.Scan(&jr.ID, &jr.TeamID, &jr.UserID, &jr.Email, &jr.Status, &jr.CreatedOn, &jr.DecidedOn); err != nil {
+			return nil, fmt.Errorf("unable to scan join requests: %w", err)
+		}
+		requests = append(requests, jr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning join requests: %w", err)
+	}
+	return requests, nil
+}
+
+// decideJoinRequest approves or rejects a pending request. It returns nil if the team has no such pending request
+func (s *Server) decideJoinRequest(teamID, requestID int, approve bool) (*JoinRequest, error) {
+	requests, err := s.queryJoinRequests("where team_join_requests.id=? and team_id=? and status=?", requestID, teamID, joinPending)
+	if err != nil || len(requests) == 0 {
+		return nil, err
+	}
+	jr := &requests[0]
+
+	jr.Status, jr.DecidedOn = joinRejected, int(time.Now().Unix())
+	if approve {
+		jr.Status = joinApproved
+		if err := s.postMyTeams(teamID, jr.UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := s.DB.Exec("update team_join_requests set status=?, decided_on=? where id=?", jr.Status, jr.DecidedOn, jr.ID); err != nil {
+		return nil, fmt.Errorf("unable to decideJoinRequest: %w", err)
+	}
+	return jr, nil
+}
+
+// joinWithInvite adds the user to the invite's team, and settles any request they had pending
+func (s *Server) joinWithInvite(invite *TeamInvite, uid int) error {
+	if err := s.postMyTeams(invite.TeamID, uid); err != nil {
+		return err
+	}
+	q := "update team_join_requests set status=?, decided_on=? where team_id=? and user_id=? and status=?"
+	if _, err := s.DB.Exec(q, joinApproved, time.Now().Unix(), invite.TeamID, uid, joinPending); err != nil {
+		return fmt.Errorf("unable to settle join request for invite: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) getTeamMembers(teamID int) ([]TeamMember, error) {
+	q := "select distinct user_teams.user_id, coalesce(users.email, '') from user_teams left join users on users.id=user_teams.user_id where user_teams.team_id=? order by users.email"
+	rows, err := s.DB.Query(q, teamID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getTeamMembers: %w", err)
+	}
+	defer rows.Close()
+
+	members := make([]TeamMember, 0)
+	for rows.Next() {
+		var m TeamMember
+		if err := rows.Scan(&m.UserID, &m.Email); err != nil {
+			return nil, fmt.Errorf("unable to scan getTeamMembers: %w", err)
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getTeamMembers: %w", err)
+	}
+	return members, nil
+}
+
+// GetTeamInvites lists the team's invites that have not expired. Team owners only
+func (s *Server) GetTeamInvites(w http.ResponseWriter, r *http.Request) {
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := s.getTeamInvites(teamID, time.Now())
+	if err != nil {
+		log.Printf("unable to GetTeamInvites: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Invites []TeamInvite }{data}); err != nil {
+		log.Println("GetTeamInvites marshal err ", err.Error())
+	}
+}
+
+// PostTeamInvites makes a new invite. Team owners only. Body: {"Days": 7}, optional
+func (s *Server) PostTeamInvites(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := struct{ Days int }{Days: inviteDays}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Days < 1 || req.Days > maxInviteDays {
+		http.Error(w, fmt.Sprintf("Days must be between 1 and %d", maxInviteDays), http.StatusBadRequest)
+		return
+	}
+
+	invite, err := s.postTeamInvite(teamID, uid, time.Now().AddDate(0, 0, req.Days))
+	if err != nil {
+		log.Printf("unable to PostTeamInvites: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(invite); err != nil {
+		log.Println("PostTeamInvites marshal err ", err.Error())
+	}
+}
+
+// DeleteTeamInvite revokes an invite. Team owners only
+func (s *Server) DeleteTeamInvite(w http.ResponseWriter, r *http.Request) {
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+
+	found, err := s.deleteTeamInvite(teamID, chi.URLParam(r, "code"))
+	if err != nil {
+		log.Printf("unable to DeleteTeamInvite: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "invite not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PostInvite joins the team the invite is for, whatever the team's visibility
+func (s *Server) PostInvite(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+
+	invite, err := s.getTeamInvite(chi.URLParam(r, "code"))
+	if err != nil {
+		log.Printf("unable to PostInvite: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if invite == nil {
+		http.Error(w, "invite not found", http.StatusNotFound)
+		return
+	}
+	if int64(invite.ExpiresOn) <= time.Now().Unix() {
+		http.Error(w, "invite expired; ask the team owner for a new one", http.StatusGone)
+		return
+	}
+
+	member, err := s.isTeamMember(invite.TeamID, uid)
+	if err != nil {
+		log.Printf("unable to PostInvite: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.joinWithInvite(invite, uid); err != nil {
+		log.Printf("unable to PostInvite: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !member {
+		s.auditRequest(r, uid, AuditEntry{Action: "team.join", SubjectType: "team", SubjectID: invite.TeamID, After: auditJSON(auditMember{uid})})
+	}
+
+	team, err := s.getTeamByID(invite.TeamID)
+	if err != nil {
+		log.Printf("unable to PostInvite: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(team); err != nil {
+		log.Println("PostInvite marshal err ", err.Error())
+	}
+}
+
+// GetJoinRequests lists the pending requests to join the team. Team owners only
+func (s *Server) GetJoinRequests(w http.ResponseWriter, r *http.Request) {
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := s.getJoinRequests(teamID)
+	if err != nil {
+		log.Printf("unable to GetJoinRequests: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Requests []JoinRequest }{data}); err != nil {
+		log.Println("GetJoinRequests marshal err ", err.Error())
+	}
+}
+
+func (s *Server) PostApproveJoinRequest(w http.ResponseWriter, r *http.Request) {
+	s.decideJoinRequestHandler(w, r, true)
+}
+
+func (s *Server) PostRejectJoinRequest(w http.ResponseWriter, r *http.Request) {
+	s.decideJoinRequestHandler(w, r, false)
+}
+
+// decideJoinRequestHandler is for team owners only
+func (s *Server) decideJoinRequestHandler(w http.ResponseWriter, r *http.Request, approve bool) {
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+	requestID, err := strconv.Atoi(chi.URLParam(r, "requestID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jr, err := s.decideJoinRequest(teamID, requestID, approve)
+	if err != nil {
+		log.Printf("unable to decide join request: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if jr == nil {
+		http.Error(w, "pending join request not found", http.StatusNotFound)
+		return
+	}
+	if approve {
+		s.teamAuditRequest(r, teamID, AuditEntry{Action: "team.join", SubjectType: "team", SubjectID: teamID, After: auditJSON(auditMember{jr.UserID})})
+	}
+	if err := json.NewEncoder(w).Encode(jr); err != nil {
+		log.Println("decideJoinRequestHandler marshal err ", err.Error())
+	}
+}
+
+// GetTeamMembers lists who is on the team. Team owners only
+func (s *Server) GetTeamMembers(w http.ResponseWriter, r *http.Request) {
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := s.getTeamMembers(teamID)
+	if err != nil {
+		log.Printf("unable to GetTeamMembers: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Members []TeamMember }{data}); err != nil {
+		log.Println("GetTeamMembers marshal err ", err.Error())
+	}
+}
+
+// DeleteTeamMember removes someone from the team. Team owners only
+func (s *Server) DeleteTeamMember(w http.ResponseWriter, r *http.Request) {
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	member, err := s.isTeamMember(teamID, userID)
+	if err != nil {
+		log.Printf("unable to DeleteTeamMember: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.deleteMyTeams(teamID, userID); err != nil {
+		log.Printf("unable to DeleteTeamMember: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if member {
+		s.teamAuditRequest(r, teamID, AuditEntry{Action: "team.leave", SubjectType: "team", SubjectID: teamID, Before: auditJSON(auditMember{userID})})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
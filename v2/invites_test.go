@@ -0,0 +1,233 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrivateTeamJoinRequests(t *testing.T) {
+	s, _ := newTestServer(t)
+	owner := newTestClient(t, s, "owner@twilio.com")
+	joiner := newTestClient(t, s, "joiner@twilio.com")
+
+	team, err := s.postTeam("Secret Squirrels", owner.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	teamPath := fmt.Sprintf("/v3/teams/%d", team.ID)
+
+	if w := joiner.do("PUT", teamPath, `{"Visibility": "private"}`); w.Code != http.StatusForbidden {
+		t.Errorf("got %d for a non owner changing visibility, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := owner.do("PUT", teamPath, `{"Visibility": "secret"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for an unknown visibility, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := owner.do("PUT", teamPath, `{"Visibility": "private"}`); w.Code != http.StatusOK {
+		t.Fatalf("got %d setting visibility, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	w := joiner.do("POST", fmt.Sprintf("/v3/myteams/%d", team.ID), "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d joining a private team, want %d", w.Code, http.StatusAccepted)
+	}
+	var jr JoinRequest
+	if err := json.NewDecoder(w.Body).Decode(&jr); err != nil {
+		t.Fatal(err)
+	}
+	if member, _ := s.isTeamMember(team.ID, joiner.UID); member {
+		t.Fatalf("got a member before the owner approved")
+	}
+
+	// asking twice is the same request
+	w = joiner.do("POST", fmt.Sprintf("/v3/myteams/%d", team.ID), "")
+	var again JoinRequest
+	json.NewDecoder(w.Body).Decode(&again)
+	if again.ID != jr.ID {
+		t.Errorf("got request %d asking again, want %d", again.ID, jr.ID)
+	}
+
+	if w := joiner.do("POST", fmt.Sprintf("%s/requests/%d/approve", teamPath, jr.ID), ""); w.Code != http.StatusForbidden {
+		t.Errorf("got %d approving your own request, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := owner.do("POST", fmt.Sprintf("%s/requests/%d/approve", teamPath, jr.ID), ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d approving, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if member, _ := s.isTeamMember(team.ID, joiner.UID); !member {
+		t.Errorf("got no membership after approval")
+	}
+	if w := owner.do("POST", fmt.Sprintf("%s/requests/%d/reject", teamPath, jr.ID), ""); w.Code != http.StatusNotFound {
+		t.Errorf("got %d deciding a request twice, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// owners can remove members
+	if w := owner.do("DELETE", fmt.Sprintf("%s/members/%d", teamPath, joiner.UID), ""); w.Code != http.StatusNoContent {
+		t.Fatalf("got %d removing a member, want %d", w.Code, http.StatusNoContent)
+	}
+	if member, _ := s.isTeamMember(team.ID, joiner.UID); member {
+		t.Errorf("got a member after removal")
+	}
+
+	// and a rejected request leaves them off the team
+	w = joiner.do("POST", fmt.Sprintf("/v3/myteams/%d", team.ID), "")
+	json.NewDecoder(w.Body).Decode(&jr)
+	if w := owner.do("POST", fmt.Sprintf("%s/requests/%d/reject", teamPath, jr.ID), ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d rejecting, want %d", w.Code, http.StatusOK)
+	}
+	if member, _ := s.isTeamMember(team.ID, joiner.UID); member {
+		t.Errorf("got a member after rejection")
+	}
+}
+
+func TestInviteOnlyTeams(t *testing.T) {
+	s, _ := newTestServer(t)
+	owner := newTestClient(t, s, "owner@twilio.com")
+	outsider := newTestClient(t, s, "outsider@twilio.com")
+
+	team, err := s.postTeam("Invite Only", owner.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.putTeamVisibility(team.ID, teamInviteOnly); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := func(c *testClient) bool {
+		var data Teams
+		if err := json.NewDecoder(c.do("GET", "/v3/teams", "").Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		for _, tm := range data.Collection {
+			if tm.ID == team.ID {
+				return true
+			}
+		}
+		return false
+	}
+	if !listed(owner) {
+		t.Errorf("got the team hidden from its owner")
+	}
+	if listed(outsider) {
+		t.Errorf("got the team listed for an outsider")
+	}
+	if w := outsider.do("POST", fmt.Sprintf("/v3/myteams/%d", team.ID), ""); w.Code != http.StatusNotFound {
+		t.Errorf("got %d joining without an invite, want %d", w.Code, http.StatusNotFound)
+	}
+
+	expired, err := s.postTeamInvite(team.ID, owner.UID, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := outsider.do("POST", "/v3/invites/"+expired.Code, ""); w.Code != http.StatusGone {
+		t.Errorf("got %d for an expired invite, want %d", w.Code, http.StatusGone)
+	}
+
+	w := owner.do("POST", fmt.Sprintf("/v3/teams/%d/invites", team.ID), `{"Days": 3}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d creating an invite, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var invite TeamInvite
+	if err := json.NewDecoder(w.Body).Decode(&invite); err != nil {
+		t.Fatal(err)
+	}
+	if w := outsider.do("POST", "/v3/invites/"+invite.Code, ""); w.Code != http.StatusCreated {
+		t.Fatalf("got %d using an invite, want %d", w.Code, http.StatusCreated)
+	}
+	if !listed(outsider) {
+		t.Errorf("got the team hidden from a member")
+	}
+
+	if w := owner.do("DELETE", fmt.Sprintf("/v3/teams/%d/invites/%s", team.ID, invite.Code), ""); w.Code != http.StatusNoContent {
+		t.Errorf("got %d revoking an invite, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := outsider.do("POST", "/v3/invites/"+invite.Code, ""); w.Code != http.StatusNotFound {
+		t.Errorf("got %d for a revoked invite, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestInviteOnlyTeamsOffLeaderboards(t *testing.T) {
+	s, _ := newTestServer(t)
+	day := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+	owner := newTestClient(t, s, "owner@twilio.com")
+	outsider := newTestClient(t, s, "outsider@twilio.com")
+
+	team, err := s.postTeam("Secret Squad", owner.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.putTeamVisibility(team.ID, teamInviteOnly); err != nil {
+		t.Fatal(err)
+	}
+	mustInsertReps(t, s, owner.UID, "Push Ups", 20, day)
+
+	_, rankings, err := s.streamStandings(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rank := range rankings {
+		if rank.TeamID == team.ID {
+			t.Errorf("got the invite-only team ranked in the stream snapshot")
+		}
+	}
+	if text := s.slackLeaderboard().Text; strings.Contains(text, team.Name) {
+		t.Errorf("got the invite-only team on the slack leaderboard: %s", text)
+	}
+
+	for _, path := range []string{"/v3/teams/%d/summary", "/v3/stats/team/%d", "/v3/teams/%d/goals"} {
+		path = fmt.Sprintf(path, team.ID)
+		if w := outsider.do("GET", path, ""); w.Code != http.StatusNotFound {
+			t.Errorf("got %d for %s as an outsider, want %d", w.Code, path, http.StatusNotFound)
+		}
+		if w := owner.do("GET", path, ""); w.Code != http.StatusOK {
+			t.Errorf("got %d for %s as the owner, want %d", w.Code, path, http.StatusOK)
+		}
+	}
+}
+
+func TestInviteOnlyTeamsOffChallenges(t *testing.T) {
+	s, _ := newTestServer(t)
+	owner := newTestClient(t, s, "owner@twilio.com")
+	outsider := newTestClient(t, s, "outsider@twilio.com")
+
+	open, err := s.postTeam("Open Team", outsider.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	team, err := s.postTeam("Secret Squad", owner.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.putTeamVisibility(team.ID, teamInviteOnly); err != nil {
+		t.Fatal(err)
+	}
+	c := &Challenge{Name: "Push Off", Start: "2020-11-10", End: "2020-11-12"}
+	if err := s.postChallenge(outsider.UID, open.ID, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.joinChallenge(c.ID, team.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/v3/challenges", fmt.Sprintf("/v3/challenges/%d", c.ID), fmt.Sprintf("/v3/challenges/%d/scoreboard", c.ID)} {
+		if body := outsider.do("GET", path, "").Body.String(); strings.Contains(body, team.Name) {
+			t.Errorf("got the invite-only team in %s for an outsider: %s", path, body)
+		}
+		if body := owner.do("GET", path, "").Body.String(); !strings.Contains(body, team.Name) {
+			t.Errorf("got the invite-only team missing from %s for its owner: %s", path, body)
+		}
+	}
+
+	w := outsider.do("POST", "/v3/teams", `{"Name": "Secret Squad"}`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("got %d posting an invite-only team's name, want %d", w.Code, http.StatusConflict)
+	}
+	if strings.Contains(w.Body.String(), fmt.Sprintf(`"ID":%d`, team.ID)) {
+		t.Errorf("got the invite-only team handed back: %s", w.Body)
+	}
+	if member, _ := s.isTeamMember(team.ID, outsider.UID); member {
+		t.Errorf("got the outsider on the invite-only team")
+	}
+}
@@ -0,0 +1,447 @@
+package countmyreps
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/sethgrid/countmyreps/v2/teamname"
+)
+
+// importSourceV1 marks the import batch holding reps copied from v1, so the copy is only done once
+const importSourceV1 = "v1"
+
+// V1Report reconciles a copy of v1's MySQL data into v2. Offices become teams like any other v1 team.
+// Reconciled is true when every v1 rep is accounted for, either copied or skipped
+type V1Report struct {
+	ImportID int `json:",omitempty"`
+	DryRun   bool
+
+	Users        int
+	UsersCreated int
+	Offices      int
+	Teams        int
+	TeamsCreated int
+	Memberships  int
+	// MembershipsAdded leaves out people who were already on the team in v2
+	MembershipsAdded int
+
+	Exercises  []V1ExerciseTotals
+	Reconciled bool
+}
+
+// V1ExerciseTotals compares a v2 exercise before and after the copy. V1Exercises are the v1 names that became it.
+// Exercise is empty for a v1 name with no v2 match, whose reps are all skipped. Reps without a timestamp are skipped too
+type V1ExerciseTotals struct {
+	Exercise       string
+	V1Exercises    []string
+	V1Entries      int
+	V1Count        int
+	V2Entries      int
+	V2Count        int
+	SkippedEntries int
+	SkippedCount   int
+}
+
+// v1ExerciseKey matches v1 exercise names to v2's by their letters alone, so "Pull Ups", "pullups", and "pull-ups" are the same
+func v1ExerciseKey(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// MigrateV1 copies v1's users, offices, teams, memberships, and reps into v2 in one transaction. The reps are an import
+// batch, so they can be rolled back with RollbackImport; users and teams stay. A dry run, or a copy whose totals do not
+// reconcile, does all the work and reports it, then rolls it back. It refuses to run again while a copy is in place
+func (s *Server) MigrateV1(v1 *sql.DB, dryRun bool) (*V1Report, error) {
+	var previous int
+	if err := s.DB.QueryRow("select count(*) from imports where source=? and rolled_back_on=0", importSourceV1).Scan(&previous); err != nil {
+		return nil, fmt.Errorf("unable to scan MigrateV1 previous imports: %w", err)
+	}
+	if previous > 0 {
+		return nil, fmt.Errorf("v1 has already been migrated; roll back that import first to migrate again")
+	}
+
+	// everything v2 already has is read up front; the sqlite connection is held by the transaction after this
+	exs, err := s.getExercises()
+	if err != nil {
+		return nil, err
+	}
+	exercisesByKey := make(map[string]Exercise)
+	for _, ex := range exs.Collection {
+		exercisesByKey[v1ExerciseKey(ex.Name)] = ex
+	}
+	teams, err := s.getAllTeams(-1)
+	if err != nil {
+		return nil, err
+	}
+	teamsByKey := make(map[string]int)
+	for _, t := range teams.Collection {
+		if _, ok := teamsByKey[teamname.Key(t.Name)]; !ok {
+			teamsByKey[teamname.Key(t.Name)] = t.ID
+		}
+	}
+
+	report := &V1Report{DryRun: dryRun, Exercises: make([]V1ExerciseTotals, 0)}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("unable to begin MigrateV1: %w", err)
+	}
+	// committed below unless this is a dry run; rolling back after a commit is a no op
+	defer tx.Rollback()
+
+	users, err := s.migrateV1Users(v1, tx, report)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.migrateV1Teams(v1, tx, users, teamsByKey, report); err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec("insert into imports (user_id, rows, created_on, source) values (-1, 0, ?, ?)", time.Now().Unix(), importSourceV1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to insert MigrateV1 import: %w", err)
+	}
+	importID, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get last insert id for MigrateV1 import: %w", err)
+	}
+
+	totals, err := s.migrateV1Reps(v1, tx, users, exercisesByKey, int(importID))
+	if err != nil {
+		return nil, err
+	}
+
+	// the after numbers come from v2 itself rather than from what was sent to it
+	rows, err := tx.Query("select exercise_id, count(*), sum(count) from reps where import_id=? group by exercise_id", importID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query MigrateV1 totals: %w", err)
+	}
+	after := make(map[int][2]int)
+	var copied int
+	for rows.Next() {
+		var exerciseID, entries, count int
+		if err := rows.Scan(&exerciseID, &entries, &count); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("unable to scan MigrateV1 totals: %w", err)
+		}
+		after[exerciseID] = [2]int{entries, count}
+		copied += entries
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning MigrateV1 totals: %w", err)
+	}
+	if _, err := tx.Exec("update imports set rows=? where id=?", copied, importID); err != nil {
+		return nil, fmt.Errorf("unable to update MigrateV1 import: %w", err)
+	}
+
+	report.Reconciled = true
+	for _, total := range totals {
+		if ex, ok := exercisesByKey[v1ExerciseKey(total.Exercise)]; ok {
+			total.V2Entries, total.V2Count = after[ex.ID][0], after[ex.ID][1]
+		}
+		if total.V2Entries+total.SkippedEntries != total.V1Entries || total.V2Count+total.SkippedCount != total.V1Count {
+			report.Reconciled = false
+		}
+		report.Exercises = append(report.Exercises, total)
+	}
+
+	if dryRun || !report.Reconciled {
+		return report, nil
+	}
+	byUser, err := s.getImportReps(tx, int(importID))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("unable to commit MigrateV1: %w", err)
+	}
+	report.ImportID = int(importID)
+	s.audit(AuditEntry{Source: auditCLI, Action: "import.create", SubjectType: "import", SubjectID: report.ImportID, After: auditJSON(report)})
+
+	// the command exits next, so let subscribers award badges and queue webhooks first
+	s.publishImportReps(byUser, false, time.Now())
+	s.events.wait()
+	return report, nil
+}
+
+// migrateV1Users maps each v1 user id to a v2 user, matching existing v2 users by email
+func (s *Server) migrateV1Users(v1 *sql.DB, tx *sql.Tx, report *V1Report) (map[int]int, error) {
+	existing := make(map[string]int)
+	rows, err := tx.Query("select id, email from users")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query migrateV1Users v2 users: %w", err)
+	}
+	for rows.Next() {
+		var id int
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("unable to scan migrateV1Users v2 users: %w", err)
+		}
+		existing[strings.ToLower(email)] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning migrateV1Users v2 users: %w", err)
+	}
+
+	rows, err = v1.Query("select id, email from user order by id")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query migrateV1Users v1 users: %w", err)
+	}
+	defer rows.Close()
+
+	users := make(map[int]int)
+	for rows.Next() {
+		var v1ID int
+		var email string
+		if err := rows.Scan(&v1ID, &email); err != nil {
+			return nil, fmt.Errorf("unable to scan migrateV1Users v1 users: %w", err)
+		}
+		report.Users++
+
+		email = strings.ToLower(strings.TrimSpace(email))
+		id, ok := existing[email]
+		if !ok {
+			res, err := tx.Exec("insert into users (email) values (?)", email)
+			if err != nil {
+				return nil, fmt.Errorf("unable to insert migrateV1Users user: %w", err)
+			}
+			newID, err := res.LastInsertId()
+			if err != nil {
+				return nil, fmt.Errorf("unable to get last insert id for migrateV1Users: %w", err)
+			}
+			id = int(newID)
+			existing[email] = id
+			report.UsersCreated++
+		}
+		users[v1ID] = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning migrateV1Users v1 users: %w", err)
+	}
+	return users, nil
+}
+
+// migrateV1Teams turns v1 offices and teams into v2 teams, matched to existing v2 teams by name, and copies who is on them.
+// Teams made here have no owner, like the seeded teams, so only admins can manage them
+func (s *Server) migrateV1Teams(v1 *sql.DB, tx *sql.Tx, users map[int]int, teamsByKey map[string]int, report *V1Report) error {
+	teamID := func(name string, headCount int) (int, error) {
+		name = teamname.Normalize(name)
+		if id, ok := teamsByKey[teamname.Key(name)]; ok {
+			if headCount > 0 {
+				// keep a head count set in v2
+				if _, err := tx.Exec("update teams set head_count=? where id=? and head_count=0", headCount, id); err != nil {
+					return 0, fmt.Errorf("unable to update migrateV1Teams head count: %w", err)
+				}
+			}
+			return id, nil
+		}
+		res, err := tx.Exec("insert into teams (name, created_by_user_id, head_count) values (?, -1, ?)", name, headCount)
+		if err != nil {
+			return 0, fmt.Errorf("unable to insert migrateV1Teams team: %w", err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, fmt.Errorf("unable to get last insert id for migrateV1Teams: %w", err)
+		}
+		teamsByKey[teamname.Key(name)] = int(id)
+		report.TeamsCreated++
+		return int(id), nil
+	}
+
+	members := make(map[[2]int]bool)
+	rows, err := tx.Query("select distinct team_id, user_id from user_teams")
+	if err != nil {
+		return fmt.Errorf("unable to query migrateV1Teams v2 members: %w", err)
+	}
+	for rows.Next() {
+		var m [2]int
+		if err := rows.Scan(&m[0], &m[1]); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to scan migrateV1Teams v2 members: %w", err)
+		}
+		members[m] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unexpected error after scanning migrateV1Teams v2 members: %w", err)
+	}
+	addMember := func(teamID, v1UserID int) error {
+		report.Memberships++
+		uid, ok := users[v1UserID]
+		if !ok || members[[2]int{teamID, uid}] {
+			return nil
+		}
+		if _, err := tx.Exec("insert into user_teams (team_id, user_id) values (?, ?)", teamID, uid); err != nil {
+			return fmt.Errorf("unable to insert migrateV1Teams member: %w", err)
+		}
+		members[[2]int{teamID, uid}] = true
+		report.MembershipsAdded++
+		return nil
+	}
+
+	// v1 tables are read in full before writing; they are small, and it keeps the two databases' reads and writes apart
+	type v1Team struct {
+		id, headCount int
+		name          string
+	}
+	readTeams := func(q string) ([]v1Team, error) {
+		rows, err := v1.Query(q)
+		if err != nil {
+			return nil, fmt.Errorf("unable to query migrateV1Teams: %w", err)
+		}
+		defer rows.Close()
+		var teams []v1Team
+		for rows.Next() {
+			var t v1Team
+			var name sql.NullString
+			var headCount sql.NullInt64
+			if err := rows.Scan(&t.id, &name, &headCount); err != nil {
+				return nil, fmt.Errorf("unable to scan migrateV1Teams: %w", err)
+			}
+			t.name, t.headCount = name.String, int(headCount.Int64)
+			if strings.TrimSpace(t.name) != "" {
+				teams = append(teams, t)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("unexpected error after scanning migrateV1Teams: %w", err)
+		}
+		return teams, nil
+	}
+	readPairs := func(q string) ([][2]int, error) {
+		rows, err := v1.Query(q)
+		if err != nil {
+			return nil, fmt.Errorf("unable to query migrateV1Teams members: %w", err)
+		}
+		defer rows.Close()
+		var pairs [][2]int
+		for rows.Next() {
+			var p [2]int
+			if err := rows.Scan(&p[0], &p[1]); err != nil {
+				return nil, fmt.Errorf("unable to scan migrateV1Teams members: %w", err)
+			}
+			pairs = append(pairs, p)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("unexpected error after scanning migrateV1Teams members: %w", err)
+		}
+		return pairs, nil
+	}
+
+	offices, err := readTeams("select id, name, head_count from office order by id")
+	if err != nil {
+		return err
+	}
+	officeMembers, err := readPairs("select office, id from user where office is not null and office>0")
+	if err != nil {
+		return err
+	}
+	v1Teams, err := readTeams("select id, name, 0 from team order by id")
+	if err != nil {
+		return err
+	}
+	teamMembers, err := readPairs("select distinct team_id, user_id from user_team")
+	if err != nil {
+		return err
+	}
+	report.Offices, report.Teams = len(offices), len(v1Teams)
+
+	for _, group := range []struct {
+		teams   []v1Team
+		members [][2]int
+	}{{offices, officeMembers}, {v1Teams, teamMembers}} {
+		ids := make(map[int]int)
+		for _, t := range group.teams {
+			id, err := teamID(t.name, t.headCount)
+			if err != nil {
+				return err
+			}
+			ids[t.id] = id
+		}
+		for _, m := range group.members {
+			if id, ok := ids[m[0]]; ok {
+				if err := addMember(id, m[1]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// migrateV1Reps copies every v1 rep with a known exercise and a timestamp, and totals each exercise as it goes
+func (s *Server) migrateV1Reps(v1 *sql.DB, tx *sql.Tx, users map[int]int, exercisesByKey map[string]Exercise, importID int) ([]V1ExerciseTotals, error) {
+	rows, err := v1.Query("select user_id, exercise, count, created_at from reps order by id")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query migrateV1Reps: %w", err)
+	}
+	defer rows.Close()
+
+	stmt, err := tx.Prepare("insert into reps (exercise_id, user_id, count, points, created_on, import_id) values (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare migrateV1Reps: %w", err)
+	}
+	defer stmt.Close()
+
+	totals := make(map[string]*V1ExerciseTotals)
+	for rows.Next() {
+		var v1UserID, count int
+		var exercise string
+		var createdAt sql.NullTime
+		if err := rows.Scan(&v1UserID, &exercise, &count, &createdAt); err != nil {
+			return nil, fmt.Errorf("unable to scan migrateV1Reps: %w", err)
+		}
+
+		ex, known := exercisesByKey[v1ExerciseKey(exercise)]
+		// unknown v1 names are totaled on their own, keyed so they cannot collide with a v2 name
+		key := ex.Name
+		if !known {
+			key = "v1:" + exercise
+		}
+		total, ok := totals[key]
+		if !ok {
+			total = &V1ExerciseTotals{Exercise: ex.Name}
+			totals[key] = total
+		}
+		if !inList(exercise, total.V1Exercises) {
+			total.V1Exercises = append(total.V1Exercises, exercise)
+		}
+		total.V1Entries++
+		total.V1Count += count
+
+		uid, found := users[v1UserID]
+		if !known || !found || !createdAt.Valid {
+			total.SkippedEntries++
+			total.SkippedCount += count
+			continue
+		}
+		if _, err := stmt.Exec(ex.ID, uid, count, ex.points(count), createdAt.Time.Unix(), importID); err != nil {
+			return nil, fmt.Errorf("unable to insert migrateV1Reps: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning migrateV1Reps: %w", err)
+	}
+
+	keys := make([]string, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := make([]V1ExerciseTotals, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, *totals[key])
+	}
+	return list, nil
+}
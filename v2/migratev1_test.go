@@ -0,0 +1,138 @@
+package countmyreps
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestV1DB returns a sqlite stand in for v1's MySQL db, with the same tables and columns
+func newTestV1DB(t *testing.T, s *Server) *sql.DB {
+	t.Helper()
+	v1, err := sql.Open("sqlite3", filepath.Join(filepath.Dir(s.conf.DBPath), "v1.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { v1.Close() })
+
+	for _, stmt := range []string{
+		"create table office (id integer primary key autoincrement, name varchar(255) not null default '', head_count int default null)",
+		"create table user (id integer primary key autoincrement, email varchar(255) not null default '', office int default 0)",
+		"create table reps (id integer primary key autoincrement, user_id int not null, exercise varchar(255) not null default '', count int not null, created_at timestamp null)",
+		"create table team (id integer primary key autoincrement, name varchar(255) default null)",
+		"create table user_team (id integer primary key autoincrement, user_id int not null, team_id int not null)",
+	} {
+		if _, err := v1.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return v1
+}
+
+func TestMigrateV1(t *testing.T) {
+	s, _ := newTestServer(t)
+	v1 := newTestV1DB(t, s)
+	at := time.Date(2017, 3, 14, 15, 9, 26, 0, time.UTC)
+
+	// someone who has already signed in to v2, and a team v2 already has under a different case
+	existing := mustCreateUser(t, s, "existing@sendgrid.com")
+
+	for _, stmt := range []string{
+		"insert into office (id, name, head_count) values (1, 'denver', 120), (2, 'Anaheim', null)",
+		"insert into user (id, email, office) values (1, 'Existing@SendGrid.com', 1), (2, 'new@sendgrid.com', 2), (3, 'nooffice@sendgrid.com', 0)",
+		"insert into team (id, name) values (1, 'Lunch Lifters')",
+		"insert into user_team (user_id, team_id) values (1, 1), (2, 1), (2, 1)",
+	} {
+		if _, err := v1.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rep := range []struct {
+		uid      int
+		exercise string
+		count    int
+		at       interface{}
+	}{
+		{1, "Pull Ups", 10, at},
+		{1, "pullups", 5, at},
+		{2, "Push Ups", 20, at},
+		{2, "Squats", 30, nil},
+		{3, "unknown", 7, at},
+	} {
+		if _, err := v1.Exec("insert into reps (user_id, exercise, count, created_at) values (?, ?, ?, ?)", rep.uid, rep.exercise, rep.count, rep.at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := s.MigrateV1(v1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Reconciled {
+		t.Errorf("got a dry run that does not reconcile: %+v", report)
+	}
+	reps, _ := s.getReps(existing, 0, int(time.Now().Unix()))
+	if got := len(reps); got != 0 {
+		t.Fatalf("got %d reps after a dry run, want none", got)
+	}
+
+	report, err = s.MigrateV1(v1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ImportID == 0 || !report.Reconciled {
+		t.Fatalf("got an unreconciled migration: %+v", report)
+	}
+	if got, want := [3]int{report.Users, report.UsersCreated, report.TeamsCreated}, [3]int{3, 2, 2}; got != want {
+		t.Errorf("got users, new users, and new teams %v, want %v", got, want)
+	}
+	if got, want := [2]int{report.Memberships, report.MembershipsAdded}, [2]int{4, 4}; got != want {
+		t.Errorf("got memberships and new memberships %v, want %v", got, want)
+	}
+
+	totals := make(map[string]V1ExerciseTotals)
+	for _, ex := range report.Exercises {
+		totals[ex.Exercise] = ex
+	}
+	// both v1 spellings are the one v2 exercise
+	want := V1ExerciseTotals{Exercise: "Pull Ups", V1Exercises: []string{"Pull Ups", "pullups"}, V1Entries: 2, V1Count: 15, V2Entries: 2, V2Count: 15}
+	if got := totals["Pull Ups"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, want := totals["Squats"].SkippedEntries, 1; got != want {
+		t.Errorf("got %d skipped squats without a timestamp, want %d", got, want)
+	}
+	if got, want := totals[""].SkippedCount, 7; got != want {
+		t.Errorf("got %d skipped for an unknown exercise, want %d", got, want)
+	}
+
+	// the existing user kept their id, and their v1 history kept its timestamp
+	reps, _ = s.getReps(existing, 0, int(time.Now().Unix()))
+	if got, want := len(reps), 2; got != want {
+		t.Fatalf("got %d reps for the existing user, want %d", got, want)
+	}
+	if got, want := reps[0].CreatedOn, int(at.Unix()); got != want {
+		t.Errorf("got created on %d, want %d", got, want)
+	}
+
+	// the denver office is the seeded Denver team, with v1's head count
+	denver, _ := s.getTeamByName("Denver")
+	if got, want := denver.HeadCount, 120; got != want {
+		t.Errorf("got Denver head count %d, want %d", got, want)
+	}
+	if member, _ := s.isTeamMember(denver.ID, existing); !member {
+		t.Errorf("got the existing user off the Denver team, want them on it")
+	}
+
+	if _, err := s.MigrateV1(v1, false); err == nil {
+		t.Errorf("got a second migration, want an error")
+	}
+	if removed, err := s.rollbackImport(report.ImportID); err != nil || removed != 3 {
+		t.Errorf("got %d removed (%v) rolling back, want 3", removed, err)
+	}
+	if _, err := s.MigrateV1(v1, true); err != nil {
+		t.Errorf("got %v migrating after a rollback, want it allowed", err)
+	}
+}
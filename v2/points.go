@@ -0,0 +1,123 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+)
+
+// points scores count of the exercise at its weight
+func (e Exercise) points(count int) float64 {
+	if e.Per < 1 {
+		return float64(count)
+	}
+	return float64(count) * e.Weight / float64(e.Per)
+}
+
+// roundPoints is how points are shown. They are stored unrounded so totals of many small entries add up correctly
+func roundPoints(points float64) int {
+	return int(math.Round(points))
+}
+
+// putExerciseWeight sets the exercise's weight and rescores every rep ever logged for it.
+// It returns how many reps were rescored, or -1 if there is no such exercise
+func (s *Server) putExerciseWeight(exerciseID int, weight float64, per int) (int, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to begin putExerciseWeight: %w", err)
+	}
+
+	res, err := tx.Exec("update exercises set weight=?, per=? where id=?", weight, per, exerciseID)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to update putExerciseWeight: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return 0, fmt.Errorf("unable to get rows affected for putExerciseWeight: %w", err)
+		}
+		return -1, nil
+	}
+
+	res, err = tx.Exec("update reps set points=count*?/? where exercise_id=?", weight, float64(per), exerciseID)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to rescore reps in putExerciseWeight: %w", err)
+	}
+	rescored, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to get rescored reps for putExerciseWeight: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit putExerciseWeight: %w", err)
+	}
+
+	// reload the cached exercises so new reps are scored at the new weight
+	if _, err := s.getExercises(); err != nil {
+		return 0, err
+	}
+	return int(rescored), nil
+}
+
+// PutExerciseWeight is admin only. Body: {"Weight": 1, "Per": 10} scores a point for every 10 of the exercise's unit. Each defaults to 1
+// Every rep already logged for the exercise is rescored, so past leaderboards change too
+func (s *Server) PutExerciseWeight(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+	exerciseID, err := strconv.Atoi(chi.URLParam(r, "exerciseID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	update := struct {
+		Weight float64
+		Per    int
+	}{Weight: 1, Per: 1}
+	if err := json.Unmarshal(body, &update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.Weight < 0 || update.Per < 1 {
+		http.Error(w, "Weight cannot be negative and Per must be at least 1", http.StatusBadRequest)
+		return
+	}
+
+	previous, _ := s.getExerciseByID(exerciseID)
+	rescored, err := s.putExerciseWeight(exerciseID, update.Weight, update.Per)
+	if err != nil {
+		log.Printf("unable to PutExerciseWeight: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rescored < 0 {
+		http.Error(w, "exercise not found", http.StatusNotFound)
+		return
+	}
+
+	ex, _ := s.getExerciseByID(exerciseID)
+	data := struct {
+		Exercise Exercise
+		Rescored int
+	}{ex, rescored}
+	s.auditRequest(r, -1, AuditEntry{Action: "exercise.update", SubjectType: "exercise", SubjectID: exerciseID, Before: auditJSON(previous), After: auditJSON(data)})
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("PutExerciseWeight marshal err ", err.Error())
+	}
+}
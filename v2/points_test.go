@@ -0,0 +1,98 @@
+package countmyreps
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExerciseWeights(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.conf.Admins = []string{"admin@twilio.com"}
+	day := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+	start, end := int(day.AddDate(0, 0, -1).Unix()), int(day.AddDate(0, 0, 1).Unix())
+
+	lifter := mustCreateUser(t, s, "lifter@twilio.com")
+	runner := mustCreateUser(t, s, "runner@twilio.com")
+	lifters, err := s.postTeam("Lifters", lifter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runners, err := s.postTeam("Runners", runner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsertReps(t, s, lifter, "Push Ups", 100, day)
+	mustInsertReps(t, s, runner, "Running", 5000, day)
+
+	// out of the box every rep is a point, and every 10 meters
+	running, _ := s.getExerciseByName("Running")
+	pushUps, _ := s.getExerciseByName("Push Ups")
+	if got, want := [2]int{pushUps.Per, running.Per}, [2]int{1, 10}; got != want {
+		t.Errorf("got push ups and running per %v, want %v", got, want)
+	}
+	ranks, err := s.getTeamRankings(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ranks[0].TeamID, runners.ID; got != want {
+		t.Errorf("got team %d first before weighting, want the runners", got)
+	}
+
+	admin := newTestClient(t, s, "admin@twilio.com")
+	member := newTestClient(t, s, "member@twilio.com")
+	path := fmt.Sprintf("/v3/admin/exercises/%d", running.ID)
+
+	if got, want := member.do("PUT", path, `{"Weight": 1, "Per": 100}`).Code, http.StatusForbidden; got != want {
+		t.Errorf("got %d for a non admin, want %d", got, want)
+	}
+	if got, want := admin.do("PUT", path, `{"Weight": 1, "Per": 0}`).Code, http.StatusBadRequest; got != want {
+		t.Errorf("got %d for Per 0, want %d", got, want)
+	}
+	if got, want := admin.do("PUT", "/v3/admin/exercises/9999", `{"Weight": 1}`).Code, http.StatusNotFound; got != want {
+		t.Errorf("got %d for an unknown exercise, want %d", got, want)
+	}
+	if got, want := admin.do("PUT", path, `{"Weight": 1, "Per": 100}`).Code, http.StatusOK; got != want {
+		t.Fatalf("got %d setting the weight, want %d", got, want)
+	}
+
+	// history is rescored: 5000 meters is now 50 points
+	totals, err := s.getExerciseTotals(runner, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := totals[0].Count, 5000; got != want {
+		t.Errorf("got %d meters, want %d", got, want)
+	}
+	if got, want := totals[0].Points, 50; got != want {
+		t.Errorf("got %d points, want %d", got, want)
+	}
+
+	ranks, err = s.getTeamRankings(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ranks[0].TeamID, lifters.ID; got != want {
+		t.Errorf("got team %d first after weighting, want the lifters", got)
+	}
+	if got, want := ranks[1].TotalPoints, 50; got != want {
+		t.Errorf("got %d points for the runners, want %d", got, want)
+	}
+
+	// new and edited reps are scored at the new weight
+	reps, err := s.postStats(runner, Exercises{Collection: []Exercise{{Name: "Running", Count: 250}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reps[0].Points, 3; got != want {
+		t.Errorf("got %d points for 250 meters, want %d", got, want)
+	}
+	rep, err := s.putRep(reps[0].ID, runner, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rep.Points, 10; got != want {
+		t.Errorf("got %d points for an edited 1000 meters, want %d", got, want)
+	}
+}
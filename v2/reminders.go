@@ -0,0 +1,208 @@
+package countmyreps
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	reminderToday = "today"
+	reminderIdle  = "idle"
+)
+
+// ReminderData is the data needed to populate the reminder email templates
+type ReminderData struct {
+	SiteURL string
+	Email   string
+	// Rule is "today" when nothing has been logged yet today, or "idle" after DaysIdle days without logging
+	Rule     string
+	DaysIdle int
+	DaysLeft int
+}
+
+// reminderRule decides if a reminder should go out given the user's local time, their last rep, and when this rule last fired for them
+type reminderRule struct {
+	name string
+	due  func(local, lastRep, lastSent time.Time) bool
+}
+
+// reminderRules are built from config. Rules are checked in order and at most one reminder is sent per user per run
+func (s *Server) reminderRules() []reminderRule {
+	var rules []reminderRule
+
+	if s.conf.ReminderIdleDays > 0 {
+		idle := time.Duration(s.conf.ReminderIdleDays) * 24 * time.Hour
+		rules = append(rules, reminderRule{
+			name: reminderIdle,
+			due: func(local, lastRep, lastSent time.Time) bool {
+				// only one idle reminder per idle stretch
+				return local.Sub(lastRep) >= idle && lastSent.Before(lastRep)
+			},
+		})
+	}
+
+	if s.conf.ReminderHour >= 0 {
+		hour := s.conf.ReminderHour
+		rules = append(rules, reminderRule{
+			name: reminderToday,
+			due: func(local, lastRep, lastSent time.Time) bool {
+				midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+				return local.Hour() >= hour && lastRep.Before(midnight) && lastSent.Before(midnight)
+			},
+		})
+	}
+
+	return rules
+}
+
+type reminderUser struct {
+	id       int
+	email    string
+	timezone string
+	lastRep  int64
+}
+
+// sendReminders nudges challenge participants who have not opted out and whose activity matches a reminder rule.
+// No user gets more than one reminder a day, or more than ReminderWeeklyCap reminders in a rolling week.
+func (s *Server) sendReminders(now time.Time) error {
+	challengeStart, challengeEnd := s.conf.Challenge(now)
+	if now.Before(challengeStart) || !now.Before(challengeEnd) {
+		return nil
+	}
+
+	rules := s.reminderRules()
+	if len(rules) == 0 || s.conf.ReminderWeeklyCap <= 0 {
+		return nil
+	}
+
+	users, err := s.getReminderUsers(int(challengeStart.Unix()), int(challengeEnd.Unix()))
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, u := range users {
+		sentThisWeek, lastSent, err := s.getRemindersSent(u.id, now.AddDate(0, 0, -7))
+		if err != nil {
+			return err
+		}
+		if sentThisWeek >= s.conf.ReminderWeeklyCap {
+			continue
+		}
+
+		loc, err := time.LoadLocation(u.timezone)
+		if err != nil {
+			loc = time.UTC
+		}
+		local := now.In(loc)
+		lastRep := time.Unix(u.lastRep, 0).In(loc)
+
+		// never more than one reminder a day, whichever rule sent it
+		midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		var remindedToday bool
+		for _, sentOn := range lastSent {
+			if sentOn >= midnight.Unix() {
+				remindedToday = true
+			}
+		}
+		if remindedToday {
+			continue
+		}
+
+		for _, rule := range rules {
+			if !rule.due(local, lastRep, time.Unix(lastSent[rule.name], 0).In(loc)) {
+				continue
+			}
+
+			data := ReminderData{
+				SiteURL:  s.conf.FullAddr,
+				Email:    u.email,
+				Rule:     rule.name,
+				DaysIdle: int(now.Sub(lastRep).Hours() / 24),
+				DaysLeft: int(challengeEnd.Sub(now).Hours() / 24),
+			}
+			if err := s.sendReminder(data); err != nil {
+				log.Printf("unable to send %s reminder to %s: %s", rule.name, u.email, err.Error())
+				failed++
+				break
+			}
+
+			if _, err := s.DB.Exec("insert into reminders (user_id, rule, sent_on) values (?, ?, ?)", u.id, rule.name, now.Unix()); err != nil {
+				return fmt.Errorf("unable to record reminder: %w", err)
+			}
+			break
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d reminders failed to send", failed)
+	}
+	return nil
+}
+
+func (s *Server) sendReminder(data ReminderData) error {
+	subject := "You haven't logged any reps today"
+	if data.Rule == reminderIdle {
+		subject = fmt.Sprintf("It's been %d days since you logged any reps", data.DaysIdle)
+	}
+
+	msg, err := s.renderEmail("reminder", data.Email, subject, data)
+	if err != nil {
+		return err
+	}
+	return s.emailer.SendEmail(msg)
+}
+
+// getReminderUsers returns users who have not opted out and logged reps between start (inclusive) and end (exclusive), with their most recent rep
+func (s *Server) getReminderUsers(start, end int) ([]reminderUser, error) {
+	q := "select users.id, users.email, users.timezone, max(reps.created_on) from users join reps on reps.user_id=users.id where users.reminders=1 group by users.id having sum(case when reps.created_on>=? and reps.created_on<? then 1 else 0 end) > 0"
+	rows, err := s.DB.Query(q, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getReminderUsers: %w", err)
+	}
+	defer rows.Close()
+
+	var users []reminderUser
+	for rows.Next() {
+		var u reminderUser
+		if err := rows.Scan(&u.id, &u.email, &u.timezone, &u.lastRep); err != nil {
+			return nil, fmt.Errorf("unable to scan getReminderUsers: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getReminderUsers: %w", err)
+	}
+	return users, nil
+}
+
+// getRemindersSent returns how many reminders the user got since since, and when each rule last fired for them
+func (s *Server) getRemindersSent(uid int, since time.Time) (int, map[string]int64, error) {
+	var count int
+	q := "select count(*) from reminders where user_id=? and sent_on>=?"
+	if err := s.DB.QueryRow(q, uid, since.Unix()).Scan(&count); err != nil {
+		return 0, nil, fmt.Errorf("unable to scan getRemindersSent count: %w", err)
+	}
+
+	q = "select rule, max(sent_on) from reminders where user_id=? group by rule"
+	rows, err := s.DB.Query(q, uid)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to query getRemindersSent: %w", err)
+	}
+	defer rows.Close()
+
+	lastSent := make(map[string]int64)
+	for rows.Next() {
+		var rule string
+		var sentOn int64
+		if err := rows.Scan(&rule, &sentOn); err != nil {
+			return 0, nil, fmt.Errorf("unable to scan getRemindersSent: %w", err)
+		}
+		lastSent[rule] = sentOn
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("unexpected error after scanning getRemindersSent: %w", err)
+	}
+	return count, lastSent, nil
+}
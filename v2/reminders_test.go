@@ -0,0 +1,78 @@
+package countmyreps
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendReminders(t *testing.T) {
+	s, emailer := newTestServer(t)
+	now := time.Date(2020, 11, 10, 16, 0, 0, 0, time.UTC)
+
+	notToday := mustCreateUser(t, s, "nottoday@twilio.com")
+	loggedToday := mustCreateUser(t, s, "loggedtoday@twilio.com")
+	idle := mustCreateUser(t, s, "idle@twilio.com")
+	optedOut := mustCreateUser(t, s, "optedout@twilio.com")
+	tooEarly := mustCreateUser(t, s, "tooearly@twilio.com")
+
+	mustInsertReps(t, s, notToday, "Push Ups", 10, now.AddDate(0, 0, -1))
+	mustInsertReps(t, s, loggedToday, "Push Ups", 10, now.Add(-time.Hour))
+	mustInsertReps(t, s, idle, "Push Ups", 10, now.AddDate(0, 0, -4))
+	mustInsertReps(t, s, optedOut, "Push Ups", 10, now.AddDate(0, 0, -1))
+	mustInsertReps(t, s, tooEarly, "Push Ups", 10, now.AddDate(0, 0, -1))
+
+	if err := s.putPreferences(optedOut, &Preferences{Timezone: "UTC", Reminders: false}); err != nil {
+		t.Fatal(err)
+	}
+	// 8am in Los Angeles, before the reminder hour
+	if err := s.putPreferences(tooEarly, &Preferences{Timezone: "America/Los_Angeles", Reminders: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.sendReminders(now); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(map[string]Message)
+	for _, msg := range emailer.Sent {
+		sent[msg.To] = msg
+	}
+	if got, want := len(emailer.Sent), 2; got != want {
+		t.Errorf("got %d reminders, want %d: %v", got, want, sent)
+	}
+	if msg, ok := sent["nottoday@twilio.com"]; !ok || !strings.Contains(msg.Text, "You haven't logged any reps today.") {
+		t.Errorf("got %#v, want a today reminder for nottoday@twilio.com", msg)
+	}
+	if msg, ok := sent["idle@twilio.com"]; !ok || !strings.Contains(msg.Text, "It's been 4 days since you logged any reps.") {
+		t.Errorf("got %#v, want an idle reminder for idle@twilio.com", msg)
+	}
+
+	// later the same day, nobody gets a second reminder
+	if err := s.sendReminders(now.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(emailer.Sent), 2; got != want {
+		t.Errorf("got %d reminders after rerun, want %d", got, want)
+	}
+}
+
+func TestRemindersWeeklyCap(t *testing.T) {
+	s, emailer := newTestServer(t)
+	s.conf.ReminderWeeklyCap = 2
+	now := time.Date(2020, 11, 10, 16, 0, 0, 0, time.UTC)
+
+	uid := mustCreateUser(t, s, "lazy@twilio.com")
+	mustInsertReps(t, s, uid, "Push Ups", 10, time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC))
+
+	// one idle reminder, then a today reminder each day until the cap is hit
+	for day := 0; day < 5; day++ {
+		if err := s.sendReminders(now.AddDate(0, 0, day)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := len(emailer.Sent), 2; got != want {
+		t.Errorf("got %d reminders, want %d", got, want)
+	}
+}
@@ -0,0 +1,44 @@
+package countmyreps
+
+import (
+	"log"
+	"time"
+)
+
+// job is a unit of scheduled work. It is handed the tick time so it can decide for itself what is due
+type job struct {
+	name string
+	run  func(now time.Time) error
+}
+
+func (s *Server) jobs() []job {
+	return []job{
+		{name: "digests", run: s.sendDigests},
+		{name: "reminders", run: s.sendReminders},
+		{name: "backups", run: s.runBackups},
+	}
+}
+
+// runScheduler runs every job once per SchedulerInterval until the server is closed
+func (s *Server) runScheduler() {
+	ticker := time.NewTicker(s.conf.SchedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.runJobs(now)
+		}
+	}
+}
+
+// runJobs runs each job in turn. A failing job is logged and does not stop the others
+func (s *Server) runJobs(now time.Time) {
+	for _, j := range s.jobs() {
+		if err := j.run(now); err != nil {
+			log.Printf("scheduled job %s failed: %s", j.name, err.Error())
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package countmyreps
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const slackUsage = "Usage:\n`/reps 20 pushups` to log reps. Log several at once with commas: `/reps 20 push ups, 15 squats`\n`/reps me` to see your totals for the challenge\n`/reps leaderboard` to see the team standings"
+
+// slackResponse is a Block Kit message. Ephemeral responses are only shown to the user that ran the command
+type slackResponse struct {
+	ResponseType string       `json:"response_type"`
+	Text         string       `json:"text"`
+	Blocks       []slackBlock `json:"blocks,omitempty"`
+}
+
+type slackBlock struct {
+	Type string     `json:"type"`
+	Text *slackText `json:"text,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// ephemeral builds a response of one markdown section per paragraph
+func ephemeral(paragraphs ...string) slackResponse {
+	resp := slackResponse{ResponseType: "ephemeral", Text: strings.Join(paragraphs, "\n")}
+	for _, p := range paragraphs {
+		resp.Blocks = append(resp.Blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: p}})
+	}
+	return resp
+}
+
+// SlackCommandHandler handles the `/reps` slash command. Slack shows non-200 responses as a generic failure,
+// so anything the user can act on is returned as a 200 with an explanation.
+func (s *Server) SlackCommandHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := verifySlackSignature(s.conf.SlackSigningSecret, r.Header, body, time.Now()); err != nil {
+		log.Printf("rejected slack command: %s", err.Error())
+		http.Error(w, "invalid slack signature", http.StatusUnauthorized)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := s.slackCommand(form.Get("user_id"), form.Get("text"))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println("SlackCommandHandler marshal err ", err.Error())
+	}
+}
+
+func (s *Server) slackCommand(slackUserID string, text string) slackResponse {
+	text = strings.TrimSpace(text)
+	command := strings.ToLower(text)
+	if command == "" || command == "help" {
+		return ephemeral(slackUsage)
+	}
+
+	email, err := s.slackUserEmail(slackUserID)
+	if err != nil {
+		log.Printf("unable to look up slack user %s: %s", slackUserID, err.Error())
+		return ephemeral("Sorry, CountMyReps could not look up your email address in Slack. Please try again later.")
+	}
+	if !allowedEmail(email) {
+		return ephemeral(fmt.Sprintf("Sorry, CountMyReps is only for %s accounts.", allowedEmailDomain))
+	}
+	if command == "leaderboard" {
+		return s.slackLeaderboard()
+	}
+
+	// only commands that are about you sign you up
+	uid, err := s.getOrCreateUser(email)
+	if err != nil {
+		log.Printf("unable to get slack user %s: %s", email, err.Error())
+		return ephemeral("Sorry, CountMyReps had an unexpected error. Please try again later.")
+	}
+	if command == "me" {
+		return s.slackMe(uid)
+	}
+
+	exs, err := s.parseSlackReps(text)
+	if err != nil {
+		return ephemeral(err.Error(), slackUsage)
+	}
+	reps, err := s.postStats(uid, exs)
+	if err != nil {
+		log.Printf("unable to post slack reps for %s: %s", email, err.Error())
+		return ephemeral("Sorry, CountMyReps was unable to save your reps. Please try again later.")
+	}
+	s.auditRepsLogged(uid, auditSlack, reps)
+
+	var logged []string
+	for _, ex := range exs.Collection {
+		logged = append(logged, fmt.Sprintf("%d %s", ex.Count, ex.Name))
+	}
+	return ephemeral(fmt.Sprintf(":muscle: Logged %s. Keep it up!", strings.Join(logged, ", ")))
+}
+
+func (s *Server) slackLeaderboard() slackResponse {
+	start, end := s.conf.Challenge(time.Now())
+	ranks, err := s.getTeamRankings(int(start.Unix()), int(end.Unix()))
+	if err != nil {
+		log.Printf("unable to get slack leaderboard: %s", err.Error())
+		return ephemeral("Sorry, CountMyReps had an unexpected error. Please try again later.")
+	}
+	if len(ranks) == 0 {
+		return ephemeral("No teams have any members yet.")
+	}
+
+	lines := []string{"*Team leaderboard* (points per person)"}
+	for i, rank := range ranks {
+		if i == 10 {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s: %d (%d members)", rank.Rank, rank.Name, rank.PointsPerPerson, rank.Members))
+	}
+	return ephemeral(strings.Join(lines, "\n"))
+}
+
+func (s *Server) slackMe(uid int) slackResponse {
+	start, end := s.conf.Challenge(time.Now())
+	totals, err := s.getExerciseTotals(uid, int(start.Unix()), int(end.Unix()))
+	if err != nil {
+		log.Printf("unable to get slack totals: %s", err.Error())
+		return ephemeral("Sorry, CountMyReps had an unexpected error. Please try again later.")
+	}
+	if len(totals) == 0 {
+		return ephemeral("You haven't logged anything this challenge yet. Try `/reps 20 pushups`")
+	}
+
+	lines := []string{"*Your totals this challenge*"}
+	for _, ex := range totals {
+		lines = append(lines, fmt.Sprintf("%s: %d %s", ex.Name, ex.Count, strings.ToLower(ex.ValueType)))
+	}
+	return ephemeral(strings.Join(lines, "\n"))
+}
+
+// parseSlackReps parses "20 pushups, 15 squats" into exercises. Names are matched loosely, ignoring case, spaces, and a trailing s
+func (s *Server) parseSlackReps(text string) (Exercises, error) {
+	exs := Exercises{}
+
+	all, err := s.getExercises()
+	if err != nil {
+		return exs, fmt.Errorf("Sorry, CountMyReps was unable to load the exercise list")
+	}
+
+	for _, part := range strings.Split(text, ",") {
+		fields := strings.Fields(part)
+		if len(fields) < 2 {
+			return exs, fmt.Errorf("I didn't understand %q", strings.TrimSpace(part))
+		}
+		count, err := strconv.Atoi(fields[0])
+		if err != nil || count <= 0 {
+			return exs, fmt.Errorf("%q is not a number of reps", fields[0])
+		}
+
+		name := slackExerciseKey(strings.Join(fields[1:], ""))
+		var found bool
+		for _, ex := range all.Collection {
+			if slackExerciseKey(ex.Name) == name {
+				exs.Collection = append(exs.Collection, Exercise{ID: ex.ID, Name: ex.Name, Count: count})
+				found = true
+				break
+			}
+		}
+		if !found {
+			var names []string
+			for _, ex := range all.Collection {
+				names = append(names, ex.Name)
+			}
+			return exs, fmt.Errorf("I don't know the exercise %q. Try one of: %s", strings.Join(fields[1:], " "), strings.Join(names, ", "))
+		}
+	}
+
+	return exs, nil
+}
+
+// slackExerciseKey reduces "Push Ups", "pushups", and "push-up" to "pushup"
+func slackExerciseKey(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) {
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "s")
+}
+
+// verifySlackSignature checks the request was signed by Slack with our signing secret and is recent enough to not be a replay.
+// See https://api.slack.com/authentication/verifying-requests-from-slack
+func verifySlackSignature(secret string, header http.Header, body []byte, now time.Time) error {
+	if secret == "" {
+		return fmt.Errorf("slack signing secret not configured")
+	}
+
+	ts := header.Get("X-Slack-Request-Timestamp")
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad slack timestamp %q", ts)
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > 5*time.Minute || age < -5*time.Minute {
+		return fmt.Errorf("stale slack timestamp %q", ts)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("slack signature mismatch")
+	}
+	return nil
+}
+
+// slackUserEmail looks up the email address on the Slack user's profile. Results are cached alongside bearer tokens
+func (s *Server) slackUserEmail(slackUserID string) (string, error) {
+	if slackUserID == "" {
+		return "", fmt.Errorf("missing slack user_id")
+	}
+
+	cacheKey := "slack:" + slackUserID
+	if email, ok := s.tokenCache.Get(cacheKey); ok {
+		return email.(string), nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.slackAPIURL+"/users.info?user="+url.QueryEscape(slackUserID), nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create slack users.info request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.conf.SlackBotToken)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to call slack users.info: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var info struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		User  struct {
+			Profile struct {
+				Email string `json:"email"`
+			} `json:"profile"`
+		} `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("unable to decode slack users.info: %w", err)
+	}
+	if !info.OK {
+		return "", fmt.Errorf("slack users.info error: %s", info.Error)
+	}
+	if info.User.Profile.Email == "" {
+		return "", fmt.Errorf("slack user %s has no email; is the users:read.email scope granted?", slackUserID)
+	}
+
+	s.tokenCache.Set(cacheKey, info.User.Profile.Email, 0)
+	return info.User.Profile.Email, nil
+}
@@ -0,0 +1,161 @@
+package countmyreps
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signSlack(secret string, ts int64, body string) http.Header {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:%s", ts, body)
+	h := http.Header{}
+	h.Set("X-Slack-Request-Timestamp", strconv.FormatInt(ts, 10))
+	h.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return h
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	now := time.Unix(1604966400, 0)
+	body := []byte("user_id=U123&text=20+pushups")
+
+	tests := []struct {
+		name   string
+		secret string
+		header http.Header
+		ok     bool
+	}{
+		{"valid", "shh", signSlack("shh", now.Unix(), string(body)), true},
+		{"wrong secret", "shh", signSlack("nope", now.Unix(), string(body)), false},
+		{"tampered body", "shh", signSlack("shh", now.Unix(), "user_id=U123&text=2000+pushups"), false},
+		{"replayed", "shh", signSlack("shh", now.Add(-10*time.Minute).Unix(), string(body)), false},
+		{"no secret configured", "", signSlack("", now.Unix(), string(body)), false},
+		{"missing headers", "shh", http.Header{}, false},
+	}
+	for _, test := range tests {
+		err := verifySlackSignature(test.secret, test.header, body, now)
+		if got, want := err == nil, test.ok; got != want {
+			t.Errorf("%s: got ok %t, want %t (err: %v)", test.name, got, want, err)
+		}
+	}
+}
+
+func TestSlackExerciseKey(t *testing.T) {
+	for _, name := range []string{"Push Ups", "pushups", "push-up", "PUSHUP"} {
+		if got, want := slackExerciseKey(name), "pushup"; got != want {
+			t.Errorf("got %q, want %q for %q", got, want, name)
+		}
+	}
+}
+
+func TestSlackCommandHandler(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.conf.SlackSigningSecret = "shh"
+	s.conf.SlackBotToken = "xoxb-test"
+
+	slackAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "Bearer xoxb-test"; got != want {
+			t.Errorf("got auth %q, want %q", got, want)
+		}
+		domain := "twilio.com"
+		if r.URL.Query().Get("user") == "UOUTSIDE" {
+			domain = "example.com"
+		}
+		fmt.Fprintf(w, `{"ok":true,"user":{"profile":{"email":"%s@%s"}}}`, strings.ToLower(r.URL.Query().Get("user")), domain)
+	}))
+	defer slackAPI.Close()
+	s.slackAPIURL = slackAPI.URL
+
+	slackUser := "U123"
+	command := func(text string) slackResponse {
+		body := url.Values{"user_id": {slackUser}, "text": {text}}.Encode()
+		req := httptest.NewRequest(http.MethodPost, "/slack/command", strings.NewReader(body))
+		req.Header = signSlack("shh", time.Now().Unix(), body)
+		w := httptest.NewRecorder()
+		s.SlackCommandHandler(w, req)
+		if got, want := w.Code, http.StatusOK; got != want {
+			t.Fatalf("got status %d, want %d for %q", got, want, text)
+		}
+		var resp slackResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.ResponseType, "ephemeral"; got != want {
+			t.Errorf("got response type %q, want %q", got, want)
+		}
+		return resp
+	}
+
+	resp := command("20 pushups, 15 Squats")
+	if !strings.Contains(resp.Text, "Logged 20 Push Ups, 15 Squats") {
+		t.Errorf("unexpected response to logging reps: %q", resp.Text)
+	}
+
+	uid := mustCreateUser(t, s, "u123@twilio.com")
+	totals, err := s.getExerciseTotals(uid, 0, int(time.Now().Add(time.Hour).Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(totals), 2; got != want {
+		t.Fatalf("got %d exercise totals, want %d", got, want)
+	}
+
+	resp = command("20 jumping jacks")
+	if !strings.Contains(resp.Text, `I don't know the exercise "jumping jacks"`) {
+		t.Errorf("unexpected response to unknown exercise: %q", resp.Text)
+	}
+
+	resp = command("help")
+	if !strings.Contains(resp.Text, "/reps leaderboard") {
+		t.Errorf("unexpected response to help: %q", resp.Text)
+	}
+
+	denver, _ := s.getTeamByName("Denver")
+	if err := s.postMyTeams(denver.ID, uid); err != nil {
+		t.Fatal(err)
+	}
+
+	// looking around does not sign you up
+	slackUser = "U456"
+	command("help")
+	if resp := command("leaderboard"); !strings.Contains(resp.Text, "(points per person)") {
+		t.Errorf("unexpected response to leaderboard: %q", resp.Text)
+	}
+	var signedUp int
+	if err := s.DB.QueryRow("select count(*) from users where email='u456@twilio.com'").Scan(&signedUp); err != nil {
+		t.Fatal(err)
+	}
+	if signedUp != 0 {
+		t.Errorf("got a user created for help and leaderboard, want none")
+	}
+
+	slackUser = "UOUTSIDE"
+	resp = command("20 pushups")
+	if !strings.Contains(resp.Text, "only for twilio.com accounts") {
+		t.Errorf("unexpected response to someone outside twilio.com: %q", resp.Text)
+	}
+	if err := s.DB.QueryRow("select count(*) from users where email='uoutside@example.com'").Scan(&signedUp); err != nil {
+		t.Fatal(err)
+	}
+	if signedUp != 0 {
+		t.Errorf("got a user created for someone outside twilio.com")
+	}
+
+	// a bad signature never reaches the command
+	req := httptest.NewRequest(http.MethodPost, "/slack/command", strings.NewReader("user_id=U123&text=1000+pushups"))
+	req.Header = signSlack("wrong", time.Now().Unix(), "user_id=U123&text=1000+pushups")
+	w := httptest.NewRecorder()
+	s.SlackCommandHandler(w, req)
+	if got, want := w.Code, http.StatusUnauthorized; got != want {
+		t.Errorf("got status %d, want %d for bad signature", got, want)
+	}
+}
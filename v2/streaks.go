@@ -0,0 +1,274 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const dayFormat = "2006-01-02"
+
+// Streaks are runs of consecutive days with reps, by the user's local day. A frozen rest day keeps a streak going but does not add to it
+type Streaks struct {
+	Current int
+	Longest int
+	// LastActive is the most recent local day with reps, as YYYY-MM-DD
+	LastActive string `json:",omitempty"`
+	Timezone   string
+
+	// Frozen are the rest days taken this challenge. FreezesLeft is how many more can be taken
+	Frozen      []string
+	FreezesLeft int
+}
+
+// computeStreaks walks every day from the first active day through today. Today not having reps yet does not break the current streak
+func computeStreaks(active, frozen map[string]bool, today string) (int, int) {
+	if len(active) == 0 {
+		return 0, 0
+	}
+
+	var days []string
+	for day := range active {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	// days are walked in UTC so DST changes never skip or repeat a day
+	day, err := time.Parse(dayFormat, days[0])
+	if err != nil {
+		return 0, 0
+	}
+	end, err := time.Parse(dayFormat, today)
+	if err != nil || end.Before(day) {
+		end, _ = time.Parse(dayFormat, days[len(days)-1])
+	}
+
+	var run, longest int
+	for ; !day.After(end); day = day.AddDate(0, 0, 1) {
+		key := day.Format(dayFormat)
+		switch {
+		case active[key]:
+			run++
+		case frozen[key]:
+		case key == today:
+		default:
+			run = 0
+		}
+		if run > longest {
+			longest = run
+		}
+	}
+
+	return run, longest
+}
+
+// getStreaks computes the user's streaks as of now in their timezone
+func (s *Server) getStreaks(uid int, now time.Time) (*Streaks, error) {
+	prefs, err := s.getPreferences(uid)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(prefs.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	rows, err := s.DB.Query("select distinct created_on from reps where user_id=?", uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getStreaks: %w", err)
+	}
+	defer rows.Close()
+
+	active := make(map[string]bool)
+	for rows.Next() {
+		var createdOn int64
+		if err := rows.Scan(&createdOn); err != nil {
+			return nil, fmt.Errorf("unable to scan getStreaks: %w", err)
+		}
+		active[time.Unix(createdOn, 0).In(loc).Format(dayFormat)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getStreaks: %w", err)
+	}
+
+	frozenDays, err := s.getStreakFreezes(uid)
+	if err != nil {
+		return nil, err
+	}
+	frozen := make(map[string]bool)
+	for _, day := range frozenDays {
+		frozen[day] = true
+	}
+
+	streaks := &Streaks{Timezone: loc.String(), Frozen: make([]string, 0)}
+	streaks.Current, streaks.Longest = computeStreaks(active, frozen, now.In(loc).Format(dayFormat))
+	for day := range active {
+		if day > streaks.LastActive {
+			streaks.LastActive = day
+		}
+	}
+
+	first, last := s.challengeDays(now)
+	for _, day := range frozenDays {
+		if day >= first && day <= last {
+			streaks.Frozen = append(streaks.Frozen, day)
+		}
+	}
+	if left := s.conf.StreakFreezes - len(streaks.Frozen); left > 0 {
+		streaks.FreezesLeft = left
+	}
+
+	return streaks, nil
+}
+
+// challengeDays are the first and last days of the current challenge as YYYY-MM-DD
+func (s *Server) challengeDays(now time.Time) (string, string) {
+	start, end := s.conf.Challenge(now)
+	return start.Format(dayFormat), end.AddDate(0, 0, -1).Format(dayFormat)
+}
+
+func (s *Server) getStreakFreezes(uid int) ([]string, error) {
+	rows, err := s.DB.Query("select day from streak_freezes where user_id=? order by day", uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getStreakFreezes: %w", err)
+	}
+	defer rows.Close()
+
+	var days []string
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			return nil, fmt.Errorf("unable to scan getStreakFreezes: %w", err)
+		}
+		days = append(days, day)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getStreakFreezes: %w", err)
+	}
+	return days, nil
+}
+
+// checkStreakFreeze returns why day cannot be one of the user's rest days, or "" if it can.
+// Only today or yesterday can be frozen, so rest days cannot be used to patch old gaps in a streak.
+func (s *Server) checkStreakFreeze(uid int, streaks *Streaks, day string, now time.Time) (string, error) {
+	loc, err := time.LoadLocation(streaks.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	today := now.In(loc).Format(dayFormat)
+	yesterday := now.In(loc).AddDate(0, 0, -1).Format(dayFormat)
+	first, last := s.challengeDays(now)
+
+	switch {
+	case s.conf.StreakFreezes <= 0:
+		return "rest days are not enabled", nil
+	case day != today && day != yesterday:
+		return fmt.Sprintf("only today (%s) or yesterday (%s) can be a rest day", today, yesterday), nil
+	case day < first || day > last:
+		return fmt.Sprintf("%s is not part of the current challenge", day), nil
+	case inList(day, streaks.Frozen):
+		return fmt.Sprintf("%s is already a rest day", day), nil
+	case streaks.FreezesLeft <= 0:
+		return "no rest days left this challenge", nil
+	}
+
+	start := dayStart(day, loc)
+	active, err := s.hasReps(uid, int(start.Unix()), int(start.AddDate(0, 0, 1).Unix()))
+	if err != nil {
+		return "", err
+	}
+	if active {
+		return fmt.Sprintf("you already logged reps on %s", day), nil
+	}
+	return "", nil
+}
+
+func (s *Server) postStreakFreeze(uid int, day string, now time.Time) error {
+	_, err := s.DB.Exec("insert into streak_freezes (user_id, day, created_on) values (?, ?, ?)", uid, day, now.Unix())
+	if err != nil {
+		return fmt.Errorf("unable to postStreakFreeze: %w", err)
+	}
+	return nil
+}
+
+// dayStart is midnight at the start of the YYYY-MM-DD day in loc
+func dayStart(day string, loc *time.Location) time.Time {
+	t, _ := time.ParseInLocation(dayFormat, day, loc)
+	return t
+}
+
+func (s *Server) GetStreaks(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	data, err := s.getStreaks(uid, time.Now())
+	if err != nil {
+		log.Printf("unable to GetStreaks: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("GetStreaks marshal err ", err.Error())
+	}
+}
+
+// PostStreakFreeze takes a rest day. Body: {"Day": "YYYY-MM-DD"}, defaulting to today
+func (s *Server) PostStreakFreeze(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var freeze struct{ Day string }
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &freeze); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	streaks, err := s.getStreaks(uid, now)
+	if err != nil {
+		log.Printf("unable to PostStreakFreeze: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if freeze.Day == "" {
+		loc, _ := time.LoadLocation(streaks.Timezone)
+		freeze.Day = now.In(loc).Format(dayFormat)
+	}
+
+	reason, err := s.checkStreakFreeze(uid, streaks, freeze.Day, now)
+	if err != nil {
+		log.Printf("unable to PostStreakFreeze: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+
+	if err := s.postStreakFreeze(uid, freeze.Day, now); err != nil {
+		log.Printf("unable to PostStreakFreeze: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := s.getStreaks(uid, now)
+	if err != nil {
+		log.Printf("unable to PostStreakFreeze: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("PostStreakFreeze marshal err ", err.Error())
+	}
+}
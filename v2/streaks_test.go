@@ -0,0 +1,152 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func days(keys ...string) map[string]bool {
+	m := make(map[string]bool)
+	for _, k := range keys {
+		m[k] = true
+	}
+	return m
+}
+
+func TestComputeStreaks(t *testing.T) {
+	tests := []struct {
+		name        string
+		active      map[string]bool
+		frozen      map[string]bool
+		today       string
+		wantCurrent int
+		wantLongest int
+	}{
+		{"nothing", days(), days(), "2020-11-10", 0, 0},
+		{"today only", days("2020-11-10"), days(), "2020-11-10", 1, 1},
+		{"not yet today", days("2020-11-08", "2020-11-09"), days(), "2020-11-10", 2, 2},
+		{"missed yesterday", days("2020-11-07", "2020-11-08"), days(), "2020-11-10", 0, 2},
+		{"longest in the past", days("2020-11-01", "2020-11-02", "2020-11-03", "2020-11-09", "2020-11-10"), days(), "2020-11-10", 2, 3},
+		{"rest day bridges", days("2020-11-07", "2020-11-09", "2020-11-10"), days("2020-11-08"), "2020-11-10", 3, 3},
+		{"rest day yesterday", days("2020-11-07", "2020-11-08"), days("2020-11-09"), "2020-11-10", 2, 2},
+		{"across months", days("2020-10-31", "2020-11-01"), days(), "2020-11-01", 2, 2},
+	}
+	for _, test := range tests {
+		current, longest := computeStreaks(test.active, test.frozen, test.today)
+		if current != test.wantCurrent || longest != test.wantLongest {
+			t.Errorf("%s: got current %d longest %d, want current %d longest %d", test.name, current, longest, test.wantCurrent, test.wantLongest)
+		}
+	}
+}
+
+func TestGetStreaksLocalDay(t *testing.T) {
+	s, _ := newTestServer(t)
+	uid := mustCreateUser(t, s, "seth.ammons@twilio.com")
+
+	// 11pm on the 9th and 11pm on the 10th in Denver are both early morning UTC on the next day
+	denver, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsertReps(t, s, uid, "Push Ups", 10, time.Date(2020, 11, 9, 23, 0, 0, 0, denver))
+	mustInsertReps(t, s, uid, "Push Ups", 10, time.Date(2020, 11, 10, 23, 0, 0, 0, denver))
+	mustInsertReps(t, s, uid, "Push Ups", 10, time.Date(2020, 11, 11, 1, 0, 0, 0, denver))
+	now := time.Date(2020, 11, 11, 12, 0, 0, 0, denver)
+
+	streaks, err := s.getStreaks(uid, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in UTC, the three entries only cover the 10th and 11th
+	if got, want := streaks.Current, 2; got != want {
+		t.Errorf("got UTC current streak %d, want %d", got, want)
+	}
+
+	if err := s.putPreferences(uid, &Preferences{Timezone: "America/Denver", Reminders: true}); err != nil {
+		t.Fatal(err)
+	}
+	streaks, err = s.getStreaks(uid, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := streaks.Current, 3; got != want {
+		t.Errorf("got Denver current streak %d, want %d", got, want)
+	}
+	if got, want := streaks.LastActive, "2020-11-11"; got != want {
+		t.Errorf("got last active %q, want %q", got, want)
+	}
+}
+
+func TestCheckStreakFreeze(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.conf.StreakFreezes = 1
+	uid := mustCreateUser(t, s, "seth.ammons@twilio.com")
+	now := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+	mustInsertReps(t, s, uid, "Push Ups", 10, now.Add(-time.Hour))
+
+	tests := []struct {
+		name string
+		day  string
+		ok   bool
+	}{
+		{"already logged today", "2020-11-11", false},
+		{"too long ago", "2020-11-05", false},
+		{"tomorrow", "2020-11-12", false},
+		{"yesterday", "2020-11-10", true},
+	}
+	for _, test := range tests {
+		streaks, err := s.getStreaks(uid, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reason, err := s.checkStreakFreeze(uid, streaks, test.day, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := reason == "", test.ok; got != want {
+			t.Errorf("%s: got ok %t, want %t (%s)", test.name, got, want, reason)
+		}
+	}
+
+	if err := s.postStreakFreeze(uid, "2020-11-10", now); err != nil {
+		t.Fatal(err)
+	}
+	streaks, err := s.getStreaks(uid, now.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := streaks.FreezesLeft, 0; got != want {
+		t.Errorf("got %d freezes left, want %d", got, want)
+	}
+	reason, err := s.checkStreakFreeze(uid, streaks, "2020-11-12", now.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason == "" {
+		t.Error("got ok, want no rest days left")
+	}
+}
+
+func TestGetStatsStreaksOptIn(t *testing.T) {
+	s, _ := newTestServer(t)
+	c := newTestClient(t, s, "seth.ammons@twilio.com")
+	c.do("POST", "/v3/stats", `{"Exercises": [{"Name": "Push Ups", "Count": 20}]}`)
+
+	// the array is what /v3/stats has always returned
+	var stats []Stats
+	if err := json.NewDecoder(c.do("GET", "/v3/stats", "").Body).Decode(&stats); err != nil {
+		t.Fatalf("got %v decoding the default response as an array", err)
+	}
+	if got, want := len(stats), 1; got != want {
+		t.Errorf("got %d stats, want %d", got, want)
+	}
+
+	var resp StatsResponse
+	if err := json.NewDecoder(c.do("GET", "/v3/stats?streaks=true", "").Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Streaks == nil || resp.Streaks.Current != 1 || len(resp.Stats) != 1 {
+		t.Errorf("got %+v, want the stats with a current streak of 1", resp)
+	}
+}
@@ -0,0 +1,367 @@
+package countmyreps
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// streamHistory is how many past events are kept for clients resuming with Last-Event-ID
+	streamHistory = 256
+	// streamClientBuffer is how far a client can fall behind before it is disconnected. It can reconnect and resume from history
+	streamClientBuffer = 64
+)
+
+// StreamSnapshot is the first event on a new stream, and on a resumed stream that fell too far behind. It is the full challenge leaderboard
+type StreamSnapshot struct {
+	Totals   []Exercise
+	Rankings []TeamRank
+}
+
+// StreamTotals is sent after reps change. Totals are challenge wide and Teams are the affected teams' new standings
+type StreamTotals struct {
+	Totals []Exercise
+	Teams  []TeamRank
+}
+
+// StreamRankings is sent when any team's rank changes. Changes are the teams that moved; a From of 0 is a newly ranked team
+type StreamRankings struct {
+	Changes  []RankChange
+	Rankings []TeamRank
+}
+
+type streamEvent struct {
+	id   int
+	name string
+	data []byte
+	// teams the event is about, for clients following a single team. Empty is everyone
+	teams []int
+}
+
+type streamClient struct {
+	team   int
+	events chan streamEvent
+}
+
+func (c *streamClient) wants(e streamEvent) bool {
+	if c.team == 0 || len(e.teams) == 0 {
+		return true
+	}
+	return inIntList(c.team, e.teams)
+}
+
+// streamHub fans leaderboard updates out to /v3/stream clients and keeps recent history for Last-Event-ID resume
+type streamHub struct {
+	mu       sync.Mutex
+	lastID   int
+	history  []streamEvent
+	clients  map[*streamClient]struct{}
+	rankings []TeamRank
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{
+		// ids start at the boot time in ms so an id from before a restart does not look resumable
+		lastID:  int(time.Now().UnixNano() / int64(time.Millisecond)),
+		clients: make(map[*streamClient]struct{}),
+	}
+}
+
+// join registers a client. It returns the events after lastEventID if they are all still in history, and false if the client needs a snapshot
+func (h *streamHub) join(team int, lastEventID int) (*streamClient, []streamEvent, int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := &streamClient{team: team, events: make(chan streamEvent, streamClientBuffer)}
+	h.clients[c] = struct{}{}
+
+	if lastEventID <= 0 || lastEventID > h.lastID {
+		return c, nil, h.lastID, false
+	}
+	if lastEventID == h.lastID {
+		return c, nil, h.lastID, true
+	}
+	if len(h.history) == 0 || h.history[0].id > lastEventID+1 {
+		return c, nil, h.lastID, false
+	}
+
+	var missed []streamEvent
+	for _, e := range h.history {
+		if e.id > lastEventID && c.wants(e) {
+			missed = append(missed, e)
+		}
+	}
+	return c, missed, h.lastID, true
+}
+
+func (h *streamHub) leave(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.events)
+	}
+}
+
+// seed sets the rankings that the first update is compared against, if there are none yet
+func (h *streamHub) seed(rankings []TeamRank) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rankings == nil {
+		h.rankings = rankings
+	}
+}
+
+// update broadcasts new totals for the affected teams and any rank changes since the last update
+func (h *streamHub) update(teams []int, totals []Exercise, rankings []TeamRank) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	affected := make([]TeamRank, 0)
+	for _, r := range rankings {
+		if inIntList(r.TeamID, teams) {
+			affected = append(affected, r)
+		}
+	}
+	if err := h.broadcast("totals", teams, StreamTotals{Totals: totals, Teams: affected}); err != nil {
+		return err
+	}
+
+	if h.rankings != nil {
+		if changes := rankMoves(h.rankings, rankings); len(changes) > 0 {
+			var moved []int
+			for _, c := range changes {
+				moved = append(moved, c.TeamID)
+			}
+			if err := h.broadcast("rankings", moved, StreamRankings{Changes: changes, Rankings: rankings}); err != nil {
+				return err
+			}
+		}
+	}
+	h.rankings = rankings
+
+	return nil
+}
+
+// broadcast must be called with the lock held
+func (h *streamHub) broadcast(name string, teams []int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("unable to marshal %s stream event: %w", name, err)
+	}
+
+	h.lastID++
+	e := streamEvent{id: h.lastID, name: name, data: data, teams: teams}
+
+	h.history = append(h.history, e)
+	if len(h.history) > streamHistory {
+		h.history = h.history[len(h.history)-streamHistory:]
+	}
+
+	for c := range h.clients {
+		if !c.wants(e) {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+			// too slow; drop it so it reconnects and resumes instead of holding everyone up
+			delete(h.clients, c)
+			close(c.events)
+		}
+	}
+	return nil
+}
+
+// rankMoves returns every team whose rank differs between previous and current, in current rank order
+func rankMoves(previous, current []TeamRank) []RankChange {
+	before := make(map[int]int)
+	for _, r := range previous {
+		before[r.TeamID] = r.Rank
+	}
+
+	changes := make([]RankChange, 0)
+	for _, r := range current {
+		if from := before[r.TeamID]; from != r.Rank {
+			changes = append(changes, RankChange{TeamID: r.TeamID, Name: r.Name, From: from, To: r.Rank})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].To < changes[j].To })
+	return changes
+}
+
+func inIntList(n int, list []int) bool {
+	for _, elem := range list {
+		if n == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// handleStreamEvent is the event bus subscriber that turns rep and team changes into leaderboard stream updates
+func (s *Server) handleStreamEvent(e Event) error {
+	var teams []int
+	var at time.Time
+
+	switch e := e.(type) {
+	case RepsLogged:
+		at = e.At
+		teams = s.streamTeams(e.UserID)
+	case RepEdited:
+		at = e.At
+		teams = s.streamTeams(e.UserID)
+	case RepDeleted:
+		at = e.At
+		teams = s.streamTeams(e.UserID)
+	case RepsDeleted:
+		at = e.At
+		teams = s.streamTeams(e.UserID)
+	case TeamJoined:
+		at = e.At
+		teams = []int{e.TeamID}
+	case TeamLeft:
+		at = e.At
+		teams = []int{e.TeamID}
+	default:
+		return nil
+	}
+
+	totals, rankings, err := s.streamStandings(at)
+	if err != nil {
+		return err
+	}
+	return s.stream.update(teams, totals, rankings)
+}
+
+// streamTeams are the user's teams and every team above them, since their totals roll up.
+// It is best effort; without the user's teams the update still goes to everyone following the whole leaderboard
+func (s *Server) streamTeams(uid int) []int {
+	q := "with recursive up(id) as (select team_id from user_teams where user_id=? union select teams.parent_id from teams join up on teams.id=up.id where teams.parent_id!=0) select id from up"
+	rows, err := s.DB.Query(q, uid)
+	if err != nil {
+		log.Printf("unable to get teams for stream update: %s", err.Error())
+		return nil
+	}
+	defer rows.Close()
+
+	teams := make([]int, 0)
+	for rows.Next() {
+		var teamID int
+		if err := rows.Scan(&teamID); err != nil {
+			log.Printf("unable to scan teams for stream update: %s", err.Error())
+			return nil
+		}
+		teams = append(teams, teamID)
+	}
+	return teams
+}
+
+// streamStandings are the challenge wide totals and team rankings of the challenge in progress at at
+func (s *Server) streamStandings(at time.Time) ([]Exercise, []TeamRank, error) {
+	start, end := s.conf.Challenge(at)
+	totals, err := s.getExerciseTotals(-1, int(start.Unix()), int(end.Unix()))
+	if err != nil {
+		return nil, nil, err
+	}
+	rankings, err := s.getTeamRankings(int(start.Unix()), int(end.Unix()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return totals, rankings, nil
+}
+
+// streamAuth lets a request with ?display_token= matching COUNTMYREPS_STREAM_DISPLAY_TOKEN through, since an EventSource on a
+// shared display cannot send a bearer token. Everything else goes through authMiddleware
+func (s *Server) streamAuth(next http.Handler) http.Handler {
+	signedIn := s.authMiddleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("display_token")
+		if s.conf.StreamDisplayToken != "" && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.StreamDisplayToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		signedIn.ServeHTTP(w, r)
+	})
+}
+
+// StreamHandler pushes leaderboard updates as Server-Sent Events. Only challenge wide aggregates are sent. It needs a signed in
+// user, or the display token for shared displays (see streamAuth). Options: ?team={:team_id:} to only get updates about one team.
+// Clients reconnecting with a Last-Event-ID header (or ?lastEventId=) get the events they missed, or a fresh snapshot if too many were missed.
+func (s *Server) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	team, _ := strconv.Atoi(r.URL.Query().Get("team"))
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	lastID, _ := strconv.Atoi(lastEventID)
+
+	client, missed, snapshotID, resumed := s.stream.join(team, lastID)
+	defer s.stream.leave(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 3000\n\n")
+
+	if !resumed {
+		totals, rankings, err := s.streamStandings(time.Now())
+		if err != nil {
+			log.Printf("unable to get stream snapshot: %s", err.Error())
+			return
+		}
+		s.stream.seed(rankings)
+
+		data, err := json.Marshal(StreamSnapshot{Totals: totals, Rankings: rankings})
+		if err != nil {
+			log.Println("StreamHandler marshal err ", err.Error())
+			return
+		}
+		missed = []streamEvent{{id: snapshotID, name: "snapshot", data: data}}
+	}
+	for _, e := range missed {
+		writeStreamEvent(w, e)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.conf.StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case e, ok := <-client.events:
+			if !ok {
+				return
+			}
+			writeStreamEvent(w, e)
+			flusher.Flush()
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, e streamEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, e.name, e.data)
+}
@@ -0,0 +1,230 @@
+package countmyreps
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	id   string
+	name string
+	data string
+}
+
+// openStream connects to the stream and parses events onto the returned channel until the returned func is called
+func openStream(t *testing.T, url string, lastEventID string) (<-chan sseEvent, func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Fatalf("got content type %q, want %q", got, want)
+	}
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+
+		var e sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			case line == "" && e.name != "":
+				events <- e
+				e = sseEvent{}
+			}
+		}
+	}()
+
+	return events, cancel
+}
+
+func nextStreamEvent(t *testing.T, events <-chan sseEvent, wantName string) sseEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.name != wantName {
+			t.Fatalf("got %q event, want %q: %s", e.name, wantName, e.data)
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q event", wantName)
+	}
+	return sseEvent{}
+}
+
+func noStreamEvent(t *testing.T, events <-chan sseEvent) {
+	t.Helper()
+	select {
+	case e := <-events:
+		t.Fatalf("got unexpected %q event: %s", e.name, e.data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	s, _ := newTestServer(t)
+	srv := httptest.NewServer(http.HandlerFunc(s.StreamHandler))
+	defer srv.Close()
+
+	seth := mustCreateUser(t, s, "seth.ammons@twilio.com")
+	other := mustCreateUser(t, s, "someone@twilio.com")
+	alpha, err := s.postTeam("Alpha Lifters", seth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beta, err := s.postTeam("Beta Lifters", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.events.wait()
+
+	events, stop := openStream(t, srv.URL, "")
+	snapshot := nextStreamEvent(t, events, "snapshot")
+
+	// reps are in the configured 2020 challenge, so publish the event the way postStats would for them
+	at := time.Date(2020, 11, 10, 12, 0, 0, 0, time.UTC)
+	mustInsertReps(t, s, seth, "Push Ups", 20, at)
+	s.events.publish(RepsLogged{UserID: seth, At: at})
+
+	e := nextStreamEvent(t, events, "totals")
+	var totals StreamTotals
+	if err := json.Unmarshal([]byte(e.data), &totals); err != nil {
+		t.Fatal(err)
+	}
+	if len(totals.Totals) != 1 || totals.Totals[0].Count != 20 {
+		t.Errorf("got totals %+v, want 20 Push Ups", totals.Totals)
+	}
+	if len(totals.Teams) != 1 || totals.Teams[0].TeamID != alpha.ID {
+		t.Errorf("got teams %+v, want only %s", totals.Teams, alpha.Name)
+	}
+	// alpha was already first alphabetically, so no rank change
+	noStreamEvent(t, events)
+	firstTotals := e.id
+
+	mustInsertReps(t, s, other, "Squats", 50, at)
+	s.events.publish(RepsLogged{UserID: other, At: at})
+	nextStreamEvent(t, events, "totals")
+	e = nextStreamEvent(t, events, "rankings")
+	var rankings StreamRankings
+	if err := json.Unmarshal([]byte(e.data), &rankings); err != nil {
+		t.Fatal(err)
+	}
+	want := []RankChange{{TeamID: beta.ID, Name: beta.Name, From: 2, To: 1}, {TeamID: alpha.ID, Name: alpha.Name, From: 1, To: 2}}
+	if got, want := len(rankings.Changes), len(want); got != want {
+		t.Fatalf("got %d rank changes, want %d", got, want)
+	}
+	for i := range want {
+		if rankings.Changes[i] != want[i] {
+			t.Errorf("got rank change %+v, want %+v", rankings.Changes[i], want[i])
+		}
+	}
+	stop()
+
+	tests := []struct {
+		name        string
+		query       string
+		lastEventID string
+		want        []string
+	}{
+		{"resume", "", firstTotals, []string{"totals", "rankings"}},
+		{"resume from snapshot", "", snapshot.id, []string{"totals", "totals", "rankings"}},
+		{"resume one team", "?team=" + strconv.Itoa(alpha.ID), snapshot.id, []string{"totals", "rankings"}},
+		{"too old to resume", "", "1", []string{"snapshot"}},
+		{"garbage", "", "nope", []string{"snapshot"}},
+	}
+	for _, test := range tests {
+		events, stop := openStream(t, srv.URL+test.query, test.lastEventID)
+		for _, name := range test.want {
+			nextStreamEvent(t, events, name)
+		}
+		noStreamEvent(t, events)
+		stop()
+	}
+}
+
+func TestStreamHubDropsSlowClients(t *testing.T) {
+	h := newStreamHub()
+	slow, _, _, _ := h.join(0, 0)
+
+	for i := 0; i < streamClientBuffer+1; i++ {
+		if err := h.update(nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received int
+	for range slow.events {
+		received++
+	}
+	if got, want := received, streamClientBuffer; got != want {
+		t.Errorf("got %d events before disconnect, want %d", got, want)
+	}
+
+	// leaving after being dropped must not double close
+	h.leave(slow)
+}
+
+func TestStreamAuth(t *testing.T) {
+	s, _ := newTestServer(t)
+	c := newTestClient(t, s, "seth.ammons@twilio.com")
+
+	// the stream never ends on its own, so each request is cut off once it has started
+	get := func(path string, signedIn bool) int {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		r := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		if signedIn {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		c.mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if got, want := get("/v3/stream", false), http.StatusBadRequest; got != want {
+		t.Errorf("got %d without signing in, want %d", got, want)
+	}
+	if got, want := get("/v3/stream", true), http.StatusOK; got != want {
+		t.Errorf("got %d signed in, want %d", got, want)
+	}
+	// no display token is set, so an empty one does not get in
+	if got, want := get("/v3/stream?display_token=", false), http.StatusBadRequest; got != want {
+		t.Errorf("got %d with an empty display token, want %d", got, want)
+	}
+
+	s.conf.StreamDisplayToken = "office-tv"
+	if got, want := get("/v3/stream?display_token=nope", false), http.StatusBadRequest; got != want {
+		t.Errorf("got %d with the wrong display token, want %d", got, want)
+	}
+	if got, want := get("/v3/stream?display_token=office-tv", false), http.StatusOK; got != want {
+		t.Errorf("got %d with the display token, want %d", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+// Package teamname normalizes team names so a team is found however its name is typed, and spots names that are probably duplicates.
+// It is shared by v1 and v2 so both find the same team for the same name.
+package teamname
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+var folder = cases.Fold()
+
+// Normalize is the name as it should be stored and shown: Unicode NFC, with runs of whitespace collapsed to one space and trimmed
+func Normalize(name string) string {
+	return strings.Join(strings.Fields(norm.NFC.String(name)), " ")
+}
+
+// Key is what names are compared by. Names with the same key are the same team
+func Key(name string) string {
+	return norm.NFC.String(folder.String(Normalize(name)))
+}
+
+// Sanitize is Normalize without anything but letters, digits, spaces, and the punctuation team names use (_ - ( ) .), for
+// names that come from places like email subjects. Word separators are kept, so the result has the same Key as the name
+// typed anywhere else. Letters with accents are kept whether they were typed precomposed or with combining marks
+func Sanitize(name string) string {
+	var rns []rune
+	for _, r := range norm.NFC.String(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || unicode.IsSpace(r) || strings.ContainsRune("_-().", r) {
+			rns = append(rns, r)
+		}
+	}
+	return Normalize(string(rns))
+}
+
+// Similar reports whether b is confusably close to a: the same once accents and punctuation are ignored,
+// one name's words are all in the other ("Denver" and "Denver Office"), or a typo or two apart
+func Similar(a, b string) bool {
+	wordsA, wordsB := skeleton(a), skeleton(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return false
+	}
+
+	joinedA, joinedB := strings.Join(wordsA, ""), strings.Join(wordsB, "")
+	if joinedA == joinedB || subset(wordsA, wordsB) || subset(wordsB, wordsA) {
+		return true
+	}
+
+	shortest := len([]rune(joinedA))
+	if n := len([]rune(joinedB)); n < shortest {
+		shortest = n
+	}
+	switch {
+	case shortest < 4:
+		// too short for a typo to mean anything; "Ops" and "Eng" are not the same team
+		return false
+	case shortest < 8:
+		return distance(joinedA, joinedB) <= 1
+	default:
+		return distance(joinedA, joinedB) <= 2
+	}
+}
+
+// skeleton is the name's words, case folded, without accents or punctuation
+func skeleton(name string) []string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(Key(name)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Fields(b.String())
+}
+
+func subset(small, big []string) bool {
+	for _, word := range small {
+		var found bool
+		for _, other := range big {
+			if word == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// distance is the Levenshtein edit distance between a and b, in runes
+func distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minOf(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func minOf(n int, rest ...int) int {
+	for _, m := range rest {
+		if m < n {
+			n = m
+		}
+	}
+	return n
+}
@@ -0,0 +1,86 @@
+package teamname
+
+import "testing"
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"Denver", "denver", true},
+		{"Denver ", " DENVER", true},
+		{"Dublin  (Block)", "dublin (block)", true},
+		// precomposed and combining accents are the same name
+		{"München", "Mu\u0308nchen", true},
+		{"São Paulo", "são paulo", true},
+		{"Straße", "STRASSE", true},
+		{"São Paulo", "Sao Paulo", false},
+		{"Denver", "Denver Office", false},
+	}
+	for _, test := range tests {
+		if got := Key(test.a) == Key(test.b); got != test.same {
+			t.Errorf("Key(%q) == Key(%q) got %t, want %t", test.a, test.b, got, test.same)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"  Denver   Office ", "Denver Office"},
+		{"Mu\u0308nchen", "München"},
+		{"Sa\u0303o\tPaulo", "São Paulo"},
+	}
+	for _, test := range tests {
+		if got := Normalize(test.in); got != test.out {
+			t.Errorf("Normalize(%q) got %q, want %q", test.in, got, test.out)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"Big_Data", "Big_Data"},
+		{"Big Data", "Big Data"},
+		{" Big   Data ", "Big Data"},
+		{"<script type='javascript'>", "script typejavascript"},
+		{"München", "München"},
+		{"Mu\u0308nchen", "München"},
+		{"São Paulo", "São Paulo"},
+		{"Dublin (Block)", "Dublin (Block)"},
+	}
+	for _, test := range tests {
+		if got := Sanitize(test.in); got != test.out {
+			t.Errorf("Sanitize(%q) got %q, want %q", test.in, got, test.out)
+		}
+		// a name typed in an email subject finds the same team as the name typed anywhere else
+		if test.in == test.out && Key(Sanitize(test.in)) != Key(test.in) {
+			t.Errorf("Key(Sanitize(%q)) got %q, want %q", test.in, Key(Sanitize(test.in)), Key(test.in))
+		}
+	}
+}
+
+func TestSimilar(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		similar bool
+	}{
+		{"Denver", "Denver Office", true},
+		{"Sao Paulo", "São Paulo", true},
+		{"Dublin-Block", "Dublin (Block)", true},
+		{"Engineering", "Enginering", true},
+		{"Irvine", "Irvin", true},
+		{"Denver", "Dublin", false},
+		{"Ops", "Eng", false},
+		{"Sales", "Legal", false},
+		{"Dublin (Block)", "Dublin (Wall)", false},
+	}
+	for _, test := range tests {
+		if got := Similar(test.a, test.b); got != test.similar {
+			t.Errorf("Similar(%q, %q) got %t, want %t", test.a, test.b, got, test.similar)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package countmyreps
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sethgrid/countmyreps/v2/teamname"
+)
+
+// TeamSummary is a team's per capita numbers between Start (inclusive) and End (exclusive).
+// Participating members are the ones who logged something in the window, not everyone on the team.
+// HeadCount is the owner's expected head count when set, otherwise Members
+type TeamSummary struct {
+	TeamID int
+	Name   string
+	Start  int
+	End    int
+	// Days is how much of the window has passed, at least 1
+	Days int
+
+	Members                          int
+	HeadCount                        int
+	Participating                    int
+	PercentParticipating             int
+	TotalReps                        int
+	RepsPerPerson                    int
+	RepsPerPersonParticipating       int
+	RepsPerPersonPerDay              int
+	RepsPerPersonParticipatingPerDay int
+	TotalPoints                      int
+	PointsPerPerson                  int
+	PointsPerPersonParticipating     int
+
+	Exercises []Exercise
+}
+
+// getTeamSummary returns nil if there is no such team
+func (s *Server) getTeamSummary(teamID int, start, end int, now time.Time) (*TeamSummary, error) {
+	team, err := s.getTeamByID(teamID)
+	if err != nil || team == nil {
+		return nil, err
+	}
+	summary := &TeamSummary{TeamID: team.ID, Name: team.Name, Start: start, End: end}
+
+	q := "select count(*) from (" + teamMembersSQL + ")"
+	if err := s.DB.QueryRow(q, teamID).Scan(&summary.Members); err != nil {
+		return nil, fmt.Errorf("unable to scan getTeamSummary members: %w", err)
+	}
+	summary.HeadCount = teamHeadCount(team.HeadCount, summary.Members)
+
+	var points float64
+	q = "select count(distinct user_id), coalesce(sum(count), 0), coalesce(sum(points), 0) from reps where user_id in (" + teamMembersSQL + ") and created_on>=? and created_on<?"
+	if err := s.DB.QueryRow(q, teamID, start, end).Scan(&summary.Participating, &summary.TotalReps, &points); err != nil {
+		return nil, fmt.Errorf("unable to scan getTeamSummary totals: %w", err)
+	}
+	summary.TotalPoints = roundPoints(points)
+
+	summary.Exercises, err = s.getTeamExerciseTotals(teamID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	// a window still in progress is averaged over the days so far, so per day numbers are not dragged down by days yet to come
+	elapsed := end
+	if int(now.Unix()) < elapsed {
+		elapsed = int(now.Unix())
+	}
+	summary.Days = (elapsed - start + 86399) / 86400
+	if summary.Days < 1 {
+		summary.Days = 1
+	}
+
+	if summary.HeadCount > 0 {
+		summary.PercentParticipating = summary.Participating * 100 / summary.HeadCount
+		summary.RepsPerPerson = summary.TotalReps / summary.HeadCount
+		summary.RepsPerPersonPerDay = summary.TotalReps / summary.HeadCount / summary.Days
+		summary.PointsPerPerson = summary.TotalPoints / summary.HeadCount
+	}
+	if summary.Participating > 0 {
+		summary.RepsPerPersonParticipating = summary.TotalReps / summary.Participating
+		summary.RepsPerPersonParticipatingPerDay = summary.TotalReps / summary.Participating / summary.Days
+		summary.PointsPerPersonParticipating = summary.TotalPoints / summary.Participating
+	}
+
+	return summary, nil
+}
+
+// GetTeamSummary defaults to the current challenge. Options: ?startdate={:unix_ts:}&enddate={:unix_ts:}
+func (s *Server) GetTeamSummary(w http.ResponseWriter, r *http.Request) {
+	teamID, err := strconv.Atoi(chi.URLParam(r, "teamID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hidden, err := s.isTeamHidden(r, teamID)
+	if err != nil {
+		log.Printf("unable to GetTeamSummary: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hidden {
+		http.Error(w, "team not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	challengeStart, challengeEnd := s.conf.Challenge(now)
+	start, end := int(challengeStart.Unix()), int(challengeEnd.Unix())
+	if ts, err := strconv.Atoi(r.URL.Query().Get("startdate")); err == nil && ts > 0 {
+		start = ts
+	}
+	if ts, err := strconv.Atoi(r.URL.Query().Get("enddate")); err == nil && ts > 0 {
+		end = ts
+	}
+	if end <= start {
+		http.Error(w, "enddate must be after startdate", http.StatusBadRequest)
+		return
+	}
+
+	summary, err := s.getTeamSummary(teamID, start, end, now)
+	if err != nil {
+		log.Printf("unable to GetTeamSummary: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if summary == nil {
+		http.Error(w, "team not found", http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Println("GetTeamSummary marshal err ", err.Error())
+	}
+}
+
+// teamChildren maps each team id to the ids of the teams directly under it
+func teamChildren(teams []Team) map[int][]int {
+	children := make(map[int][]int)
+	for _, t := range teams {
+		if t.ParentID != 0 {
+			children[t.ParentID] = append(children[t.ParentID], t.ID)
+		}
+	}
+	return children
+}
+
+// teamSubtree is the team and every team under it
+func teamSubtree(teamID int, children map[int][]int) []int {
+	seen := map[int]bool{teamID: true}
+	subtree := []int{teamID}
+	for i := 0; i < len(subtree); i++ {
+		for _, child := range children[subtree[i]] {
+			if !seen[child] {
+				seen[child] = true
+				subtree = append(subtree, child)
+			}
+		}
+	}
+	return subtree
+}
+
+// buildTeamTree nests teams under their parents. Teams whose parent is gone are top level
+func buildTeamTree(teams []Team) []Team {
+	exists := make(map[int]bool)
+	byParent := make(map[int][]Team)
+	for _, t := range teams {
+		exists[t.ID] = true
+		byParent[t.ParentID] = append(byParent[t.ParentID], t)
+	}
+
+	seen := make(map[int]bool)
+	var nest func(t Team) Team
+	nest = func(t Team) Team {
+		seen[t.ID] = true
+		for _, child := range byParent[t.ID] {
+			if !seen[child.ID] {
+				t.Children = append(t.Children, nest(child))
+			}
+		}
+		return t
+	}
+
+	roots := make([]Team, 0)
+	for _, t := range teams {
+		if t.ParentID == 0 || !exists[t.ParentID] {
+			roots = append(roots, nest(t))
+		}
+	}
+	return roots
+}
+
+// checkTeamParent returns why parentID cannot be the team's parent, or "" if it can. 0 is always allowed and makes the team top level.
+// You have to own the parent too, so nobody can add their team's reps to someone else's roll up
+func (s *Server) checkTeamParent(r *http.Request, teamID, parentID int) (string, error) {
+	if parentID == 0 {
+		return "", nil
+	}
+
+	uid := r.Context().Value(ctxUID).(int)
+	owner, found, err := s.getTeamOwner(parentID)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "parent team not found", nil
+	}
+	if owner != uid && !s.isAdmin(r) {
+		return "you can only put your team under a team you own; ask an admin", nil
+	}
+
+	teams, err := s.getAllTeams(-1)
+	if err != nil {
+		return "", err
+	}
+	if inIntList(parentID, teamSubtree(teamID, teamChildren(teams.Collection))) {
+		return "a team cannot be under itself or one of its own sub teams", nil
+	}
+	return "", nil
+}
+
+func (s *Server) putTeamParent(teamID, parentID int) error {
+	if _, err := s.DB.Exec("update teams set parent_id=? where id=?", parentID, teamID); err != nil {
+		return fmt.Errorf("unable to putTeamParent: %w", err)
+	}
+	return nil
+}
+
+// similarTeams are the teams the user can see whose names are confusably close to name, to catch "Denver Office" when "Denver" exists
+func (s *Server) similarTeams(name string, uid int) ([]Team, error) {
+	teams, err := s.getAllTeams(-1)
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := s.getHiddenTeams(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	similar := make([]Team, 0)
+	for _, t := range teams.Collection {
+		if !inIntList(t.ID, hidden) && teamname.Similar(name, t.Name) {
+			similar = append(similar, t)
+		}
+	}
+	return similar, nil
+}
+
+func (s *Server) putTeamName(teamID int, name string) error {
+	if _, err := s.DB.Exec("update teams set name=? where id=?", name, teamID); err != nil {
+		return fmt.Errorf("unable to putTeamName: %w", err)
+	}
+	return nil
+}
+
+// mergeTeams moves everyone and everything on the from team to the into team, deletes the from team, and leaves a redirect to the into team.
+// It returns how many people were added to the into team; people already on both are only counted once
+func (s *Server) mergeTeams(fromID, intoID int) (int, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to begin mergeTeams: %w", err)
+	}
+
+	rows, err := tx.Query("select distinct user_id from user_teams where team_id=? and user_id not in (select user_id from user_teams where team_id=?)", fromID, intoID)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unable to query mergeTeams members: %w", err)
+	}
+	var moved []int
+	for rows.Next() {
+		var uid int
+		if err := rows.Scan(&uid); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, fmt.Errorf("unable to scan mergeTeams members: %w", err)
+		}
+		moved = append(moved, uid)
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("unexpected error after scanning mergeTeams members: %w", err)
+	}
+	rows.Close()
+
+	now := time.Now()
+	statements := []struct {
+		q    string
+		args []interface{}
+	}{
+		{"insert into user_teams (team_id, user_id) select distinct ?, user_id from user_teams where team_id=? and user_id not in (select user_id from user_teams where team_id=?)", []interface{}{intoID, fromID, intoID}},
+		{"delete from user_teams where team_id=?", []interface{}{fromID}},
+		{"update goals set team_id=? where team_id=?", []interface{}{intoID, fromID}},
+		{"insert or ignore into challenge_teams (challenge_id, team_id, joined_on) select challenge_id, ?, joined_on from challenge_teams where team_id=?", []interface{}{intoID, fromID}},
+		{"delete from challenge_teams where team_id=?", []interface{}{fromID}},
+		{"update teams set parent_id=? where parent_id=?", []interface{}{intoID, fromID}},
+		{"update team_invites set team_id=? where team_id=?", []interface{}{intoID, fromID}},
+		// anyone already asking to join the into team keeps that request
+		{"update or ignore team_join_requests set team_id=? where team_id=?", []interface{}{intoID, fromID}},
+		{"delete from team_join_requests where team_id=?", []interface{}{fromID}},
+		{"update team_redirects set to_team_id=? where to_team_id=?", []interface{}{intoID, fromID}},
+		{"insert or replace into team_redirects (from_team_id, to_team_id, created_on) values (?, ?, ?)", []interface{}{fromID, intoID, now.Unix()}},
+		{"delete from teams where id=?", []interface{}{fromID}},
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.q, stmt.args...); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("unable to mergeTeams: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit mergeTeams: %w", err)
+	}
+
+	for _, uid := range moved {
+		s.events.publish(TeamJoined{UserID: uid, TeamID: intoID, At: now})
+	}
+	return len(moved), nil
+}
+
+// getTeamRedirect is the team a merged team went to, or 0 if it was not merged
+func (s *Server) getTeamRedirect(teamID int) (int, error) {
+	var to int
+	err := s.DB.QueryRow("select to_team_id from team_redirects where from_team_id=?", teamID).Scan(&to)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to scan getTeamRedirect: %w", err)
+	}
+	return to, nil
+}
+
+// teamRedirect sends requests for a merged team to the same route on the team it was merged into.
+// 308 keeps the method and body, so writes follow the redirect too
+func (s *Server) teamRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rctx := chi.RouteContext(r.Context())
+		teamID, err := strconv.Atoi(chi.URLParam(r, "teamID"))
+		if rctx == nil || err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		to, err := s.getTeamRedirect(teamID)
+		if err != nil {
+			log.Printf("unable to check team redirect: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if to == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path := rctx.RoutePattern()
+		for i, key := range rctx.URLParams.Keys {
+			value := rctx.URLParams.Values[i]
+			if key == "teamID" {
+				value = strconv.Itoa(to)
+			}
+			path = strings.Replace(path, "{"+key+"}", value, 1)
+		}
+		if r.URL.RawQuery != "" {
+			path += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, path, http.StatusPermanentRedirect)
+	})
+}
+
+// PutTeam updates the team's settings. Team owners and admins only. Only the fields provided are changed.
+// Body: {"Name": "Denver", "HeadCount": 300, "ParentID": 2, "Visibility": "private"}, where a HeadCount of 0 goes back to counting members and a ParentID of 0 makes the team top level
+func (s *Server) PutTeam(w http.ResponseWriter, r *http.Request) {
+	teamID, ok := s.authorizeTeamOwner(w, r)
+	if !ok {
+		return
+	}
+	previous, err := s.getTeamByID(teamID)
+	if err != nil {
+		log.Printf("unable to PutTeam: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var update struct {
+		Name       *string
+		HeadCount  *int
+		ParentID   *int
+		Visibility *string
+	}
+	if err := json.Unmarshal(body, &update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if update.Name != nil {
+		*update.Name = teamname.Normalize(*update.Name)
+		if *update.Name == "" {
+			http.Error(w, "team name required", http.StatusBadRequest)
+			return
+		}
+		existing, err := s.getTeamByName(*update.Name)
+		if err != nil {
+			log.Printf("unable to PutTeam: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if existing != nil && existing.ID != teamID {
+			http.Error(w, fmt.Sprintf("there is already a team named %q; an admin can merge the two", *update.Name), http.StatusConflict)
+			return
+		}
+	}
+	if update.HeadCount != nil && *update.HeadCount < 0 {
+		http.Error(w, "HeadCount cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if update.Visibility != nil && !inList(*update.Visibility, []string{teamPublic, teamPrivate, teamInviteOnly}) {
+		http.Error(w, "Visibility must be one of public, private, or invite-only", http.StatusBadRequest)
+		return
+	}
+	if update.ParentID != nil {
+		reason, err := s.checkTeamParent(r, teamID, *update.ParentID)
+		if err != nil {
+			log.Printf("unable to PutTeam: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if reason != "" {
+			http.Error(w, reason, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if update.Name != nil {
+		if err := s.putTeamName(teamID, *update.Name); err != nil {
+			log.Printf("unable to PutTeam: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if update.HeadCount != nil {
+		if err := s.putTeamHeadCount(teamID, *update.HeadCount); err != nil {
+			log.Printf("unable to PutTeam: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if update.ParentID != nil {
+		if err := s.putTeamParent(teamID, *update.ParentID); err != nil {
+			log.Printf("unable to PutTeam: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if update.Visibility != nil {
+		if err := s.putTeamVisibility(teamID, *update.Visibility); err != nil {
+			log.Printf("unable to PutTeam: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	team, err := s.getTeamByID(teamID)
+	if err != nil {
+		log.Printf("unable to PutTeam: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.teamAuditRequest(r, teamID, AuditEntry{Action: "team.update", SubjectType: "team", SubjectID: teamID, Before: auditJSON(previous), After: auditJSON(team)})
+
+	if err := json.NewEncoder(w).Encode(team); err != nil {
+		log.Println("PutTeam marshal err ", err.Error())
+	}
+}
+
+// PostTeamMerge moves the team into another and leaves a redirect behind. Admins only. Body: {"Into": 2}
+func (s *Server) PostTeamMerge(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+	fromID, err := strconv.Atoi(chi.URLParam(r, "teamID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req struct{ Into int }
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, err := s.getTeamByID(fromID)
+	if err != nil {
+		log.Printf("unable to PostTeamMerge: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	into, err := s.getTeamByID(req.Into)
+	if err != nil {
+		log.Printf("unable to PostTeamMerge: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if from == nil {
+		http.Error(w, "team not found", http.StatusNotFound)
+		return
+	}
+	if into == nil || into.ID == from.ID {
+		http.Error(w, "Into must be another team", http.StatusBadRequest)
+		return
+	}
+
+	teams, err := s.getAllTeams(-1)
+	if err != nil {
+		log.Printf("unable to PostTeamMerge: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if inIntList(into.ID, teamSubtree(from.ID, teamChildren(teams.Collection))) {
+		http.Error(w, "a team cannot be merged into one of its own sub teams", http.StatusBadRequest)
+		return
+	}
+
+	moved, err := s.mergeTeams(from.ID, into.ID)
+	if err != nil {
+		log.Printf("unable to PostTeamMerge: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.auditRequest(r, -1, AuditEntry{Action: "team.merge", SubjectType: "team", SubjectID: from.ID, Before: auditJSON(from), After: auditJSON(struct {
+		Into  int
+		Moved int
+	}{into.ID, moved})})
+
+	data := struct {
+		Team  *Team
+		Moved int
+	}{into, moved}
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("PostTeamMerge marshal err ", err.Error())
+	}
+}
@@ -0,0 +1,452 @@
+package countmyreps
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetTeamSummary(t *testing.T) {
+	s, _ := newTestServer(t)
+	start := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 30)
+
+	// four on the team, two of whom logged anything during the window
+	owner := mustCreateUser(t, s, "owner@twilio.com")
+	team, err := s.postTeam("Per Capita", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := mustCreateUser(t, s, "active@twilio.com")
+	idle := mustCreateUser(t, s, "idle@twilio.com")
+	late := mustCreateUser(t, s, "late@twilio.com")
+	for _, uid := range []int{active, idle, late} {
+		if err := s.postMyTeams(team.ID, uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustInsertReps(t, s, owner, "Push Ups", 600, start.AddDate(0, 0, 2))
+	mustInsertReps(t, s, active, "Sit Ups", 400, start.AddDate(0, 0, 5))
+	mustInsertReps(t, s, late, "Push Ups", 5000, end.AddDate(0, 0, 1))
+
+	// ten days into the window
+	summary, err := s.getTeamSummary(team.ID, int(start.Unix()), int(end.Unix()), start.AddDate(0, 0, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := TeamSummary{
+		TeamID:                           team.ID,
+		Name:                             "Per Capita",
+		Start:                            int(start.Unix()),
+		End:                              int(end.Unix()),
+		Days:                             10,
+		Members:                          4,
+		HeadCount:                        4,
+		Participating:                    2,
+		PercentParticipating:             50,
+		TotalReps:                        1000,
+		RepsPerPerson:                    250,
+		RepsPerPersonParticipating:       500,
+		RepsPerPersonPerDay:              25,
+		RepsPerPersonParticipatingPerDay: 50,
+		TotalPoints:                      1000,
+		PointsPerPerson:                  250,
+		PointsPerPersonParticipating:     500,
+	}
+	got := *summary
+	got.Exercises = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+	if got, want := len(summary.Exercises), 2; got != want {
+		t.Errorf("got %d exercises, want %d", got, want)
+	}
+
+	// after the window, per day numbers use the whole window
+	summary, err = s.getTeamSummary(team.ID, int(start.Unix()), int(end.Unix()), end.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := summary.Days, 30; got != want {
+		t.Errorf("got %d days, want %d", got, want)
+	}
+
+	// an expected head count spreads the same reps over everyone who could have joined in
+	if err := s.putTeamHeadCount(team.ID, 10); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = s.getTeamSummary(team.ID, int(start.Unix()), int(end.Unix()), start.AddDate(0, 0, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.HeadCount != 10 || summary.PercentParticipating != 20 || summary.RepsPerPerson != 100 || summary.RepsPerPersonParticipating != 500 {
+		t.Errorf("got %+v, want head count 10, 20 percent participating, 100 per person, 500 per participant", summary)
+	}
+
+	if summary, err := s.getTeamSummary(9999, int(start.Unix()), int(end.Unix()), end); err != nil || summary != nil {
+		t.Errorf("got %+v, %v, want no summary for an unknown team", summary, err)
+	}
+}
+
+func TestTeamHeadCount(t *testing.T) {
+	tests := []struct {
+		headCount, members, want int
+	}{
+		{0, 4, 4},
+		{300, 4, 300},
+		// fewer than are actually on the team is not a useful denominator
+		{2, 4, 4},
+	}
+	for _, test := range tests {
+		if got := teamHeadCount(test.headCount, test.members); got != test.want {
+			t.Errorf("teamHeadCount(%d, %d) got %d, want %d", test.headCount, test.members, got, test.want)
+		}
+	}
+}
+
+func TestTeamRankingsHeadCount(t *testing.T) {
+	s, _ := newTestServer(t)
+	day := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+	start, end := int(day.AddDate(0, 0, -1).Unix()), int(day.AddDate(0, 0, 1).Unix())
+
+	// a big office where only one person signed up so far, against a real pair
+	office := mustCreateUser(t, s, "office@twilio.com")
+	big, err := s.postTeam("Big Office", office)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsertReps(t, s, office, "Push Ups", 300, day)
+
+	one := mustCreateUser(t, s, "one@twilio.com")
+	two := mustCreateUser(t, s, "two@twilio.com")
+	pair, err := s.postTeam("Pair", one)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postMyTeams(pair.ID, two); err != nil {
+		t.Fatal(err)
+	}
+	mustInsertReps(t, s, one, "Push Ups", 100, day)
+	mustInsertReps(t, s, two, "Push Ups", 100, day)
+
+	rankOf := func(teamID int) TeamRank {
+		t.Helper()
+		ranks, err := s.getTeamRankings(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range ranks {
+			if r.TeamID == teamID {
+				return r
+			}
+		}
+		t.Fatalf("team %d not ranked", teamID)
+		return TeamRank{}
+	}
+
+	if got := rankOf(big.ID); got.Rank != 1 || got.RepsPerPerson != 300 {
+		t.Errorf("got %+v, want the office first at 300 per person without a head count", got)
+	}
+
+	if err := s.putTeamHeadCount(big.ID, 30); err != nil {
+		t.Fatal(err)
+	}
+	if got := rankOf(big.ID); got.HeadCount != 30 || got.RepsPerPerson != 10 {
+		t.Errorf("got %+v, want 10 per person over a head count of 30", got)
+	}
+	if got := rankOf(pair.ID); got.Rank >= rankOf(big.ID).Rank {
+		t.Errorf("got the pair at rank %d, want them ahead of the office", got.Rank)
+	}
+}
+
+func TestTeamRollUp(t *testing.T) {
+	s, _ := newTestServer(t)
+	day := time.Date(2020, 11, 11, 12, 0, 0, 0, time.UTC)
+	start, end := int(day.AddDate(0, 0, -1).Unix()), int(day.AddDate(0, 0, 1).Unix())
+
+	admin := mustCreateUser(t, s, "admin@twilio.com")
+	dublin, err := s.postTeam("Dublin", admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.deleteMyTeams(dublin.ID, admin); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := s.getTeamByName("Dublin (Block)")
+	wall, _ := s.getTeamByName("Dublin (Wall)")
+	for _, team := range []*Team{block, wall} {
+		if err := s.putTeamParent(team.ID, dublin.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one person in each building, and one who works out of both
+	inBlock := mustCreateUser(t, s, "block@twilio.com")
+	inWall := mustCreateUser(t, s, "wall@twilio.com")
+	both := mustCreateUser(t, s, "both@twilio.com")
+	for _, m := range []struct{ team, uid int }{{block.ID, inBlock}, {wall.ID, inWall}, {block.ID, both}, {wall.ID, both}} {
+		if err := s.postMyTeams(m.team, m.uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustInsertReps(t, s, inBlock, "Push Ups", 100, day)
+	mustInsertReps(t, s, inWall, "Push Ups", 200, day)
+	mustInsertReps(t, s, both, "Push Ups", 300, day)
+
+	summary, err := s.getTeamSummary(dublin.ID, start, end, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Members != 3 || summary.Participating != 3 || summary.TotalReps != 600 {
+		t.Errorf("got %+v, want 3 members, 3 participating, 600 reps", summary)
+	}
+
+	ranks, err := s.getTeamRankings(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, r := range ranks {
+		if r.TeamID == dublin.ID {
+			found = true
+			if r.Members != 3 || r.TotalReps != 600 || r.RepsPerPerson != 200 {
+				t.Errorf("got %+v, want 3 members with 600 reps", r)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("got no ranking for Dublin, want its sub teams rolled up")
+	}
+
+	// deleting the middle of the tree keeps the rest of it together
+	sub, err := s.postTeam("Dublin (Block) Lunch", inBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.putTeamParent(sub.ID, block.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DB.Exec("update teams set created_by_user_id=? where id=?", admin, block.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.deleteTeam(block.ID, admin); err != nil {
+		t.Fatal(err)
+	}
+	if sub, _ = s.getTeamByID(sub.ID); sub.ParentID != dublin.ID {
+		t.Errorf("got parent %d after deleting the parent, want %d", sub.ParentID, dublin.ID)
+	}
+}
+
+func TestBuildTeamTree(t *testing.T) {
+	teams := []Team{
+		{ID: 1, Name: "Dublin"},
+		{ID: 2, Name: "Dublin (Block)", ParentID: 1},
+		{ID: 3, Name: "Dublin (Wall)", ParentID: 1},
+		{ID: 4, Name: "Block Engineering", ParentID: 2},
+		{ID: 5, Name: "Denver"},
+		{ID: 6, Name: "Orphan", ParentID: 99},
+	}
+
+	tree := buildTeamTree(teams)
+	if got, want := len(tree), 3; got != want {
+		t.Fatalf("got %d top level teams, want %d", got, want)
+	}
+	if got, want := len(tree[0].Children), 2; got != want {
+		t.Fatalf("got %d teams under Dublin, want %d", got, want)
+	}
+	if got, want := tree[0].Children[0].Children[0].Name, "Block Engineering"; got != want {
+		t.Errorf("got %q two levels down, want %q", got, want)
+	}
+	if got, want := tree[2].Name, "Orphan"; got != want {
+		t.Errorf("got %q, want a team with a missing parent at the top", got)
+	}
+
+	if got, want := teamSubtree(1, teamChildren(teams)), []int{1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got subtree %v, want %v", got, want)
+	}
+}
+
+func TestCheckTeamParent(t *testing.T) {
+	s, _ := newTestServer(t)
+	owner := mustCreateUser(t, s, "owner@twilio.com")
+	other := mustCreateUser(t, s, "other@twilio.com")
+
+	top, _ := s.postTeam("Top", owner)
+	middle, _ := s.postTeam("Middle", owner)
+	bottom, _ := s.postTeam("Bottom", owner)
+	theirs, _ := s.postTeam("Theirs", other)
+	if err := s.putTeamParent(middle.ID, top.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.putTeamParent(bottom.ID, middle.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("PUT", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxUID, owner))
+
+	tests := []struct {
+		name     string
+		team     int
+		parent   int
+		wantOkay bool
+	}{
+		{"top level", middle.ID, 0, true},
+		{"sibling", bottom.ID, top.ID, true},
+		{"itself", top.ID, top.ID, false},
+		{"under its own grandchild", top.ID, bottom.ID, false},
+		{"someone else's team", bottom.ID, theirs.ID, false},
+		{"missing", bottom.ID, 9999, false},
+	}
+	for _, test := range tests {
+		reason, err := s.checkTeamParent(r, test.team, test.parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reason == ""; got != test.wantOkay {
+			t.Errorf("%s: got ok %t (%q), want %t", test.name, got, reason, test.wantOkay)
+		}
+	}
+}
+
+func TestRenameTeam(t *testing.T) {
+	s, _ := newTestServer(t)
+	owner := newTestClient(t, s, "owner@twilio.com")
+	team, err := s.postTeam("Lunch Crew", owner.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/v3/teams/%d", team.ID)
+
+	if w := owner.do("PUT", path, `{"Name": "denver "}`); w.Code != http.StatusConflict {
+		t.Errorf("got %d renaming onto a seeded team, want %d", w.Code, http.StatusConflict)
+	}
+	if w := owner.do("PUT", path, `{"Name": "  "}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for a blank name, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := owner.do("PUT", path, `{"Name": " Denver  Lunch Crew "}`); w.Code != http.StatusOK {
+		t.Fatalf("got %d renaming, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if team, _ = s.getTeamByID(team.ID); team.Name != "Denver Lunch Crew" {
+		t.Errorf("got name %q, want it renamed and trimmed", team.Name)
+	}
+}
+
+func TestMergeTeams(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.conf.Admins = []string{"admin@twilio.com"}
+	admin := newTestClient(t, s, "admin@twilio.com")
+	owner := newTestClient(t, s, "owner@twilio.com")
+
+	denver, _ := s.getTeamByName("Denver")
+	// duplicates from before names were normalized
+	res, err := s.DB.Exec("insert into teams (name, created_by_user_id) values ('denver', ?)", owner.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupeID, _ := res.LastInsertId()
+	dupe := &Team{ID: int(dupeID), Name: "denver"}
+	if err := s.postMyTeams(dupe.ID, owner.UID); err != nil {
+		t.Fatal(err)
+	}
+	// owner ends up on both, and one more person only on the duplicate
+	if err := s.postMyTeams(denver.ID, owner.UID); err != nil {
+		t.Fatal(err)
+	}
+	other := mustCreateUser(t, s, "other@twilio.com")
+	if err := s.postMyTeams(dupe.ID, other); err != nil {
+		t.Fatal(err)
+	}
+	g := &Goal{TeamID: dupe.ID, Exercise: "Squats", Target: 1000, Period: goalWeek, Start: "2020-11-01"}
+	if err := s.validateGoal(g); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postGoal(owner.UID, g); err != nil {
+		t.Fatal(err)
+	}
+
+	mergePath := fmt.Sprintf("/v3/admin/teams/%d/merge", dupe.ID)
+	body := fmt.Sprintf(`{"Into": %d}`, denver.ID)
+	if w := owner.do("POST", mergePath, body); w.Code != http.StatusForbidden {
+		t.Errorf("got %d for a non admin merge, want %d", w.Code, http.StatusForbidden)
+	}
+	w := admin.do("POST", mergePath, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d merging, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var merged struct{ Moved int }
+	json.NewDecoder(w.Body).Decode(&merged)
+	if got, want := merged.Moved, 1; got != want {
+		t.Errorf("got %d moved, want %d since owner was already on both", got, want)
+	}
+
+	members, err := s.getTeamMembers(denver.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(members), 2; got != want {
+		t.Errorf("got %d members, want %d without duplicates", got, want)
+	}
+	var dupes int
+	s.DB.QueryRow("select count(*) from user_teams where team_id=? and user_id=?", denver.ID, owner.UID).Scan(&dupes)
+	if dupes != 1 {
+		t.Errorf("got %d memberships for someone on both teams, want 1", dupes)
+	}
+	if gone, _ := s.getTeamByID(dupe.ID); gone != nil {
+		t.Errorf("got %+v, want the merged team gone", gone)
+	}
+	if goals, _ := s.getTeamGoals(denver.ID, time.Now()); len(goals) != 1 {
+		t.Errorf("got %d goals, want the merged team's goal moved", len(goals))
+	}
+
+	w = owner.do("GET", fmt.Sprintf("/v3/teams/%d/summary?startdate=1", dupe.ID), "")
+	if w.Code != http.StatusPermanentRedirect {
+		t.Fatalf("got %d for the old team id, want %d", w.Code, http.StatusPermanentRedirect)
+	}
+	if got, want := w.Header().Get("Location"), fmt.Sprintf("/v3/teams/%d/summary?startdate=1", denver.ID); got != want {
+		t.Errorf("got redirect to %q, want %q", got, want)
+	}
+
+	if w := admin.do("POST", fmt.Sprintf("/v3/admin/teams/%d/merge", denver.ID), fmt.Sprintf(`{"Into": %d}`, denver.ID)); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d merging a team into itself, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPostTeamsNormalizesNames(t *testing.T) {
+	s, _ := newTestServer(t)
+	c := newTestClient(t, s, "someone@twilio.com")
+	munich, _ := s.getTeamByName("München")
+
+	// the seeded team, typed with a combining umlaut and different case
+	w := c.do("POST", "/v3/teams", `{"Name": "  mu\u0308nchen "}`)
+	var team Team
+	if err := json.NewDecoder(w.Body).Decode(&team); err != nil {
+		t.Fatal(err)
+	}
+	if team.ID != munich.ID {
+		t.Errorf("got team %+v, want the existing %+v", team, munich)
+	}
+
+	w = c.do("POST", "/v3/teams", `{"Name": "Denver Office"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got %d for a near duplicate, want %d", w.Code, http.StatusConflict)
+	}
+	var conflict struct{ Suggestions []Team }
+	if err := json.NewDecoder(w.Body).Decode(&conflict); err != nil {
+		t.Fatal(err)
+	}
+	if len(conflict.Suggestions) == 0 || conflict.Suggestions[0].Name != "Denver" {
+		t.Errorf("got suggestions %+v, want Denver", conflict.Suggestions)
+	}
+
+	w = c.do("POST", "/v3/teams", `{"Name": "Denver Office", "Force": true}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d forcing a new team, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,591 @@
+package countmyreps
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	webhookRepCreated = "rep.created"
+	webhookRepEdited  = "rep.edited"
+	webhookRepDeleted = "rep.deleted"
+	webhookTeamJoined = "team.joined"
+	webhookTeamLeft   = "team.left"
+)
+
+var webhookEvents = []string{webhookRepCreated, webhookRepEdited, webhookRepDeleted, webhookTeamJoined, webhookTeamLeft}
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// Webhook is a url that is POSTed to when the owner's events happen. Admins can register AllUsers webhooks that get everyone's events
+type Webhook struct {
+	ID       int
+	URL      string
+	Events   []string
+	AllUsers bool
+	// Secret signs every delivery. It is only returned when the webhook is created
+	Secret    string `json:",omitempty"`
+	CreatedOn int
+}
+
+// WebhookPayload is the json body of a delivery. Rep is the new state of a created or edited rep, Previous the state before an edit or delete.
+// Rolling back an import sends one rep.deleted per person with every removed rep in PreviousReps instead of Previous
+type WebhookPayload struct {
+	Event        string
+	OccurredOn   int64
+	UserID       int
+	Email        string
+	Rep          *Rep  `json:",omitempty"`
+	Previous     *Rep  `json:",omitempty"`
+	PreviousReps []Rep `json:",omitempty"`
+	Team         *Team `json:",omitempty"`
+}
+
+// WebhookDelivery is one attempt-tracked delivery of an event to a webhook
+type WebhookDelivery struct {
+	ID             int
+	WebhookID      int
+	Event          string
+	Status         string
+	Attempts       int
+	NextAttemptOn  int
+	LastStatusCode int
+	LastError      string
+	CreatedOn      int
+	DeliveredOn    int
+}
+
+// handleWebhookEvent is the event bus subscriber that turns domain events into webhook deliveries
+func (s *Server) handleWebhookEvent(e Event) error {
+	switch e := e.(type) {
+	case RepsLogged:
+		for _, rep := range e.Reps {
+			rep := rep
+			if err := s.enqueueWebhooks(webhookRepCreated, e.At, e.UserID, WebhookPayload{Rep: &rep}); err != nil {
+				return err
+			}
+		}
+	case RepEdited:
+		return s.enqueueWebhooks(webhookRepEdited, e.At, e.UserID, WebhookPayload{Rep: &e.Rep, Previous: &e.Previous})
+	case RepDeleted:
+		return s.enqueueWebhooks(webhookRepDeleted, e.At, e.UserID, WebhookPayload{Previous: &e.Previous})
+	case RepsDeleted:
+		return s.enqueueWebhooks(webhookRepDeleted, e.At, e.UserID, WebhookPayload{PreviousReps: e.Previous})
+	case TeamJoined:
+		return s.enqueueWebhooks(webhookTeamJoined, e.At, e.UserID, WebhookPayload{Team: s.teamForPayload(e.TeamID)})
+	case TeamLeft:
+		return s.enqueueWebhooks(webhookTeamLeft, e.At, e.UserID, WebhookPayload{Team: s.teamForPayload(e.TeamID)})
+	}
+	return nil
+}
+
+// enqueueWebhooks queues a delivery of the event for every matching webhook
+func (s *Server) enqueueWebhooks(event string, at time.Time, uid int, payload WebhookPayload) error {
+	q := "select id, events from webhooks where user_id=? or all_users=1"
+	rows, err := s.DB.Query(q, uid)
+	if err != nil {
+		return fmt.Errorf("unable to query webhooks for %s: %w", event, err)
+	}
+
+	var hookIDs []int
+	for rows.Next() {
+		var id int
+		var events string
+		if err := rows.Scan(&id, &events); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to scan webhooks for %s: %w", event, err)
+		}
+		if inList(event, strings.Split(events, ",")) {
+			hookIDs = append(hookIDs, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unexpected error after scanning webhooks for %s: %w", event, err)
+	}
+
+	if len(hookIDs) == 0 {
+		return nil
+	}
+
+	payload.Event = event
+	payload.OccurredOn = at.Unix()
+	payload.UserID = uid
+	payload.Email, err = s.getUserEmail(uid)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("unable to marshal %s webhook: %w", event, err)
+	}
+
+	now := time.Now().Unix()
+	q = "insert into webhook_deliveries (webhook_id, event, payload, status, next_attempt_on, created_on) values (?, ?, ?, ?, ?, ?)"
+	for _, id := range hookIDs {
+		if _, err := s.DB.Exec(q, id, event, string(body), deliveryPending, now, now); err != nil {
+			return fmt.Errorf("unable to queue %s webhook %d: %w", event, id, err)
+		}
+	}
+
+	// wake the delivery worker; if it is already awake, it will pick these up
+	select {
+	case s.webhookKick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// teamForPayload is best effort; a missing team is still worth telling webhooks about by id
+func (s *Server) teamForPayload(teamID int) *Team {
+	team, err := s.getTeamByID(teamID)
+	if err != nil || team == nil {
+		return &Team{ID: teamID}
+	}
+	return team
+}
+
+// runWebhookDeliveries delivers queued webhooks until the server is closed. It wakes when new deliveries are queued and every WebhookPollInterval for retries
+func (s *Server) runWebhookDeliveries() {
+	ticker := time.NewTicker(s.conf.WebhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		case <-s.webhookKick:
+		}
+		if err := s.deliverWebhooks(time.Now()); err != nil {
+			log.Printf("unable to deliver webhooks: %s", err.Error())
+		}
+	}
+}
+
+type pendingDelivery struct {
+	id       int
+	event    string
+	payload  string
+	attempts int
+	url      string
+	secret   string
+}
+
+// deliverWebhooks attempts every pending delivery that is due. Failures are retried with exponential backoff until WebhookMaxAttempts
+func (s *Server) deliverWebhooks(now time.Time) error {
+	q := "select webhook_deliveries.id, webhook_deliveries.event, webhook_deliveries.payload, webhook_deliveries.attempts, webhooks.url, webhooks.secret from webhook_deliveries join webhooks on webhooks.id=webhook_deliveries.webhook_id where webhook_deliveries.status=? and webhook_deliveries.next_attempt_on<=? order by webhook_deliveries.id limit 100"
+	rows, err := s.DB.Query(q, deliveryPending, now.Unix())
+	if err != nil {
+		return fmt.Errorf("unable to query pending webhook deliveries: %w", err)
+	}
+
+	var pending []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to scan pending webhook deliveries: %w", err)
+		}
+		pending = append(pending, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unexpected error after scanning pending webhook deliveries: %w", err)
+	}
+
+	for _, d := range pending {
+		attempts := d.attempts + 1
+		code, err := s.postWebhook(d, now)
+		if err == nil {
+			q := "update webhook_deliveries set status=?, attempts=?, last_status_code=?, last_error='', delivered_on=? where id=?"
+			if _, err := s.DB.Exec(q, deliveryDelivered, attempts, code, now.Unix(), d.id); err != nil {
+				return fmt.Errorf("unable to mark webhook delivery %d delivered: %w", d.id, err)
+			}
+			continue
+		}
+
+		status := deliveryPending
+		if attempts >= s.conf.WebhookMaxAttempts {
+			status = deliveryFailed
+		}
+		q := "update webhook_deliveries set status=?, attempts=?, last_status_code=?, last_error=?, next_attempt_on=? where id=?"
+		if _, err := s.DB.Exec(q, status, attempts, code, err.Error(), now.Add(webhookBackoff(attempts)).Unix(), d.id); err != nil {
+			return fmt.Errorf("unable to record webhook delivery %d failure: %w", d.id, err)
+		}
+	}
+
+	return nil
+}
+
+// privateNetworks are the ranges set aside for private networks, which the net package has no check for in the go version we target,
+// along with carrier-grade NAT, "this network", and benchmarking ranges that can also reach internal hosts
+var privateNetworks = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7", "100.64.0.0/10", "0.0.0.0/8", "198.18.0.0/15"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// blockedWebhookIP is true for addresses webhooks must not reach: loopback, private, link-local (which includes cloud metadata
+// services), and unspecified
+func blockedWebhookIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebhookHost resolves a webhook's host when it is registered and rejects it if any of its addresses are blocked
+func (s *Server) checkWebhookHost(host string) error {
+	if s.conf.WebhookAllowPrivate {
+		return nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return fmt.Errorf("unable to resolve webhook host %s", host)
+	}
+	for _, ip := range ips {
+		if blockedWebhookIP(ip) {
+			return fmt.Errorf("webhook URL must not point at a loopback, private, or link-local address")
+		}
+	}
+	return nil
+}
+
+// newWebhookClient checks every address it connects to, after it is resolved, so a host that resolved to a public address when
+// the webhook was registered cannot later be pointed at a blocked one. It never uses a proxy, which would hide the address
+func (s *Server) newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if s.conf.WebhookAllowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || blockedWebhookIP(ip) {
+				return fmt.Errorf("webhook address %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// postWebhook sends one delivery. Anything other than a 2xx is a failure
+func (s *Server) postWebhook(d pendingDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.url, strings.NewReader(d.payload))
+	if err != nil {
+		return 0, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	ts := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "CountMyReps-Webhook")
+	req.Header.Set("X-CountMyReps-Event", d.event)
+	req.Header.Set("X-CountMyReps-Delivery", strconv.Itoa(d.id))
+	req.Header.Set("X-CountMyReps-Timestamp", ts)
+	req.Header.Set("X-CountMyReps-Signature", "sha256="+signWebhook(d.secret, ts, []byte(d.payload)))
+
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook is the hex HMAC-SHA256 of "{timestamp}.{body}". Receivers should recompute it with their secret and reject stale timestamps
+func signWebhook(secret string, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff doubles from 30 seconds after each failed attempt, up to 6 hours
+func webhookBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= 6*time.Hour {
+			return 6 * time.Hour
+		}
+	}
+	return backoff
+}
+
+func inList(s string, list []string) bool {
+	for _, elem := range list {
+		if s == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// getWebhooks for the given uid. If the uid is <0, return all webhooks
+func (s *Server) getWebhooks(uid int) ([]Webhook, error) {
+	var rows *sql.Rows
+	var err error
+
+	if uid < 0 {
+		rows, err = s.DB.Query("select id, url, events, all_users, created_on from webhooks order by id")
+	} else {
+		rows, err = s.DB.Query("select id, url, events, all_users, created_on from webhooks where user_id=? order by id", uid)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getWebhooks: %w", err)
+	}
+	defer rows.Close()
+
+	hooks := make([]Webhook, 0)
+	for rows.Next() {
+		var h Webhook
+		var events string
+		if err := rows.Scan(&h.ID, &h.URL, &events, &h.AllUsers, &h.CreatedOn); err != nil {
+			return nil, fmt.Errorf("unable to scan getWebhooks: %w", err)
+		}
+		h.Events = strings.Split(events, ",")
+		hooks = append(hooks, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getWebhooks: %w", err)
+	}
+	return hooks, nil
+}
+
+// getWebhookOwner returns 0 if the webhook does not exist
+func (s *Server) getWebhookOwner(webhookID int) (int, error) {
+	var uid int
+	err := s.DB.QueryRow("select user_id from webhooks where id=?", webhookID).Scan(&uid)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("unable to scan getWebhookOwner: %w", err)
+	}
+	return uid, nil
+}
+
+func (s *Server) postWebhooks(uid int, h *Webhook) error {
+	h.Secret = randToken()
+	h.CreatedOn = int(time.Now().Unix())
+
+	q := "insert into webhooks (user_id, url, secret, events, all_users, created_on) values (?, ?, ?, ?, ?, ?)"
+	res, err := s.DB.Exec(q, uid, h.URL, h.Secret, strings.Join(h.Events, ","), h.AllUsers, h.CreatedOn)
+	if err != nil {
+		return fmt.Errorf("unable to insert webhook: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("unable to get last insert id for webhook: %w", err)
+	}
+	h.ID = int(id)
+	return nil
+}
+
+func (s *Server) deleteWebhook(webhookID int) error {
+	if _, err := s.DB.Exec("delete from webhook_deliveries where webhook_id=?", webhookID); err != nil {
+		return fmt.Errorf("unable to delete webhook deliveries: %w", err)
+	}
+	if _, err := s.DB.Exec("delete from webhooks where id=?", webhookID); err != nil {
+		return fmt.Errorf("unable to deleteWebhook: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) getWebhookDeliveries(webhookID int, limit int) ([]WebhookDelivery, error) {
+	q := "select id, webhook_id, event, status, attempts, next_attempt_on, last_status_code, last_error, created_on, delivered_on from webhook_deliveries where webhook_id=? order by id desc limit ?"
+	rows, err := s.DB.Query(q, webhookID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query getWebhookDeliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &d.NextAttemptOn, &d.LastStatusCode, &d.LastError, &d.CreatedOn, &d.DeliveredOn); err != nil {
+			return nil, fmt.Errorf("unable to scan getWebhookDeliveries: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unexpected error after scanning getWebhookDeliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+func (s *Server) isAdmin(r *http.Request) bool {
+	email, _ := r.Context().Value(ctxEmail).(string)
+	return s.conf.IsAdmin(email)
+}
+
+// GetWebhooks lists your webhooks. Admins see every webhook
+func (s *Server) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	if s.isAdmin(r) {
+		uid = -1
+	}
+
+	data, err := s.getWebhooks(uid)
+	if err != nil {
+		log.Printf("unable to GetWebhooks: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Webhooks []Webhook }{data}); err != nil {
+		log.Println("GetWebhooks marshal err ", err.Error())
+	}
+}
+
+func (s *Server) PostWebhooks(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(ctxUID).(int)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hook := &Webhook{}
+	if err := json.Unmarshal(body, hook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(hook.URL)
+	if err != nil || !(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+		http.Error(w, "webhook URL must be an absolute http or https url", http.StatusBadRequest)
+		return
+	}
+	if err := s.checkWebhookHost(u.Hostname()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(hook.Events) == 0 {
+		hook.Events = webhookEvents
+	}
+	for _, event := range hook.Events {
+		if !inList(event, webhookEvents) {
+			http.Error(w, fmt.Sprintf("unknown event %q, must be one of %s", event, strings.Join(webhookEvents, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+	if hook.AllUsers && !s.isAdmin(r) {
+		http.Error(w, "only admins can register webhooks for all users", http.StatusForbidden)
+		return
+	}
+
+	if err := s.postWebhooks(uid, hook); err != nil {
+		log.Printf("unable to PostWebhooks: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(hook); err != nil {
+		log.Println("PostWebhooks marshal err ", err.Error())
+	}
+}
+
+func (s *Server) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := s.authorizeWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.deleteWebhook(webhookID); err != nil {
+		log.Printf("unable to DeleteWebhook: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries is the delivery log for a webhook, newest first. Options: ?limit={:n:} (default 50, max 500)
+func (s *Server) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := s.authorizeWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 50
+	}
+	if limit > 500 {
+		limit = 500
+	}
+
+	data, err := s.getWebhookDeliveries(webhookID, limit)
+	if err != nil {
+		log.Printf("unable to GetWebhookDeliveries: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(struct{ Deliveries []WebhookDelivery }{data}); err != nil {
+		log.Println("GetWebhookDeliveries marshal err ", err.Error())
+	}
+}
+
+// authorizeWebhook parses the webhookID url param and checks the caller owns it or is an admin. It writes the error response when not ok
+func (s *Server) authorizeWebhook(w http.ResponseWriter, r *http.Request) (int, bool) {
+	uid := r.Context().Value(ctxUID).(int)
+	webhookID, err := strconv.Atoi(chi.URLParam(r, "webhookID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+
+	owner, err := s.getWebhookOwner(webhookID)
+	if err != nil {
+		log.Printf("unable to authorize webhook: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	if owner == 0 || (owner != uid && !s.isAdmin(r)) {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return 0, false
+	}
+
+	return webhookID, true
+}
@@ -0,0 +1,270 @@
+package countmyreps
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records deliveries it could verify and answers with the next status code in codes, then 200s
+type webhookReceiver struct {
+	mu       sync.Mutex
+	secret   string
+	codes    []int
+	payloads []WebhookPayload
+	badSigs  int
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	ts := r.Header.Get("X-CountMyReps-Timestamp")
+	if r.Header.Get("X-CountMyReps-Signature") != "sha256="+signWebhook(wr.secret, ts, body) {
+		wr.badSigs++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	code := http.StatusOK
+	if len(wr.codes) > 0 {
+		code, wr.codes = wr.codes[0], wr.codes[1:]
+	}
+	if code == http.StatusOK {
+		var p WebhookPayload
+		json.Unmarshal(body, &p)
+		wr.payloads = append(wr.payloads, p)
+	}
+	w.WriteHeader(code)
+}
+
+func getDelivery(t *testing.T, s *Server, webhookID int) WebhookDelivery {
+	t.Helper()
+	deliveries, err := s.getWebhookDeliveries(webhookID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(deliveries), 1; got != want {
+		t.Fatalf("got %d deliveries, want %d", got, want)
+	}
+	return deliveries[0]
+}
+
+func TestWebhookDeliveryRetries(t *testing.T) {
+	s, _ := newTestServer(t)
+	receiver := &webhookReceiver{codes: []int{http.StatusInternalServerError}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	// the receiver listens on loopback
+	s.conf.WebhookAllowPrivate = true
+
+	uid := mustCreateUser(t, s, "seth.ammons@twilio.com")
+	hook := &Webhook{URL: srv.URL, Events: []string{webhookRepCreated}}
+	if err := s.postWebhooks(uid, hook); err != nil {
+		t.Fatal(err)
+	}
+	receiver.secret = hook.Secret
+
+	if _, err := s.postStats(uid, Exercises{Collection: []Exercise{{Name: "Push Ups", Count: 20}}}); err != nil {
+		t.Fatal(err)
+	}
+	s.events.wait()
+
+	now := time.Now()
+	if err := s.deliverWebhooks(now); err != nil {
+		t.Fatal(err)
+	}
+	d := getDelivery(t, s, hook.ID)
+	if got, want := d.Status, deliveryPending; got != want {
+		t.Errorf("got status %q after a 500, want %q", got, want)
+	}
+	if got, want := d.LastStatusCode, http.StatusInternalServerError; got != want {
+		t.Errorf("got last status code %d, want %d", got, want)
+	}
+	if got, want := d.NextAttemptOn, int(now.Add(30*time.Second).Unix()); got != want {
+		t.Errorf("got next attempt %d, want %d", got, want)
+	}
+
+	// not due yet
+	if err := s.deliverWebhooks(now.Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := getDelivery(t, s, hook.ID).Attempts, 1; got != want {
+		t.Errorf("got %d attempts before the backoff elapsed, want %d", got, want)
+	}
+
+	if err := s.deliverWebhooks(now.Add(31 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	d = getDelivery(t, s, hook.ID)
+	if got, want := d.Status, deliveryDelivered; got != want {
+		t.Errorf("got status %q, want %q", got, want)
+	}
+	if got, want := d.Attempts, 2; got != want {
+		t.Errorf("got %d attempts, want %d", got, want)
+	}
+
+	if got, want := receiver.badSigs, 0; got != want {
+		t.Errorf("got %d bad signatures, want %d", got, want)
+	}
+	if got, want := len(receiver.payloads), 1; got != want {
+		t.Fatalf("got %d payloads, want %d", got, want)
+	}
+	p := receiver.payloads[0]
+	if p.Event != webhookRepCreated || p.UserID != uid || p.Email != "seth.ammons@twilio.com" {
+		t.Errorf("got payload %+v, want rep.created for uid %d", p, uid)
+	}
+	if p.Rep == nil || p.Rep.Count != 20 || p.Rep.Name != "Push Ups" {
+		t.Errorf("got rep %+v, want 20 pushups", p.Rep)
+	}
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	s, _ := newTestServer(t)
+	receiver := &webhookReceiver{codes: []int{500, 500, 500, 500}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	// the receiver listens on loopback
+	s.conf.WebhookAllowPrivate = true
+
+	uid := mustCreateUser(t, s, "seth.ammons@twilio.com")
+	hook := &Webhook{URL: srv.URL, Events: webhookEvents}
+	if err := s.postWebhooks(uid, hook); err != nil {
+		t.Fatal(err)
+	}
+	receiver.secret = hook.Secret
+
+	if err := s.enqueueWebhooks(webhookTeamJoined, time.Now(), uid, WebhookPayload{Team: &Team{ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		now = now.Add(7 * time.Hour)
+		if err := s.deliverWebhooks(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := getDelivery(t, s, hook.ID)
+	if got, want := d.Status, deliveryFailed; got != want {
+		t.Errorf("got status %q, want %q", got, want)
+	}
+	if got, want := d.Attempts, s.conf.WebhookMaxAttempts; got != want {
+		t.Errorf("got %d attempts, want %d", got, want)
+	}
+}
+
+func TestEnqueueWebhooksMatching(t *testing.T) {
+	s, _ := newTestServer(t)
+	seth := mustCreateUser(t, s, "seth.ammons@twilio.com")
+	other := mustCreateUser(t, s, "someone@twilio.com")
+
+	hooks := map[string]*Webhook{
+		"mine, subscribed":     {URL: "http://localhost/1", Events: []string{webhookRepDeleted}},
+		"mine, not subscribed": {URL: "http://localhost/2", Events: []string{webhookRepCreated}},
+		"all users":            {URL: "http://localhost/3", Events: []string{webhookRepDeleted}, AllUsers: true},
+		"someone else's":       {URL: "http://localhost/4", Events: []string{webhookRepDeleted}},
+	}
+	want := map[string]int{"mine, subscribed": 1, "mine, not subscribed": 0, "all users": 1, "someone else's": 0}
+	for name, hook := range hooks {
+		owner := seth
+		if name == "someone else's" || name == "all users" {
+			owner = other
+		}
+		if err := s.postWebhooks(owner, hook); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.enqueueWebhooks(webhookRepDeleted, time.Now(), seth, WebhookPayload{Previous: &Rep{ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, hook := range hooks {
+		deliveries, err := s.getWebhookDeliveries(hook.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(deliveries), want[name]; got != want {
+			t.Errorf("%s: got %d deliveries, want %d", name, got, want)
+		}
+	}
+}
+
+func TestWebhookBlockedAddresses(t *testing.T) {
+	s, _ := newTestServer(t)
+	c := newTestClient(t, s, "seth.ammons@twilio.com")
+
+	for _, u := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://10.1.2.3/hook",
+		"http://172.16.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"http://0.1.2.3/hook",
+		"http://100.64.0.1/hook",
+		"http://100.127.255.254/hook",
+		"http://198.18.0.1/hook",
+		"http://198.19.255.254/hook",
+		"http://[::1]/hook",
+		"http://[fe80::1]/hook",
+		"http://[fd00::1]/hook",
+	} {
+		w := c.do("POST", "/v3/webhooks", fmt.Sprintf(`{"URL": %q}`, u))
+		if got, want := w.Code, http.StatusBadRequest; got != want {
+			t.Errorf("%s: got %d, want %d", u, got, want)
+		}
+	}
+	if got, want := c.do("POST", "/v3/webhooks", `{"URL": "https://93.184.216.34/hook", "Events": ["rep.deleted"]}`).Code, http.StatusCreated; got != want {
+		t.Errorf("got %d for a public address, want %d", got, want)
+	}
+
+	// a webhook that got past registration, say by its host being pointed somewhere else later, is still not delivered
+	receiver := &webhookReceiver{}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	hook := &Webhook{URL: srv.URL, Events: []string{webhookTeamJoined}}
+	if err := s.postWebhooks(c.UID, hook); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.enqueueWebhooks(webhookTeamJoined, time.Now(), c.UID, WebhookPayload{Team: &Team{ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.deliverWebhooks(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if d := getDelivery(t, s, hook.ID); d.Status == deliveryDelivered || d.LastError == "" {
+		t.Errorf("got delivery %+v to a loopback address, want it refused", d)
+	}
+	if got := len(receiver.payloads); got != 0 {
+		t.Errorf("got %d payloads at a loopback address, want none", got)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{5, 8 * time.Minute},
+		{10, 4*time.Hour + 16*time.Minute},
+		{11, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, test := range tests {
+		if got := webhookBackoff(test.attempts); got != test.want {
+			t.Errorf("got %s, want %s for %d attempts", got, test.want, test.attempts)
+		}
+	}
+}